@@ -88,6 +88,8 @@ func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 		return t.precommit(stub, args)
 	} else if function == "commit" {
 		return t.commit(stub, args)
+	} else if function == "abort" {
+		return t.abort(stub, args)
 	}
 
 	return shim.Error("Invalid invoke function name. Expecting \"invoke\" \"delete\" \"query\"")
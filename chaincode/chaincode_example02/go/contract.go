@@ -64,27 +64,32 @@ func (t *SimpleChaincode) commit(stub shim.ChaincodeStubInterface, args []string
 
 	rawContract, err := stub.GetState(contractID)
 	if err != nil {
-		shim.Error(fmt.Sprintf("get contract by %s, err: %v", contractID, err))
+		return shim.Error(fmt.Sprintf("get contract by %s, err: %v", contractID, err))
 	} else if rawContract == nil {
-		shim.Error(fmt.Sprintf("invalid contractid %s", contractID))
+		return shim.Error(fmt.Sprintf("invalid contractid %s", contractID))
 	}
 
 	var contract Contract
 	if err = json.Unmarshal(rawContract, &contract); err != nil {
-		shim.Error(fmt.Sprintf("parse contract with %s, err: %v", contractID, err))
+		return shim.Error(fmt.Sprintf("parse contract with %s, err: %v", contractID, err))
 	}
 
+	// courier resubmits the commit after a restart, the repeated call must not execute the contract again
 	if contract.GetStatus() == Finished {
-		shim.Success([]byte("replicate call commit"))
+		return shim.Success([]byte("replicate call commit"))
+	}
+
+	if contract.GetStatus() == Aborted {
+		return shim.Error(fmt.Sprintf("contract %s aborted", contractID))
 	}
 
 	preCommit, ok := contract.IContract.(*PrecommitContract)
 	if !ok {
-		shim.Error(fmt.Sprintf("assert contract.IContract.(*PrecommitContract) failed"))
+		return shim.Error(fmt.Sprintf("assert contract.IContract.(*PrecommitContract) failed"))
 	}
 
 	if err = t.doCommit(stub, preCommit); err != nil {
-		shim.Error(fmt.Sprintf("doCommit err: %v", err))
+		return shim.Error(fmt.Sprintf("doCommit err: %v", err))
 	}
 
 	preCommit.UpdateStatus(Finished)
@@ -92,12 +97,12 @@ func (t *SimpleChaincode) commit(stub shim.ChaincodeStubInterface, args []string
 
 	updateData, err := json.Marshal(contract)
 	if err != nil {
-		shim.Error(err.Error())
+		return shim.Error(err.Error())
 	}
 
 	// store to ledger
 	if err = stub.PutState(contractID, updateData); err != nil {
-		shim.Error(err.Error())
+		return shim.Error(err.Error())
 	}
 
 	commit := Contract{
@@ -108,7 +113,7 @@ func (t *SimpleChaincode) commit(stub shim.ChaincodeStubInterface, args []string
 
 	rawCommit, err := json.Marshal(commit)
 	if err != nil {
-		shim.Error(err.Error())
+		return shim.Error(err.Error())
 	}
 
 	// send event
@@ -119,6 +124,62 @@ func (t *SimpleChaincode) commit(stub shim.ChaincodeStubInterface, args []string
 	return shim.Success(nil)
 }
 
+//abort <contractID, reason>
+// release the precommit contract, the later commit is rejected
+func (t *SimpleChaincode) abort(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+
+	contractID := args[0]
+	reason := args[1]
+
+	rawContract, err := stub.GetState(contractID)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("get contract by %s, err: %v", contractID, err))
+	} else if rawContract == nil {
+		return shim.Error(fmt.Sprintf("invalid contractid %s", contractID))
+	}
+
+	var contract Contract
+	if err = json.Unmarshal(rawContract, &contract); err != nil {
+		return shim.Error(fmt.Sprintf("parse contract with %s, err: %v", contractID, err))
+	}
+
+	switch contract.GetStatus() {
+	case Aborted:
+		return shim.Success([]byte("replicate call abort"))
+	case Finished:
+		return shim.Error(fmt.Sprintf("contract %s already finished", contractID))
+	}
+
+	preCommit, ok := contract.IContract.(*PrecommitContract)
+	if !ok {
+		return shim.Error(fmt.Sprintf("assert contract.IContract.(*PrecommitContract) failed"))
+	}
+
+	preCommit.UpdateStatus(Aborted)
+
+	updateData, err := json.Marshal(contract)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// store to ledger
+	if err = stub.PutState(contractID, updateData); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Printf("abort contract %s: %s\n", contractID, reason)
+
+	// send event
+	if err = stub.SetEvent("abort", updateData); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
 func (t *SimpleChaincode) doCommit(stub shim.ChaincodeStubInterface, c *PrecommitContract) error {
 	switch c.ToCallFunc {
 	case "invoke":
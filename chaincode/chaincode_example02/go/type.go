@@ -20,6 +20,12 @@ const (
 	Finished
 	// Completed is the fabric commit contract transaction status flag, change by courier
 	Completed
+	// Aborted is the fabric precommit contract transaction status flag, generate on fabric chaincode
+	// when courier gives up waiting for the outchain receipt
+	Aborted
+	// DeadLetter is the fabric precommit contract transaction status flag, change by courier
+	// when sending to the outchain keeps failing, an operator requeues it
+	DeadLetter
 )
 
 func (c CStatus) String() string {
@@ -34,6 +40,10 @@ func (c CStatus) String() string {
 		return "Finished"
 	case Completed:
 		return "Completed"
+	case Aborted:
+		return "Aborted"
+	case DeadLetter:
+		return "DeadLetter"
 	default:
 		return "UnSupport"
 	}
@@ -51,6 +61,10 @@ func ParseCStatus(c string) (CStatus, error) {
 		return Finished, nil
 	case "Completed":
 		return Completed, nil
+	case "Aborted":
+		return Aborted, nil
+	case "DeadLetter":
+		return DeadLetter, nil
 	}
 
 	var status CStatus
@@ -108,6 +122,10 @@ func RebuildIContract(bytes json.RawMessage) (c IContract, err error) {
 	case "Executed":
 		fallthrough
 	case "Completed":
+		fallthrough
+	case "Aborted":
+		fallthrough
+	case "DeadLetter":
 		var pc PrecommitContract
 		err = json.Unmarshal(bytes, &pc)
 		c = &pc
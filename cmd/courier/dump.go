@@ -0,0 +1,122 @@
+package main
+
+import (
+	"io"
+	"os"
+
+	"github.com/icodezjb/fabric-study/courier"
+	"github.com/icodezjb/fabric-study/courier/client"
+	"github.com/icodezjb/fabric-study/courier/utils"
+	"github.com/icodezjb/fabric-study/log"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+var dumpOpts struct {
+	file      string
+	status    string
+	fromBlock uint64
+	toBlock   uint64
+	force     bool
+}
+
+var exportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "export the CrossTxs and the checkpoints to JSON lines.",
+	Long:  "export the CrossTxs (with the decoded contracts) and the config keys of every pipeline in the data directory to JSON lines, the config keys are only exported without filter",
+	Run: func(cmd *cobra.Command, args []string) {
+		cfg := client.InitStorageConfig()
+		filter := dumpFilter()
+
+		backend, err := courier.OpenBackend(cfg.DB, cfg.DataDir(), cfg.DefaultPipeline())
+		if err != nil {
+			utils.Fatalf("[main] open db err: %v", err)
+		}
+		defer backend.Close()
+
+		var w io.Writer = os.Stdout
+		if dumpOpts.file != "" && dumpOpts.file != "-" {
+			f, err := os.Create(dumpOpts.file)
+			if err != nil {
+				utils.Fatalf("[main] create %s err: %v", dumpOpts.file, err)
+			}
+			defer f.Close()
+			w = f
+		}
+
+		result, err := courier.Export(backend, w, filter)
+		if err != nil {
+			utils.Fatalf("[main] export err: %v", err)
+		}
+
+		log.Info("[Main] export done", "crossTxs", result.CrossTxs, "keys", result.Keys)
+	},
+}
+
+var importCmd = &cobra.Command{
+	Use:   "import",
+	Short: "import the CrossTxs and the checkpoints from JSON lines.",
+	Long:  "import the JSON lines written by export into an empty data directory, all the records are validated first, the checkpoints are only restored without filter",
+	Run: func(cmd *cobra.Command, args []string) {
+		cfg := client.InitStorageConfig()
+		filter := dumpFilter()
+
+		var r io.Reader = os.Stdin
+		if dumpOpts.file != "" && dumpOpts.file != "-" {
+			f, err := os.Open(dumpOpts.file)
+			if err != nil {
+				utils.Fatalf("[main] open %s err: %v", dumpOpts.file, err)
+			}
+			defer f.Close()
+			r = f
+		}
+
+		if err := os.MkdirAll(cfg.DataDir(), 0700); err != nil {
+			utils.Fatalf("[main] create data dir err: %v", err)
+		}
+
+		backend, err := courier.OpenBackend(cfg.DB, cfg.DataDir(), cfg.DefaultPipeline())
+		if err != nil {
+			utils.Fatalf("[main] open db err: %v", err)
+		}
+		defer backend.Close()
+
+		result, err := courier.Import(backend, r, filter, dumpOpts.force)
+		if err != nil {
+			utils.Fatalf("[main] import err: %v", err)
+		}
+
+		log.Info("[Main] import done", "crossTxs", result.CrossTxs, "skipped", result.Skipped, "keys", result.Keys)
+	},
+}
+
+func dumpFilter() courier.DumpFilter {
+	filter, err := courier.ParseDumpFilter(dumpOpts.status, dumpOpts.fromBlock, dumpOpts.toBlock)
+	if err != nil {
+		utils.Fatalf("[main] invalid filter: %v", err)
+	}
+
+	return filter
+}
+
+func initDumpFilter(flags *pflag.FlagSet) {
+	flags.StringVar(&dumpOpts.status, "status", "", "Only the CrossTxs of the comma separated status, e.g. Init,Pending")
+	flags.Uint64Var(&dumpOpts.fromBlock, "from-block", 0, "Only the CrossTxs from the block")
+	flags.Uint64Var(&dumpOpts.toBlock, "to-block", 0, "Only the CrossTxs up to the block")
+}
+
+func getExportCmd() *cobra.Command {
+	flags := exportCmd.Flags()
+	flags.StringVarP(&dumpOpts.file, "output", "o", "", "The output file, stdout if not set")
+	initDumpFilter(flags)
+	return exportCmd
+}
+
+func getImportCmd() *cobra.Command {
+	flags := importCmd.Flags()
+	flags.StringVarP(&dumpOpts.file, "input", "i", "", "The input file, stdin if not set")
+	flags.BoolVar(&dumpOpts.force, "force", false, "Import into a data directory which has data, the CrossTxs already stored are skipped and the checkpoints are overwritten")
+	initDumpFilter(flags)
+	return importCmd
+}
@@ -24,7 +24,12 @@ func main() {
 			return nil
 		},
 		Run: func(cmd *cobra.Command, args []string) {
-			h, err := courier.New(client.InitConfig())
+			cfg := client.InitConfig()
+			if err := courier.ValidateEvents(cfg.FilterEvents); err != nil {
+				utils.Fatalf("[main] invalid --events: %v", err)
+			}
+
+			h, err := courier.New(cfg)
 			if err != nil {
 				utils.Fatalf("[main] courier init err: %v", err)
 			}
@@ -45,12 +50,25 @@ func main() {
 	flags := mainCmd.PersistentFlags()
 	client.InitConfigFile(flags)
 	client.InitDataDir(flags)
+	client.InitDB(flags)
 	client.InitHTTPEndpoint(flags)
 	client.InitChannelID(flags)
 	client.InitChaincodeID(flags)
+	client.InitPipelines(flags)
 	client.InitPeerURL(flags)
 	client.InitUserName(flags)
 	client.InitFilterEvents(flags)
+	client.InitSyncMode(flags)
+	client.InitPrefetch(flags)
+	client.InitRecordInvalid(flags)
+	client.InitPendingTimeout(flags)
+	client.InitSendRetry(flags)
+	client.InitOutChain(flags)
+	client.InitServerTLS(flags)
+	client.InitAdminToken(flags)
+
+	mainCmd.AddCommand(getExportCmd())
+	mainCmd.AddCommand(getImportCmd())
 
 	if err := mainCmd.Execute(); err != nil {
 		fmt.Println(err)
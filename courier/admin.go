@@ -0,0 +1,272 @@
+package courier
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/icodezjb/fabric-study/courier/contractlib"
+	"github.com/icodezjb/fabric-study/log"
+
+	"github.com/asdine/storm/v3/q"
+)
+
+// OperatorNote is an annotation of a CrossTx by an operator
+type OperatorNote struct {
+	Operator string
+	// Time is the unix time in nanoseconds
+	Time int64
+	Note string
+}
+
+// AuditRecord is an admin action on a CrossTx, the failed actions are recorded too
+type AuditRecord struct {
+	ID       int64  `storm:"id,increment"`
+	CrossID  string `storm:"index"`
+	Action   string `storm:"index"`
+	Operator string
+	// Time is the unix time in nanoseconds
+	Time   int64
+	Detail string `json:",omitempty"`
+	// Err is the reason the action failed, empty if it succeeded
+	Err string `json:",omitempty"`
+}
+
+const (
+	AdminRequeue  = "requeue"
+	AdminRecommit = "recommit"
+	AdminForce    = "force-status"
+	AdminNote     = "note"
+)
+
+// audit writes the admin action to the audit log
+func (t *TxManager) audit(operator, action, crossID, detail string, err error) {
+	r := &AuditRecord{CrossID: crossID, Action: action, Operator: operator, Time: time.Now().UnixNano(), Detail: detail}
+	if err != nil {
+		r.Err = err.Error()
+	}
+
+	if err := t.DB.SaveAudit(r); err != nil {
+		log.Error("[Admin] save audit record", "crossID", crossID, "action", action, "err", err)
+	}
+
+	log.Info("[Admin] "+action, "crossID", crossID, "operator", operator, "detail", detail, "err", r.Err)
+}
+
+// AuditLog returns the admin actions on the crossID, all of them if it is empty
+func (t *TxManager) AuditLog(crossID string) []*AuditRecord {
+	var filter []q.Matcher
+	if crossID != "" {
+		filter = append(filter, q.Eq("CrossID", crossID))
+	}
+
+	return t.DB.QueryAudit(filter...)
+}
+
+// AdminRequeue sends an Init, Pending or dead-lettered tx to the outchain again, the send attempts are reset
+func (t *TxManager) AdminRequeue(operator, crossID string) (err error) {
+	defer func() { t.audit(operator, AdminRequeue, crossID, "", err) }()
+
+	tx := t.DB.One(CrossIdIndex, crossID)
+	if tx == nil {
+		return fmt.Errorf("crossID %s not found", crossID)
+	}
+
+	switch tx.GetStatus() {
+	case contractlib.DeadLetter:
+		return t.Requeue(crossID)
+	case contractlib.Init, contractlib.Pending:
+	default:
+		return fmt.Errorf("crossID %s is %s, only Init, Pending and DeadLetter txs are requeued", crossID, tx.GetStatus())
+	}
+
+	reset := func(c *CrossTx) error {
+		if status := c.GetStatus(); status != contractlib.Init && status != contractlib.Pending {
+			return fmt.Errorf("crossID %s is %s now", c.CrossID, status)
+		}
+		c.Attempts = 0
+		c.NextAttempt = 0
+		return nil
+	}
+
+	if err := t.DB.Updates([]string{crossID}, []func(c *CrossTx) error{reset}); err != nil {
+		return err
+	}
+	_ = reset(tx)
+
+	// a tx waiting for the backoff is sent now instead
+	t.retry.remove(crossID)
+	t.pending.remove(crossID)
+	t.pushPending(tx)
+
+	return nil
+}
+
+// AdminRecommit invokes the chaincode commit of an Executed tx again with its accepted receipt
+func (t *TxManager) AdminRecommit(operator, crossID string) (err error) {
+	defer func() { t.audit(operator, AdminRecommit, crossID, "", err) }()
+
+	tx := t.DB.One(CrossIdIndex, crossID)
+	if tx == nil {
+		return fmt.Errorf("crossID %s not found", crossID)
+	}
+
+	if tx.GetStatus() != contractlib.Executed {
+		return fmt.Errorf("crossID %s is %s, not %s", crossID, tx.GetStatus(), contractlib.Executed)
+	}
+
+	ctr, err := t.executedReceipt(tx)
+	if err != nil {
+		return err
+	}
+
+	t.executed.remove(crossID)
+	t.pushExecuted(ctr)
+
+	return nil
+}
+
+// ForceStatus sets the status of a tx bypassing the transition table, the reason is mandatory,
+// the tx is queued again by its new status
+func (t *TxManager) ForceStatus(operator, crossID string, to contractlib.CStatus, reason string) (err error) {
+	defer func() { t.audit(operator, AdminForce, crossID, fmt.Sprintf("to %s: %s", to, reason), err) }()
+
+	if reason == "" {
+		return fmt.Errorf("reason is required")
+	}
+
+	if to == contractlib.Finished || to.String() == "UnSupport" {
+		return fmt.Errorf("can not force the status %s", to)
+	}
+
+	tx := t.DB.One(CrossIdIndex, crossID)
+	if tx == nil {
+		return fmt.Errorf("crossID %s not found", crossID)
+	}
+
+	from := tx.GetStatus()
+	if from == to {
+		return fmt.Errorf("crossID %s is %s already", crossID, to)
+	}
+
+	var ctr CrossTxReceipt
+	if to == contractlib.Executed {
+		if ctr, err = t.executedReceipt(tx); err != nil {
+			return err
+		}
+	}
+
+	force := func(c *CrossTx) error {
+		c.UpdateStatus(to)
+		c.History = append(c.History, StatusChange{From: from, To: to, Time: time.Now().UnixNano(), Reason: fmt.Sprintf("forced by %s: %s", operator, reason)})
+		if to == contractlib.Init {
+			c.Attempts = 0
+			c.NextAttempt = 0
+		}
+		return nil
+	}
+
+	if err := t.DB.Updates([]string{crossID}, []func(c *CrossTx) error{force}); err != nil {
+		return err
+	}
+	_ = force(tx)
+
+	t.pending.remove(crossID)
+	t.retry.remove(crossID)
+	t.executed.remove(crossID)
+
+	switch to {
+	case contractlib.Init:
+		t.pushPending(tx)
+	case contractlib.Executed:
+		t.pushExecuted(ctr)
+	}
+
+	return nil
+}
+
+// AddNote annotates a tx
+func (t *TxManager) AddNote(operator, crossID, note string) (err error) {
+	defer func() { t.audit(operator, AdminNote, crossID, note, err) }()
+
+	if note == "" {
+		return fmt.Errorf("note is required")
+	}
+
+	if tx := t.DB.One(CrossIdIndex, crossID); tx == nil {
+		return fmt.Errorf("crossID %s not found", crossID)
+	}
+
+	return t.DB.Updates([]string{crossID}, []func(c *CrossTx) error{func(c *CrossTx) error {
+		c.Notes = append(c.Notes, OperatorNote{Operator: operator, Time: time.Now().UnixNano(), Note: note})
+		return nil
+	}})
+}
+
+// executedReceipt returns the accepted receipt of the tx, which its commit is invoked with
+func (t *TxManager) executedReceipt(tx *CrossTx) (CrossTxReceipt, error) {
+	pc, ok := tx.IContract.(*contractlib.PrecommitContract)
+	if !ok || pc.Receipt == "" {
+		return CrossTxReceipt{}, fmt.Errorf("crossID %s has no accepted receipt", tx.CrossID)
+	}
+
+	ctr := CrossTxReceipt{CrossID: tx.CrossID, Receipt: pc.Receipt}
+	if record := t.DB.GetReceipt(tx.CrossID); record != nil && record.Receipt == pc.Receipt {
+		ctr.Sequence = record.Sequence
+	}
+
+	return ctr, nil
+}
+
+func (t *TxManager) pushPending(tx *CrossTx) {
+	t.pending.mu.Lock()
+	t.pending.prq.Push(tx, -tx.TimeStamp.Seconds)
+	t.pending.mu.Unlock()
+
+	select {
+	case t.pending.process <- struct{}{}:
+	case <-t.stopCh:
+	}
+}
+
+func (t *TxManager) pushExecuted(ctr CrossTxReceipt) {
+	t.executed.mu.Lock()
+	t.executed.prq.Push(ctr, -ctr.Sequence)
+	t.executed.mu.Unlock()
+
+	select {
+	case t.executed.process <- struct{}{}:
+	case <-t.stopCh:
+	}
+}
+
+// remove drops the queued items of the crossID
+func (pq *Prqueue) remove(crossID string) {
+	type entry struct {
+		item     interface{}
+		priority int64
+	}
+
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+
+	var keep []entry
+	for !pq.prq.Empty() {
+		item, priority := pq.prq.Pop()
+
+		var id string
+		switch v := item.(type) {
+		case *CrossTx:
+			id = v.CrossID
+		case CrossTxReceipt:
+			id = v.CrossID
+		}
+
+		if id != crossID {
+			keep = append(keep, entry{item: item, priority: priority})
+		}
+	}
+
+	for _, e := range keep {
+		pq.prq.Push(e.item, e.priority)
+	}
+}
@@ -0,0 +1,130 @@
+package courier
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/icodezjb/fabric-study/courier/client"
+	"github.com/icodezjb/fabric-study/courier/contractlib"
+)
+
+func TestAdminAPI(t *testing.T) {
+	store, closeStore := newTestStore(t)
+	defer closeStore()
+
+	retried := newTestCrossTx("a", contractlib.Init, "")
+	retried.Attempts = 3
+	pending := newTestCrossTx("b", contractlib.Pending, "")
+	executed := newTestCrossTx("c", contractlib.Executed, "receipt-c")
+	completed := newTestCrossTx("d", contractlib.Completed, "receipt-d")
+	if err := store.Save([]*CrossTx{retried, pending, executed, completed}); err != nil {
+		t.Fatal(err)
+	}
+
+	txm := NewTxManager(&client.Config{}, &MockFabricClient{}, &client.MockOutChainClient{}, store)
+	txm.retry.prq.Push(retried, -100)
+
+	h := &Handler{adminToken: "secret", pipelines: []*Pipeline{{
+		PipelineConfig: client.PipelineConfig{ChannelID: "mychannel", ChainCodeID: "mycc"},
+		txm:            txm,
+	}}}
+
+	post := func(path, token string, form url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	form := url.Values{"operator": {"alice"}, "crossid": {"a"}}
+	if rec := post("/v1/admin/requeue", "", form); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("no token, want: 401, got: %d", rec.Code)
+	}
+	if rec := post("/v1/admin/requeue", "wrong", form); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("wrong token, want: 401, got: %d", rec.Code)
+	}
+
+	// requeue sends the tx waiting for the backoff now
+	if rec := post("/v1/admin/requeue", "secret", form); rec.Code != http.StatusOK {
+		t.Fatalf("requeue, want: 200, got: %d %s", rec.Code, rec.Body)
+	}
+	if txm.retry.prq.Size() != 0 || txm.pending.prq.Size() != 1 {
+		t.Fatalf("requeue, want the tx moved from retry to pending, got: retry %d pending %d", txm.retry.prq.Size(), txm.pending.prq.Size())
+	}
+	if tx := store.One(CrossIdIndex, "a"); tx.Attempts != 0 {
+		t.Fatalf("requeue, want the attempts reset, got: %d", tx.Attempts)
+	}
+
+	if rec := post("/v1/admin/requeue", "secret", url.Values{"operator": {"alice"}, "crossid": {"d"}}); rec.Code != http.StatusBadRequest {
+		t.Fatalf("requeue Completed, want: 400, got: %d", rec.Code)
+	}
+
+	// the dead letters are requeued by the admin API only
+	if rec := post("/v1/deadletter/requeue", "", url.Values{"crossid": {"a"}}); rec.Code != http.StatusNotFound {
+		t.Fatalf("unauthenticated requeue, want: 404, got: %d", rec.Code)
+	}
+
+	// force status needs a reason
+	form = url.Values{"operator": {"bob"}, "crossid": {"b"}, "status": {"Init"}}
+	if rec := post("/v1/admin/status", "secret", form); rec.Code != http.StatusBadRequest {
+		t.Fatalf("force without reason, want: 400, got: %d", rec.Code)
+	}
+
+	form.Set("reason", "outchain lost it")
+	if rec := post("/v1/admin/status", "secret", form); rec.Code != http.StatusOK {
+		t.Fatalf("force, want: 200, got: %d %s", rec.Code, rec.Body)
+	}
+	tx := store.One(CrossIdIndex, "b")
+	if last := tx.History[len(tx.History)-1]; tx.GetStatus() != contractlib.Init || last.From != contractlib.Pending || last.Reason != "forced by bob: outchain lost it" {
+		t.Fatalf("force, got: %s %+v", tx.GetStatus(), last)
+	}
+	if txm.pending.prq.Size() != 2 {
+		t.Fatalf("force to Init, want the tx queued, got: pending %d", txm.pending.prq.Size())
+	}
+
+	if rec := post("/v1/admin/recommit", "secret", url.Values{"operator": {"bob"}, "crossid": {"c"}}); rec.Code != http.StatusOK {
+		t.Fatalf("recommit, want: 200, got: %d %s", rec.Code, rec.Body)
+	}
+	if item, _ := txm.executed.prq.Pop(); item.(CrossTxReceipt).Receipt != "receipt-c" {
+		t.Fatalf("recommit, got: %+v", item)
+	}
+
+	if rec := post("/v1/admin/note", "secret", url.Values{"operator": {"bob"}, "crossid": {"d"}, "note": {"checked"}}); rec.Code != http.StatusOK {
+		t.Fatalf("note, want: 200, got: %d %s", rec.Code, rec.Body)
+	}
+	if tx := store.One(CrossIdIndex, "d"); len(tx.Notes) != 1 || tx.Notes[0].Operator != "bob" || tx.Notes[0].Note != "checked" {
+		t.Fatalf("note, got: %+v", tx.Notes)
+	}
+
+	req := httptest.NewRequest("GET", "/v1/admin/audit", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	var records []*AuditRecord
+	if err := json.Unmarshal(rec.Body.Bytes(), &records); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, r := range records {
+		got = append(got, r.Action+" "+r.CrossID+" "+r.Operator+" "+map[bool]string{true: "ok", false: "failed"}[r.Err == ""])
+	}
+	want := []string{"requeue a alice ok", "requeue d alice failed", "force-status b bob failed", "force-status b bob ok", "recommit c bob ok", "note d bob ok"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("audit log, want: %v, got: %v", want, got)
+	}
+
+	h.adminToken = ""
+	if rec := post("/v1/admin/note", "secret", url.Values{"operator": {"bob"}, "crossid": {"d"}, "note": {"x"}}); rec.Code != http.StatusForbidden {
+		t.Fatalf("admin disabled, want: 403, got: %d", rec.Code)
+	}
+}
@@ -0,0 +1,67 @@
+package courier
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/icodezjb/fabric-study/courier/client"
+)
+
+const (
+	// maxReceiptSkew bounds the age of a signed receipt request, it limits the replay of a captured one
+	maxReceiptSkew = 5 * time.Minute
+	// maxReceiptBodySize bounds the body read to verify the signature
+	maxReceiptBodySize = 1 << 20
+)
+
+// authenticateReceipt verifies the HMAC signature of the receipt request if the relayer secrets are set,
+// the body is restored for the form parsing
+func (h *Handler) authenticateReceipt(req *http.Request) error {
+	if len(h.receiptSecrets) == 0 {
+		return nil
+	}
+
+	relayer := req.Header.Get(client.RelayerHeader)
+	secret, ok := h.receiptSecrets[relayer]
+	if !ok {
+		return fmt.Errorf("unknown relayer %q", relayer)
+	}
+
+	timestamp := req.Header.Get(client.TimestampHeader)
+	sec, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid timestamp %q", timestamp)
+	}
+
+	if skew := time.Since(time.Unix(sec, 0)); skew > maxReceiptSkew || skew < -maxReceiptSkew {
+		return fmt.Errorf("timestamp is out of the %s window", maxReceiptSkew)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, maxReceiptBodySize+1))
+	if err != nil {
+		return fmt.Errorf("read body err: %w", err)
+	}
+	if len(body) > maxReceiptBodySize {
+		return fmt.Errorf("body is larger than %d bytes", maxReceiptBodySize)
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	sig, err := hex.DecodeString(req.Header.Get(client.SignatureHeader))
+	if err != nil {
+		return fmt.Errorf("invalid signature")
+	}
+
+	want, _ := hex.DecodeString(client.SignRequest(secret, timestamp, req.Method, req.URL.RequestURI(), body))
+	if !hmac.Equal(sig, want) {
+		return fmt.Errorf("invalid signature")
+	}
+
+	return nil
+}
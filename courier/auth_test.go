@@ -0,0 +1,107 @@
+package courier
+
+import (
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/icodezjb/fabric-study/courier/client"
+	"github.com/icodezjb/fabric-study/courier/contractlib"
+)
+
+func TestReceiptAuthentication(t *testing.T) {
+	store, closeStore := newTestStore(t)
+	defer closeStore()
+
+	if err := store.Save([]*CrossTx{newTestCrossTx("a", contractlib.Pending, "")}); err != nil {
+		t.Fatal(err)
+	}
+
+	txm := NewTxManager(&client.Config{}, &MockFabricClient{}, &client.MockOutChainClient{}, store)
+	h := &Handler{
+		receiptSecrets: map[string][]byte{"relayer-1": []byte("secret-1")},
+		stopCh:         make(chan struct{}),
+		pipelines: []*Pipeline{{
+			PipelineConfig: client.PipelineConfig{ChannelID: "mychannel", ChainCodeID: "mycc"},
+			txm:            txm,
+		}},
+	}
+
+	body := url.Values{"crossid": {"a"}, "receipt": {"r"}, "sequence": {"1"}}.Encode()
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	signed := client.SignRequest([]byte("secret-1"), now, "POST", "/v1/receipt?channel=mychannel", []byte(body))
+
+	for i, c := range []struct {
+		relayer, timestamp, signature, target string
+		want                                  int
+	}{
+		{"", now, signed, "/v1/receipt?channel=mychannel", http.StatusUnauthorized},
+		{"relayer-2", now, signed, "/v1/receipt?channel=mychannel", http.StatusUnauthorized},
+		{"relayer-1", now, "00" + signed[2:], "/v1/receipt?channel=mychannel", http.StatusUnauthorized},
+		{"relayer-1", now, signed, "/v1/receipt?channel=yourchannel", http.StatusUnauthorized},
+		{"relayer-1", strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10), signed, "/v1/receipt?channel=mychannel", http.StatusUnauthorized},
+		{"relayer-1", now, signed, "/v1/receipt?channel=mychannel", http.StatusOK},
+	} {
+		if c.want == http.StatusOK && store.GetReceipt("a") != nil {
+			t.Fatal("unauthenticated receipt reached the TxManager")
+		}
+
+		req := httptest.NewRequest("POST", c.target, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set(client.RelayerHeader, c.relayer)
+		req.Header.Set(client.TimestampHeader, c.timestamp)
+		req.Header.Set(client.SignatureHeader, c.signature)
+
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != c.want {
+			t.Fatalf("case %d, want: %d, got: %d %s", i, c.want, rec.Code, rec.Body)
+		}
+	}
+
+	if r := store.GetReceipt("a"); r == nil || r.Receipt != "r" {
+		t.Fatalf("signed receipt, want accepted, got: %+v", r)
+	}
+}
+
+func TestClientCertPerPath(t *testing.T) {
+	store, closeStore := newTestStore(t)
+	defer closeStore()
+
+	txm := NewTxManager(&client.Config{}, &MockFabricClient{}, &client.MockOutChainClient{}, store)
+	h := &Handler{
+		requireClientCert: true,
+		stopCh:            make(chan struct{}),
+		pipelines: []*Pipeline{{
+			PipelineConfig: client.PipelineConfig{ChannelID: "mychannel", ChainCodeID: "mycc"},
+			txm:            txm,
+		}},
+	}
+
+	for i, c := range []struct {
+		target       string
+		verified     bool
+		unauthorized bool
+	}{
+		{"https://courier/healthz", false, false},
+		{"https://courier/metrics", false, false},
+		{"https://courier/v1/receipt/conflicts", false, true},
+		{"https://courier/v1/receipt/conflicts", true, false},
+	} {
+		req := httptest.NewRequest("GET", c.target, nil)
+		if c.verified {
+			req.TLS.VerifiedChains = [][]*x509.Certificate{{{}}}
+		}
+
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if unauthorized := rec.Code == http.StatusUnauthorized; unauthorized != c.unauthorized {
+			t.Fatalf("case %d, want unauthorized: %v, got: %d %s", i, c.unauthorized, rec.Code, rec.Body)
+		}
+	}
+}
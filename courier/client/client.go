@@ -1,19 +1,29 @@
 package client
 
 import (
+	"fmt"
+	"sync"
+
 	"github.com/icodezjb/fabric-study/courier/utils"
 	"github.com/icodezjb/fabric-study/log"
 
 	"github.com/hyperledger/fabric-protos-go/common"
+	"github.com/hyperledger/fabric-protos-go/peer"
 	"github.com/hyperledger/fabric-sdk-go/pkg/client/channel"
 	"github.com/hyperledger/fabric-sdk-go/pkg/client/ledger"
+	"github.com/hyperledger/fabric-sdk-go/pkg/common/errors/status"
 	"github.com/hyperledger/fabric-sdk-go/pkg/common/providers/fab"
+	eventclient "github.com/hyperledger/fabric-sdk-go/pkg/fab/events/client"
+	"github.com/hyperledger/fabric-sdk-go/pkg/fab/events/deliverclient"
+	"github.com/hyperledger/fabric-sdk-go/pkg/fab/events/deliverclient/seek"
 	"github.com/hyperledger/fabric-sdk-go/pkg/fabsdk"
 )
 
 type FClient struct {
 	// Fabric network information
 	cfg *Config
+	// the channel and chaincode of the pipeline
+	pipeline PipelineConfig
 
 	// SDK Clients
 	sdk *fabsdk.FabricSDK
@@ -29,6 +39,13 @@ type OutChainClient interface {
 	Close()
 }
 
+// BatchOutChainClient sends several CrossTxs in one round-trip
+type BatchOutChainClient interface {
+	OutChainClient
+	// SendBatch returns one error per item of the batch, nil means the item was accepted by the outchain
+	SendBatch([][]byte) []error
+}
+
 type MockOutChainClient struct {
 	count uint32
 }
@@ -45,15 +62,31 @@ func (mc *MockOutChainClient) Close() {
 
 type FabricClient interface {
 	QueryBlockByNum(number uint64) (*common.Block, error)
+	// QueryHeight returns the height of the channel, the number of the block to be committed next
+	QueryHeight() (uint64, error)
+	// InvokeChainCode returns after the transaction is validated by the committing peers,
+	// the TransactionID is set whenever the proposal was endorsed, even if the transaction is invalidated
 	InvokeChainCode(fcn string, args []string) (fab.TransactionID, error)
+	// QueryTxValidation returns the validation code of a transaction in the ledger
+	QueryTxValidation(txID fab.TransactionID) (peer.TxValidationCode, error)
 
+	// ChainCodeID is the chaincode of the pipeline, only its events are synced
+	ChainCodeID() string
 	FilterEvents() []string
 	Close()
 }
 
-func NewFabCli(cfg *Config) *FClient {
+// BlockEventClient delivers the blocks of the channel as they are committed
+type BlockEventClient interface {
+	// BlockEvents delivers the blocks from the given number in order,
+	// the channel is closed when the delivery ends, the returned function stops it
+	BlockEvents(from uint64) (<-chan *common.Block, func(), error)
+}
+
+func NewFabCli(cfg *Config, pipeline PipelineConfig) *FClient {
 	c := &FClient{
-		cfg: cfg,
+		cfg:      cfg,
+		pipeline: pipeline,
 
 		packArgs: func(params []string) [][]byte {
 			var args [][]byte
@@ -93,7 +126,7 @@ func (c *FClient) initializeSDK() {
 }
 
 func (c *FClient) initializeChannelClient() {
-	channelProvider := c.sdk.ChannelContext(c.cfg.ChannelID(), fabsdk.WithUser(c.cfg.UserName()))
+	channelProvider := c.sdk.ChannelContext(c.pipeline.ChannelID, fabsdk.WithUser(c.cfg.UserName()))
 
 	cc, err := channel.New(channelProvider)
 	if err != nil {
@@ -106,7 +139,7 @@ func (c *FClient) initializeChannelClient() {
 }
 
 func (c *FClient) initializeLedgerClient() {
-	channelProvider := c.sdk.ChannelContext(c.cfg.ChannelID(), fabsdk.WithUser(c.cfg.UserName()))
+	channelProvider := c.sdk.ChannelContext(c.pipeline.ChannelID, fabsdk.WithUser(c.cfg.UserName()))
 	lc, err := ledger.New(channelProvider)
 	if err != nil {
 		utils.Fatalf("[FClient] ledger.New err: %v", err)
@@ -121,19 +154,169 @@ func (c *FClient) QueryBlockByNum(number uint64) (*common.Block, error) {
 	return c.lc.QueryBlock(number)
 }
 
+func (c *FClient) QueryHeight() (uint64, error) {
+	info, err := c.lc.QueryInfo()
+	if err != nil {
+		return 0, err
+	}
+
+	return info.BCI.GetHeight(), nil
+}
+
+func (c *FClient) QueryTxValidation(txID fab.TransactionID) (peer.TxValidationCode, error) {
+	tx, err := c.lc.QueryTransaction(txID)
+	if err != nil {
+		return peer.TxValidationCode_NOT_VALIDATED, err
+	}
+
+	return peer.TxValidationCode(tx.GetValidationCode()), nil
+}
+
+// BlockEvents seeks the deliver service of the channel from the given block, the deliver client
+// is owned by the subscription and closed by the returned stop, the sdk would cache one per seek
+func (c *FClient) BlockEvents(from uint64) (<-chan *common.Block, func(), error) {
+	channelContext, err := c.sdk.ChannelContext(c.pipeline.ChannelID, fabsdk.WithUser(c.cfg.UserName()))()
+	if err != nil {
+		return nil, nil, fmt.Errorf("channel context err: %w", err)
+	}
+
+	chConfig, err := channelContext.ChannelService().ChannelConfig()
+	if err != nil {
+		return nil, nil, fmt.Errorf("channel config err: %w", err)
+	}
+
+	discovery, err := channelContext.ChannelService().Discovery()
+	if err != nil {
+		return nil, nil, fmt.Errorf("discovery service err: %w", err)
+	}
+
+	ec, err := deliverclient.New(channelContext, chConfig, discovery,
+		eventclient.WithBlockEvents(), deliverclient.WithSeekType(seek.FromBlock), deliverclient.WithBlockNum(from))
+	if err != nil {
+		return nil, nil, fmt.Errorf("deliver client err: %w", err)
+	}
+
+	reg, events, err := ec.RegisterBlockEvent()
+	if err != nil {
+		ec.Close()
+		return nil, nil, fmt.Errorf("register block event err: %w", err)
+	}
+
+	blocks := make(chan *common.Block)
+	done := make(chan struct{})
+
+	go func() {
+		defer close(blocks)
+
+		for {
+			select {
+			case ev, ok := <-events:
+				if !ok {
+					return
+				}
+
+				select {
+				case blocks <- ev.Block:
+				case <-done:
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			close(done)
+			ec.Unregister(reg)
+			ec.Close()
+		})
+	}
+
+	log.Info("[FClient] registered block events", "channel", c.pipeline.ChannelID, "from", from)
+
+	return blocks, stop, nil
+}
+
 // InvokeChainCode("invoke", []string{"a", "b", "10"})
 func (c *FClient) InvokeChainCode(fcn string, args []string) (fab.TransactionID, error) {
 	req := channel.Request{
-		ChaincodeID: c.cfg.ChainCodeID(),
+		ChaincodeID: c.pipeline.ChainCodeID,
 		Fcn:         fcn,
 		Args:        c.packArgs(args),
 	}
+
+	// Execute waits for the tx status event of the committing peers,
+	// the response keeps the TransactionID if the transaction is invalidated
 	resp, err := c.cc.Execute(req, c.cfg.RequestOption)
-	if err != nil {
-		return "", err
+
+	return resp.TransactionID, err
+}
+
+// InvokeOutcome classifies the result of InvokeChainCode
+type InvokeOutcome int
+
+const (
+	// Committed means the transaction is committed as valid
+	Committed InvokeOutcome = iota
+	// EndorsementFailed means the proposal was rejected by the chaincode or the endorsers, nothing was sent to the orderer
+	EndorsementFailed
+	// Invalidated means the transaction was ordered but invalidated by the committing peers, e.g. MVCC_READ_CONFLICT
+	Invalidated
+	// CommitUnknown means the transaction status is unknown, e.g. timed out waiting for the block event
+	CommitUnknown
+	// Unavailable means the client could not get the proposal endorsed, e.g. the peers are unreachable, it is transient
+	Unavailable
+)
+
+func (o InvokeOutcome) String() string {
+	switch o {
+	case Committed:
+		return "Committed"
+	case EndorsementFailed:
+		return "EndorsementFailed"
+	case Invalidated:
+		return "Invalidated"
+	case Unavailable:
+		return "Unavailable"
+	default:
+		return "CommitUnknown"
+	}
+}
+
+// InvokeOutcomeOf classifies the error of InvokeChainCode,
+// the validation code is only meaningful for the Committed and Invalidated outcomes
+func InvokeOutcomeOf(err error) (InvokeOutcome, peer.TxValidationCode) {
+	if err == nil {
+		return Committed, peer.TxValidationCode_VALID
 	}
 
-	return resp.TransactionID, nil
+	s, ok := status.FromError(err)
+	if !ok {
+		return CommitUnknown, peer.TxValidationCode_NOT_VALIDATED
+	}
+
+	switch s.Group {
+	case status.EventServerStatus:
+		return Invalidated, peer.TxValidationCode(s.Code)
+	case status.EndorserServerStatus, status.ChaincodeStatus:
+		return EndorsementFailed, peer.TxValidationCode_NOT_VALIDATED
+	case status.EndorserClientStatus:
+		return Unavailable, peer.TxValidationCode_NOT_VALIDATED
+	case status.ClientStatus:
+		if s.Code == status.Timeout.ToInt32() {
+			return CommitUnknown, peer.TxValidationCode_NOT_VALIDATED
+		}
+		return Unavailable, peer.TxValidationCode_NOT_VALIDATED
+	default:
+		return CommitUnknown, peer.TxValidationCode_NOT_VALIDATED
+	}
+}
+
+func (c *FClient) ChainCodeID() string {
+	return c.pipeline.ChainCodeID
 }
 
 func (c *FClient) FilterEvents() []string {
@@ -1,7 +1,10 @@
 package client
 
 import (
+	"fmt"
+	"io/ioutil"
 	"strings"
+	"time"
 
 	"github.com/icodezjb/fabric-study/courier/utils"
 
@@ -24,6 +27,10 @@ const (
 	chaincodeIDDescription = "The Chaincode ID"
 	defaultChaincodeID     = ""
 
+	PipelinesFlag        = "pipelines"
+	pipelinesDescription = "A comma-separated list of channel:chaincode pairs synced by independent pipelines, e.g. 'mychannel:mycc,yourchannel:yourcc', the cid and ccid pair is used if not set"
+	defaultPipelines     = ""
+
 	PeerURLFlag        = "peer"
 	peerURLDescription = "A comma-separated list of peer targets, e.g. 'grpcs://localhost:7051,grpcs://localhost:8051'"
 	defaultPeerURL     = ""
@@ -33,8 +40,8 @@ const (
 	defaultConfigFile     = ""
 
 	filterEventFlag        = "events"
-	filterEventDescription = "A comma-separated list of the specified events which are in the fabric blocks, e.g. 'precommit, commit'"
-	defaultFilterEvent     = "precommit,commit"
+	filterEventDescription = "A comma-separated list of the specified events which are in the fabric blocks, each needs an event handler registered in courier, e.g. 'precommit, commit, abort'"
+	defaultFilterEvent     = "precommit,commit,abort"
 
 	HTTPEndpointFlag            = "endpoint"
 	HTTPEndpointFlagDescription = "The courier http server listening, e.g. 'localhost:8080'"
@@ -43,6 +50,94 @@ const (
 	DataDirFlag            = "datadir"
 	DataDirFlagDescription = "The courier data directory"
 	defaultDataDirFlag     = "./courier_data"
+
+	DBFlag        = "db"
+	dbDescription = "The storage backend in the data directory, 'storm' is the bolt file rootdb, 'sqlite' is the sqlite file courier.sqlite open to SQL queries"
+	defaultDB     = StormDB
+
+	SyncModeFlag        = "sync-mode"
+	syncModeDescription = "How the blocks are ingested, 'event' receives them from the peer deliver service and polls only to catch up, 'poll' queries them every 2 seconds"
+	defaultSyncMode     = PollSync
+
+	PrefetchFlag        = "prefetch"
+	prefetchDescription = "The max number of blocks fetched and decoded concurrently when catching up to the chain head, 1 disables prefetch"
+	defaultPrefetch     = 16
+
+	RecordInvalidFlag        = "record-invalid"
+	recordInvalidDescription = "Record the precommit txs invalidated by the committing peers with their validation codes, see /v1/invalid"
+	defaultRecordInvalid     = false
+
+	PendingTimeoutFlag        = "pending-timeout"
+	pendingTimeoutDescription = "The deadline of a CrossTx waiting for the outchain receipt since it entered Pending, courier aborts it on fabric when expired, 0 disables the deadline"
+	defaultPendingTimeout     = 0
+
+	MaxSendAttemptsFlag        = "outchain-max-attempts"
+	maxSendAttemptsDescription = "The max number of failed sends of a CrossTx to the outchain before it is dead-lettered"
+	defaultMaxSendAttempts     = 10
+
+	RetryBackoffFlag        = "outchain-retry-backoff"
+	retryBackoffDescription = "The initial delay of resending a CrossTx to the outchain, doubled on every failure"
+	defaultRetryBackoff     = time.Second
+
+	OutChainURLFlag        = "outchain"
+	outChainURLDescription = "The outchain endpoint which the CrossTxs are posted to, e.g. 'https://localhost:9090/v1/crosstx', the mock outchain client is used if not set"
+	defaultOutChainURL     = ""
+
+	OutChainTimeoutFlag        = "outchain-timeout"
+	outChainTimeoutDescription = "The timeout of a request to the outchain"
+	defaultOutChainTimeout     = 10 * time.Second
+
+	OutChainBatchSizeFlag        = "outchain-batch"
+	outChainBatchSizeDescription = "The max number of CrossTxs posted to the outchain in one request, 1 disables batch send"
+	defaultOutChainBatchSize     = 64
+
+	OutChainCACertFlag        = "outchain-cacert"
+	outChainCACertDescription = "The PEM file of the CA certificate to verify the outchain server"
+	defaultOutChainCACert     = ""
+
+	OutChainCertFlag        = "outchain-cert"
+	outChainCertDescription = "The PEM file of the client certificate presented to the outchain server"
+	defaultOutChainCert     = ""
+
+	OutChainKeyFlag        = "outchain-key"
+	outChainKeyDescription = "The PEM file of the client private key presented to the outchain server"
+	defaultOutChainKey     = ""
+
+	TLSCertFlag        = "tls-cert"
+	tlsCertDescription = "The PEM file of the certificate of the courier http server, it serves plain http if not set"
+	defaultTLSCert     = ""
+
+	TLSKeyFlag        = "tls-key"
+	tlsKeyDescription = "The PEM file of the private key of the courier http server"
+	defaultTLSKey     = ""
+
+	TLSClientCAFlag        = "tls-client-ca"
+	tlsClientCADescription = "The PEM file of the CA which the client certificates are verified with, setting it requires mTLS except for /healthz, /readyz and /metrics"
+	defaultTLSClientCA     = ""
+
+	ReceiptSecretsFlag        = "receipt-secrets"
+	receiptSecretsDescription = "The file of the HMAC secrets of the outchain relayers, one relayer=secret per line, the receipts must be signed if set"
+	defaultReceiptSecrets     = ""
+
+	InsecureReceiptsFlag        = "insecure-receipts"
+	insecureReceiptsDescription = "Accept the unauthenticated receipts when neither --receipt-secrets nor --tls-client-ca is set"
+	defaultInsecureReceipts     = false
+
+	AdminTokenFileFlag        = "admin-token-file"
+	adminTokenFileDescription = "The file of the bearer token of the /v1/admin API, the admin API is disabled if not set"
+	defaultAdminTokenFile     = ""
+)
+
+const (
+	// PollSync queries the blocks one by one on a timer
+	PollSync = "poll"
+	// EventSync receives the blocks from the deliver service, polling only to catch up from the checkpoint
+	EventSync = "event"
+)
+
+const (
+	StormDB  = "storm"
+	SQLiteDB = "sqlite"
 )
 
 type options struct {
@@ -53,9 +148,24 @@ type options struct {
 	User        string
 	ChannelID   string
 	ChainCodeID string
+	pipelines   string
+	syncMode    string
+	prefetch    int
+
+	recordInvalid bool
 
 	HTTPEndpoint string
 	DataDir      string
+	db           string
+
+	pendingTimeout  time.Duration
+	maxSendAttempts int
+	retryBackoff    time.Duration
+
+	outChain OutChainConfig
+
+	server         ServerConfig
+	adminTokenFile string
 }
 
 type Config struct {
@@ -63,6 +173,47 @@ type Config struct {
 	core.ConfigProvider
 	channel.RequestOption
 	FilterEvents []string
+	Pipelines    []PipelineConfig
+	SyncMode     string
+	Prefetch     int
+	// RecordInvalid records the invalidated precommit txs
+	RecordInvalid bool
+	// DB is the storage backend, storm or sqlite
+	DB string
+
+	// txmanager config
+	PendingTimeout  time.Duration
+	MaxSendAttempts int
+	RetryBackoff    time.Duration
+
+	// outchain client config
+	OutChain OutChainConfig
+
+	// server config
+	Server ServerConfig
+	// AdminToken is the bearer token of the admin API, empty disables it
+	AdminToken string
+}
+
+// PipelineConfig is the channel and chaincode synced by one BlockSync and TxManager pipeline
+type PipelineConfig struct {
+	ChannelID   string
+	ChainCodeID string
+}
+
+// ID identifies the pipeline, e.g. mychannel/mycc
+func (p PipelineConfig) ID() string {
+	return p.ChannelID + "/" + p.ChainCodeID
+}
+
+// ParsePipelineID parses the pipeline ID, e.g. mychannel/mycc
+func ParsePipelineID(id string) (PipelineConfig, error) {
+	ids := strings.Split(id, "/")
+	if len(ids) != 2 || ids[0] == "" || ids[1] == "" {
+		return PipelineConfig{}, fmt.Errorf("invalid pipeline %q, expecting channel/chaincode", id)
+	}
+
+	return PipelineConfig{ChannelID: ids[0], ChainCodeID: ids[1]}, nil
 }
 
 var opts options
@@ -82,6 +233,11 @@ func InitChaincodeID(flags *pflag.FlagSet) {
 	flags.StringVar(&opts.ChainCodeID, ChaincodeIDFlag, defaultChaincodeID, chaincodeIDDescription)
 }
 
+// InitPipelines initializes the channel and chaincode pairs from the provided arguments
+func InitPipelines(flags *pflag.FlagSet) {
+	flags.StringVar(&opts.pipelines, PipelinesFlag, defaultPipelines, pipelinesDescription)
+}
+
 // InitPeerURL initializes the peer URL from the provided arguments
 func InitPeerURL(flags *pflag.FlagSet) {
 	flags.StringVar(&opts.peerUrl, PeerURLFlag, defaultPeerURL, peerURLDescription)
@@ -107,6 +263,61 @@ func InitDataDir(flags *pflag.FlagSet) {
 	flags.StringVar(&opts.DataDir, DataDirFlag, defaultDataDirFlag, DataDirFlagDescription)
 }
 
+// InitDB initializes the storage backend from the provided arguments
+func InitDB(flags *pflag.FlagSet) {
+	flags.StringVar(&opts.db, DBFlag, defaultDB, dbDescription)
+}
+
+// InitSyncMode initializes the block ingestion mode from the provided arguments
+func InitSyncMode(flags *pflag.FlagSet) {
+	flags.StringVar(&opts.syncMode, SyncModeFlag, defaultSyncMode, syncModeDescription)
+}
+
+// InitPrefetch initializes the block prefetch window from the provided arguments
+func InitPrefetch(flags *pflag.FlagSet) {
+	flags.IntVar(&opts.prefetch, PrefetchFlag, defaultPrefetch, prefetchDescription)
+}
+
+// InitRecordInvalid initializes whether the invalidated precommit txs are recorded from the provided arguments
+func InitRecordInvalid(flags *pflag.FlagSet) {
+	flags.BoolVar(&opts.recordInvalid, RecordInvalidFlag, defaultRecordInvalid, recordInvalidDescription)
+}
+
+// InitPendingTimeout initializes the deadline of the pending CrossTxs from the provided arguments
+func InitPendingTimeout(flags *pflag.FlagSet) {
+	flags.DurationVar(&opts.pendingTimeout, PendingTimeoutFlag, defaultPendingTimeout, pendingTimeoutDescription)
+}
+
+// InitSendRetry initializes the retry policy of the outchain sends from the provided arguments
+func InitSendRetry(flags *pflag.FlagSet) {
+	flags.IntVar(&opts.maxSendAttempts, MaxSendAttemptsFlag, defaultMaxSendAttempts, maxSendAttemptsDescription)
+	flags.DurationVar(&opts.retryBackoff, RetryBackoffFlag, defaultRetryBackoff, retryBackoffDescription)
+}
+
+// InitOutChain initializes the outchain client config from the provided arguments
+func InitOutChain(flags *pflag.FlagSet) {
+	flags.StringVar(&opts.outChain.URL, OutChainURLFlag, defaultOutChainURL, outChainURLDescription)
+	flags.DurationVar(&opts.outChain.Timeout, OutChainTimeoutFlag, defaultOutChainTimeout, outChainTimeoutDescription)
+	flags.IntVar(&opts.outChain.MaxBatchSize, OutChainBatchSizeFlag, defaultOutChainBatchSize, outChainBatchSizeDescription)
+	flags.StringVar(&opts.outChain.CACert, OutChainCACertFlag, defaultOutChainCACert, outChainCACertDescription)
+	flags.StringVar(&opts.outChain.Cert, OutChainCertFlag, defaultOutChainCert, outChainCertDescription)
+	flags.StringVar(&opts.outChain.Key, OutChainKeyFlag, defaultOutChainKey, outChainKeyDescription)
+}
+
+// InitServerTLS initializes the TLS and the receipt authentication of the courier http server from the provided arguments
+func InitServerTLS(flags *pflag.FlagSet) {
+	flags.StringVar(&opts.server.Cert, TLSCertFlag, defaultTLSCert, tlsCertDescription)
+	flags.StringVar(&opts.server.Key, TLSKeyFlag, defaultTLSKey, tlsKeyDescription)
+	flags.StringVar(&opts.server.ClientCA, TLSClientCAFlag, defaultTLSClientCA, tlsClientCADescription)
+	flags.StringVar(&opts.server.ReceiptSecrets, ReceiptSecretsFlag, defaultReceiptSecrets, receiptSecretsDescription)
+	flags.BoolVar(&opts.server.InsecureReceipts, InsecureReceiptsFlag, defaultInsecureReceipts, insecureReceiptsDescription)
+}
+
+// InitAdminToken initializes the admin API token file from the provided arguments
+func InitAdminToken(flags *pflag.FlagSet) {
+	flags.StringVar(&opts.adminTokenFile, AdminTokenFileFlag, defaultAdminTokenFile, adminTokenFileDescription)
+}
+
 func peerURLs() []string {
 	if opts.peerUrl == "" {
 		utils.Fatalf("[Config] peer not set")
@@ -132,21 +343,107 @@ func filterEvents() []string {
 	if len(strings.TrimSpace(opts.events)) > 0 {
 		events := strings.Split(opts.events, ",")
 		for _, ev := range events {
-			filterEvents = append(filterEvents, ev)
+			filterEvents = append(filterEvents, strings.TrimSpace(ev))
 		}
 	}
 
 	return filterEvents
 }
 
+func adminToken() string {
+	if opts.adminTokenFile == "" {
+		return ""
+	}
+
+	raw, err := ioutil.ReadFile(opts.adminTokenFile)
+	if err != nil {
+		utils.Fatalf("[Config] read admin token err: %v", err)
+	}
+
+	token := strings.TrimSpace(string(raw))
+	if token == "" {
+		utils.Fatalf("[Config] admin token file %s is empty", opts.adminTokenFile)
+	}
+
+	return token
+}
+
+func syncMode() string {
+	switch opts.syncMode {
+	case PollSync, EventSync:
+		return opts.syncMode
+	default:
+		utils.Fatalf("[Config] unsupported sync mode: %s", opts.syncMode)
+		return ""
+	}
+}
+
+func db() string {
+	switch opts.db {
+	case StormDB, SQLiteDB:
+		return opts.db
+	default:
+		utils.Fatalf("[Config] unsupported db: %s", opts.db)
+		return ""
+	}
+}
+
+func pipelines(c *Config) []PipelineConfig {
+	if strings.TrimSpace(opts.pipelines) == "" {
+		return []PipelineConfig{{ChannelID: c.ChannelID(), ChainCodeID: c.ChainCodeID()}}
+	}
+
+	var list []PipelineConfig
+	seen := make(map[string]struct{})
+	for _, pair := range strings.Split(opts.pipelines, ",") {
+		ids := strings.Split(strings.TrimSpace(pair), ":")
+		if len(ids) != 2 || ids[0] == "" || ids[1] == "" {
+			utils.Fatalf("[Config] invalid pipeline %q, expecting channel:chaincode", pair)
+		}
+
+		p := PipelineConfig{ChannelID: ids[0], ChainCodeID: ids[1]}
+		if _, ok := seen[p.ID()]; ok {
+			utils.Fatalf("[Config] duplicate pipeline %s", p.ID())
+		}
+		seen[p.ID()] = struct{}{}
+
+		list = append(list, p)
+	}
+
+	return list
+}
+
 // InitConfig initializes the configuration
 func InitConfig() *Config {
 	cnfg := config.FromFile(opts.configFile)
 
 	cfg := &Config{
-		ConfigProvider: cnfg,
-		RequestOption:  channel.WithTargetEndpoints(peerURLs()...),
-		FilterEvents:   filterEvents(),
+		ConfigProvider:  cnfg,
+		RequestOption:   channel.WithTargetEndpoints(peerURLs()...),
+		FilterEvents:    filterEvents(),
+		SyncMode:        syncMode(),
+		Prefetch:        opts.prefetch,
+		RecordInvalid:   opts.recordInvalid,
+		DB:              db(),
+		PendingTimeout:  opts.pendingTimeout,
+		MaxSendAttempts: opts.maxSendAttempts,
+		RetryBackoff:    opts.retryBackoff,
+		OutChain:        opts.outChain,
+		Server:          opts.server,
+		AdminToken:      adminToken(),
+	}
+
+	cfg.Pipelines = pipelines(cfg)
+
+	return cfg
+}
+
+// InitStorageConfig initializes the configuration of the commands which only open the database,
+// the pipelines are optional, the first one receives the data of the layout before the pipelines
+func InitStorageConfig() *Config {
+	cfg := &Config{DB: db()}
+	if strings.TrimSpace(opts.pipelines) != "" || opts.ChannelID != "" && opts.ChainCodeID != "" {
+		cfg.Pipelines = pipelines(cfg)
 	}
 
 	return cfg
@@ -163,7 +460,7 @@ func (c *Config) UserName() string {
 
 // ChannelID returns the channel ID
 func (c *Config) ChannelID() string {
-	if opts.User == "" {
+	if opts.ChannelID == "" {
 		utils.Fatalf("[Config] cid not set")
 	}
 
@@ -172,7 +469,7 @@ func (c *Config) ChannelID() string {
 
 // ChainCodeID returns the chaicode ID
 func (c *Config) ChainCodeID() string {
-	if opts.ChannelID == "" {
+	if opts.ChainCodeID == "" {
 		utils.Fatalf("[Config] ccid not set")
 	}
 
@@ -193,3 +490,13 @@ func (c *Config) HTTPEndpoint() string {
 func (c *Config) DataDir() string {
 	return opts.DataDir
 }
+
+// DefaultPipeline returns the first pipeline, the data of the layout before the pipelines belongs to it,
+// nil if no pipeline is configured
+func (c *Config) DefaultPipeline() *PipelineConfig {
+	if len(c.Pipelines) == 0 {
+		return nil
+	}
+
+	return &c.Pipelines[0]
+}
@@ -0,0 +1,259 @@
+package client
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/icodezjb/fabric-study/log"
+)
+
+// maxErrorBodySize limits how much of an unexpected response body is kept in the error
+const maxErrorBodySize = 512
+
+type OutChainConfig struct {
+	// URL is the outchain endpoint, the CrossTxs are posted to it
+	URL string
+	// Timeout is the whole request timeout, including connection, TLS handshake and response body
+	Timeout time.Duration
+	// MaxBatchSize is the max number of CrossTxs in one request, SendBatch splits larger batches
+	MaxBatchSize int
+	// Header is added to every request, e.g. the channel and chaincode of the pipeline
+	Header http.Header
+
+	// CACert is the PEM file of the CA to verify the outchain server, system roots are used when empty
+	CACert string
+	// Cert and Key are the PEM files of the client certificate, used when the outchain requires mTLS
+	Cert string
+	Key  string
+}
+
+type HTTPOutChainClient struct {
+	url          string
+	maxBatchSize int
+	header       http.Header
+	client       *http.Client
+}
+
+// BatchResponse is the body the outchain answers a batch request with,
+// an empty body or an empty Failed list means the whole batch was accepted
+type BatchResponse struct {
+	Failed []BatchFailure `json:"failed"`
+}
+
+type BatchFailure struct {
+	// Index of the CrossTx in the posted array
+	Index int    `json:"index"`
+	Error string `json:"error"`
+}
+
+const (
+	// ChannelHeader and ChaincodeHeader tell the outchain which pipeline the CrossTxs come from,
+	// the receipts are posted back with them
+	ChannelHeader   = "X-Courier-Channel"
+	ChaincodeHeader = "X-Courier-Chaincode"
+)
+
+// NewOutChainClient returns the HTTP outchain client of the pipeline, or the mock one if the outchain url is not set
+func NewOutChainClient(cfg *Config, pipeline PipelineConfig) (OutChainClient, error) {
+	if cfg.OutChain.URL == "" {
+		log.Warn("[OutChainClient] use mock outchain client, no CrossTx leaves the process", "pipeline", pipeline.ID())
+		return &MockOutChainClient{}, nil
+	}
+
+	oc := cfg.OutChain
+	oc.Header = http.Header{}
+	oc.Header.Set(ChannelHeader, pipeline.ChannelID)
+	oc.Header.Set(ChaincodeHeader, pipeline.ChainCodeID)
+
+	return NewHTTPOutChainClient(oc)
+}
+
+func NewHTTPOutChainClient(cfg OutChainConfig) (*HTTPOutChainClient, error) {
+	if cfg.URL == "" {
+		return nil, fmt.Errorf("outchain url not set")
+	}
+
+	tlsConfig, err := cfg.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = defaultOutChainTimeout
+	}
+
+	maxBatchSize := cfg.MaxBatchSize
+	if maxBatchSize <= 0 {
+		maxBatchSize = defaultOutChainBatchSize
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	log.Info("[OutChainClient] initialized http outchain client", "url", cfg.URL, "timeout", timeout, "maxBatchSize", maxBatchSize)
+
+	return &HTTPOutChainClient{
+		url:          cfg.URL,
+		maxBatchSize: maxBatchSize,
+		header:       cfg.Header,
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   timeout,
+		},
+	}, nil
+}
+
+func (cfg OutChainConfig) tlsConfig() (*tls.Config, error) {
+	if cfg.CACert == "" && cfg.Cert == "" && cfg.Key == "" {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{}
+
+	if cfg.CACert != "" {
+		raw, err := ioutil.ReadFile(cfg.CACert)
+		if err != nil {
+			return nil, fmt.Errorf("read outchain ca cert err: %w", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(raw) {
+			return nil, fmt.Errorf("no certificate found in %s", cfg.CACert)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if cfg.Cert != "" || cfg.Key != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.Cert, cfg.Key)
+		if err != nil {
+			return nil, fmt.Errorf("load outchain client cert err: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// Send posts one marshalled CrossTx to the outchain, any non 2xx status is an error
+func (c *HTTPOutChainClient) Send(raw []byte) error {
+	_, err := c.post(raw)
+	return err
+}
+
+// SendBatch posts the marshalled CrossTxs as JSON arrays of at most maxBatchSize items,
+// a failed request fails all of its items, the outchain reports partial failures with a BatchResponse
+func (c *HTTPOutChainClient) SendBatch(batch [][]byte) []error {
+	errs := make([]error, len(batch))
+
+	for start := 0; start < len(batch); start += c.maxBatchSize {
+		end := start + c.maxBatchSize
+		if end > len(batch) {
+			end = len(batch)
+		}
+
+		c.sendChunk(batch[start:end], errs[start:end])
+	}
+
+	return errs
+}
+
+func (c *HTTPOutChainClient) sendChunk(chunk [][]byte, errs []error) {
+	if len(chunk) == 1 {
+		errs[0] = c.Send(chunk[0])
+		return
+	}
+
+	fail := func(err error) {
+		for i := range errs {
+			errs[i] = err
+		}
+	}
+
+	body, err := json.Marshal(rawArray(chunk))
+	if err != nil {
+		fail(fmt.Errorf("marshal batch err: %w", err))
+		return
+	}
+
+	respBody, err := c.post(body)
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	if len(bytes.TrimSpace(respBody)) == 0 {
+		return
+	}
+
+	var resp BatchResponse
+	if err = json.Unmarshal(respBody, &resp); err != nil {
+		fail(fmt.Errorf("parse outchain batch response err: %w", err))
+		return
+	}
+
+	for _, f := range resp.Failed {
+		if f.Index < 0 || f.Index >= len(errs) {
+			log.Warn("[OutChainClient] batch response index out of range", "index", f.Index, "len(batch)", len(errs))
+			continue
+		}
+		errs[f.Index] = fmt.Errorf("outchain rejected: %s", f.Error)
+	}
+}
+
+func (c *HTTPOutChainClient) post(body []byte) ([]byte, error) {
+	req, err := http.NewRequest("POST", c.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("new outchain request err: %w", err)
+	}
+
+	for key, values := range c.header {
+		req.Header[key] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("post to outchain err: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBodySize))
+		return nil, fmt.Errorf("outchain response status %d: %s", resp.StatusCode, bytes.TrimSpace(msg))
+	}
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("read outchain response err: %w", err)
+	}
+
+	return respBody, nil
+}
+
+// rawArray marshals the already marshalled items as a JSON array without decoding them again
+type rawArray [][]byte
+
+func (a rawArray) MarshalJSON() ([]byte, error) {
+	buf := bytes.NewBufferString("[")
+	for i, raw := range a {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.Write(raw)
+	}
+	buf.WriteByte(']')
+
+	return buf.Bytes(), nil
+}
+
+func (c *HTTPOutChainClient) Close() {
+	c.client.CloseIdleConnections()
+}
@@ -0,0 +1,195 @@
+package client
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHTTPOutChainClientSend(t *testing.T) {
+	var got []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" || req.Header.Get("Content-Type") != "application/json" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		got, _ = ioutil.ReadAll(req.Body)
+	}))
+	defer server.Close()
+
+	c, err := NewHTTPOutChainClient(OutChainConfig{URL: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := c.Send([]byte(`{"CrossID":"a"}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	if string(got) != `{"CrossID":"a"}` {
+		t.Fatalf("body, want: <%s>, got: <%s>", `{"CrossID":"a"}`, got)
+	}
+}
+
+func TestOutChainClientPipelineHeader(t *testing.T) {
+	var channel, chaincode string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		channel, chaincode = req.Header.Get(ChannelHeader), req.Header.Get(ChaincodeHeader)
+	}))
+	defer server.Close()
+
+	c, err := NewOutChainClient(&Config{OutChain: OutChainConfig{URL: server.URL}}, PipelineConfig{ChannelID: "mychannel", ChainCodeID: "mycc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := c.Send([]byte(`{"CrossID":"a"}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	if channel != "mychannel" || chaincode != "mycc" {
+		t.Fatalf("pipeline headers, want: mychannel mycc, got: %s %s", channel, chaincode)
+	}
+}
+
+func TestHTTPOutChainClientStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, "outchain busy", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	c, err := NewHTTPOutChainClient(OutChainConfig{URL: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := c.Send([]byte("{}")); err == nil {
+		t.Fatal("expected error on 503 response")
+	}
+}
+
+func TestHTTPOutChainClientSendBatch(t *testing.T) {
+	var requests [][]json.RawMessage
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var batch []json.RawMessage
+		if err := json.NewDecoder(req.Body).Decode(&batch); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		requests = append(requests, batch)
+
+		// reject the second item of every batch
+		if len(batch) > 1 {
+			_ = json.NewEncoder(w).Encode(BatchResponse{Failed: []BatchFailure{{Index: 1, Error: "rejected"}}})
+		}
+	}))
+	defer server.Close()
+
+	c, err := NewHTTPOutChainClient(OutChainConfig{URL: server.URL, MaxBatchSize: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var batch [][]byte
+	for i := 0; i < 4; i++ {
+		batch = append(batch, []byte(fmt.Sprintf(`{"CrossID":"%d"}`, i)))
+	}
+
+	errs := c.SendBatch(batch)
+
+	if len(requests) != 2 {
+		t.Fatalf("requests, want: 2, got: %d", len(requests))
+	}
+
+	for i, err := range errs {
+		if failed := i%2 == 1; failed != (err != nil) {
+			t.Fatalf("errs[%d], want failed: %v, got: %v", i, failed, err)
+		}
+	}
+}
+
+func TestHTTPOutChainClientSendBatchStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, "outchain busy", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	c, err := NewHTTPOutChainClient(OutChainConfig{URL: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for i, err := range c.SendBatch([][]byte{[]byte("{}"), []byte("{}")}) {
+		if err == nil {
+			t.Fatalf("errs[%d], expected error on 503 response", i)
+		}
+	}
+}
+
+func TestHTTPOutChainClientTimeout(t *testing.T) {
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-done
+	}))
+	defer server.Close()
+	defer close(done)
+
+	c, err := NewHTTPOutChainClient(OutChainConfig{URL: server.URL, Timeout: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := c.Send([]byte("{}")); err == nil {
+		t.Fatal("expected timeout error")
+	}
+}
+
+func TestHTTPOutChainClientTLS(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer server.Close()
+
+	// without the server CA the handshake must fail
+	c, err := NewHTTPOutChainClient(OutChainConfig{URL: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Send([]byte("{}")); err == nil {
+		t.Fatal("expected certificate verification error")
+	}
+	c.Close()
+
+	dir, err := ioutil.TempDir("", "outchain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	caFile := filepath.Join(dir, "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := ioutil.WriteFile(caFile, caPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err = NewHTTPOutChainClient(OutChainConfig{URL: server.URL, CACert: caFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := c.Send([]byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+}
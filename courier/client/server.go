@@ -0,0 +1,121 @@
+package client
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+type ServerConfig struct {
+	// Cert and Key are the PEM files of the server certificate, the server listens on plain http if not set
+	Cert string
+	Key  string
+	// ClientCA is the PEM file of the CA which the client certificates are verified with, setting it requires mTLS
+	// on the paths other than the probes and the metrics
+	ClientCA string
+	// ReceiptSecrets is the file of the HMAC secrets of the outchain relayers, one relayer=secret per line
+	ReceiptSecrets string
+	// InsecureReceipts accepts the unauthenticated receipts when neither the secrets nor the client CA is set
+	InsecureReceipts bool
+}
+
+const (
+	// RelayerHeader, TimestampHeader and SignatureHeader sign a receipt request, see SignRequest
+	RelayerHeader   = "X-Courier-Relayer"
+	TimestampHeader = "X-Courier-Timestamp"
+	SignatureHeader = "X-Courier-Signature"
+)
+
+// TLSConfig returns the TLS config of the server, nil if the server certificate is not set
+func (cfg ServerConfig) TLSConfig() (*tls.Config, error) {
+	if cfg.Cert == "" && cfg.Key == "" {
+		if cfg.ClientCA != "" {
+			return nil, fmt.Errorf("client ca needs the server certificate")
+		}
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(cfg.Cert, cfg.Key)
+	if err != nil {
+		return nil, fmt.Errorf("load server cert err: %w", err)
+	}
+
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	if cfg.ClientCA != "" {
+		raw, err := ioutil.ReadFile(cfg.ClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("read client ca cert err: %w", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(raw) {
+			return nil, fmt.Errorf("no certificate found in %s", cfg.ClientCA)
+		}
+		// the probes and the metrics are served without certificate, the handler requires it on the other paths
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return tlsConfig, nil
+}
+
+// LoadReceiptSecrets reads the HMAC secrets by relayer, nil if the secrets file is not set,
+// the blank lines and the lines starting with # are skipped
+func (cfg ServerConfig) LoadReceiptSecrets() (map[string][]byte, error) {
+	if cfg.ReceiptSecrets == "" {
+		return nil, nil
+	}
+
+	f, err := os.Open(cfg.ReceiptSecrets)
+	if err != nil {
+		return nil, fmt.Errorf("open receipt secrets err: %w", err)
+	}
+	defer f.Close()
+
+	secrets := make(map[string][]byte)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" || strings.TrimSpace(kv[1]) == "" {
+			return nil, fmt.Errorf("%s line %d: expecting relayer=secret", cfg.ReceiptSecrets, n)
+		}
+
+		secrets[strings.TrimSpace(kv[0])] = []byte(strings.TrimSpace(kv[1]))
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read receipt secrets err: %w", err)
+	}
+
+	if len(secrets) == 0 {
+		return nil, fmt.Errorf("no secret found in %s", cfg.ReceiptSecrets)
+	}
+
+	return secrets, nil
+}
+
+// SignRequest returns the hex HMAC-SHA256 of the request, the relayer sends it in the SignatureHeader
+// with its name in the RelayerHeader and the unix timestamp in the TimestampHeader,
+// the uri is the path with the query, e.g. /v1/receipt?channel=mychannel
+//
+//	hmac(secret, timestamp + "\n" + method + "\n" + uri + "\n" + body)
+func SignRequest(secret []byte, timestamp, method, uri string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp + "\n" + method + "\n" + uri + "\n"))
+	mac.Write(body)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,159 @@
+package client
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// issue writes the PEM certificate and key signed by the parent, self-signed if the parent is nil
+func issue(t *testing.T, dir, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if parent == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid = true, true
+		parent, parentKey = tmpl, key
+	}
+
+	raw, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyRaw, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, name+".pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyRaw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cert, key
+}
+
+func TestServerConfigMTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca, caKey := issue(t, dir, "ca", nil, nil)
+	issue(t, dir, "server", ca, caKey)
+	issue(t, dir, "relayer", ca, caKey)
+
+	if _, err := (ServerConfig{ClientCA: filepath.Join(dir, "ca.pem")}).TLSConfig(); err == nil {
+		t.Fatal("want error of the client ca without the server certificate")
+	}
+
+	tlsConfig, err := ServerConfig{
+		Cert:     filepath.Join(dir, "server.pem"),
+		Key:      filepath.Join(dir, "server.key"),
+		ClientCA: filepath.Join(dir, "ca.pem"),
+	}.TLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tlsConfig.ClientAuth != tls.VerifyClientCertIfGiven {
+		t.Fatalf("client auth, want: VerifyClientCertIfGiven, got: %v", tlsConfig.ClientAuth)
+	}
+
+	// the handshake verifies the given certificate, the handler requires it
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if len(req.TLS.VerifiedChains) == 0 {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	server.TLS = tlsConfig
+	server.StartTLS()
+	defer server.Close()
+
+	anonymous, err := NewHTTPOutChainClient(OutChainConfig{URL: server.URL, CACert: filepath.Join(dir, "ca.pem")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer anonymous.Close()
+
+	if err := anonymous.Send([]byte("{}")); err == nil {
+		t.Fatal("want error of the client without certificate")
+	}
+
+	relayer, err := NewHTTPOutChainClient(OutChainConfig{
+		URL:    server.URL,
+		CACert: filepath.Join(dir, "ca.pem"),
+		Cert:   filepath.Join(dir, "relayer.pem"),
+		Key:    filepath.Join(dir, "relayer.key"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer relayer.Close()
+
+	if err := relayer.Send([]byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadReceiptSecrets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "secrets")
+	if err := ioutil.WriteFile(file, []byte("# relayers\nrelayer-1 = s1\n\nrelayer-2=s=2\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	secrets, err := ServerConfig{ReceiptSecrets: file}.LoadReceiptSecrets()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(secrets) != 2 || string(secrets["relayer-1"]) != "s1" || string(secrets["relayer-2"]) != "s=2" {
+		t.Fatalf("secrets, got: %q", secrets)
+	}
+
+	if err := ioutil.WriteFile(file, []byte("relayer-1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := (ServerConfig{ReceiptSecrets: file}).LoadReceiptSecrets(); err == nil {
+		t.Fatal("want error of the line without secret")
+	}
+}
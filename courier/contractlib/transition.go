@@ -0,0 +1,43 @@
+package contractlib
+
+import (
+	"errors"
+	"fmt"
+)
+
+var ErrIllegalTransition = errors.New("illegal status transition")
+
+// transitions is the table of the legal status changes of a cross chain transaction,
+// Completed and Aborted are terminal
+//
+//	Init -> Pending -> Executed -> Completed
+//	Finished -> Completed
+//	Init, Pending, Executed, DeadLetter -> Aborted
+//	Init -> DeadLetter -> Init
+var transitions = map[CStatus][]CStatus{
+	Init:       {Pending, DeadLetter, Aborted},
+	Pending:    {Executed, Aborted},
+	Executed:   {Completed, Aborted},
+	Finished:   {Completed},
+	DeadLetter: {Init, Aborted},
+}
+
+// CanTransition reports whether the status can change to the given one
+func (c CStatus) CanTransition(to CStatus) bool {
+	for _, next := range transitions[c] {
+		if next == to {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ValidateTransition returns an error wrapping ErrIllegalTransition if from can not change to to
+func ValidateTransition(from, to CStatus) error {
+	if !from.CanTransition(to) {
+		return fmt.Errorf("%w: %s to %s", ErrIllegalTransition, from, to)
+	}
+
+	return nil
+}
@@ -22,6 +22,12 @@ const (
 	Finished
 	// Completed is the fabric commit contract transaction status flag, change by courier
 	Completed
+	// Aborted is the fabric precommit contract transaction status flag, generate on fabric chaincode
+	// when courier gives up waiting for the outchain receipt
+	Aborted
+	// DeadLetter is the fabric precommit contract transaction status flag, change by courier
+	// when sending to the outchain keeps failing, an operator requeues it
+	DeadLetter
 )
 
 func (c CStatus) String() string {
@@ -36,6 +42,10 @@ func (c CStatus) String() string {
 		return "Finished"
 	case Completed:
 		return "Completed"
+	case Aborted:
+		return "Aborted"
+	case DeadLetter:
+		return "DeadLetter"
 	default:
 		return "UnSupport"
 	}
@@ -53,6 +63,10 @@ func ParseCStatus(c string) (CStatus, error) {
 		return Finished, nil
 	case "Completed":
 		return Completed, nil
+	case "Aborted":
+		return Aborted, nil
+	case "DeadLetter":
+		return DeadLetter, nil
 	}
 
 	var status CStatus
@@ -84,11 +98,39 @@ func (c *Contract) UnmarshalJSON(bytes []byte) (err error) {
 		return err
 	}
 
-	c.IContract, err = RebuildIContract(*objMap["IContract"])
+	raw, ok := objMap["IContract"]
+	if !ok || raw == nil {
+		return fmt.Errorf("contract missing field IContract")
+	}
+
+	c.IContract, err = RebuildIContract(*raw)
 
 	return err
 }
 
+// ContractType is the concrete type of an IContract, it is saved with the contract
+// so the type is not inferred from the status
+type ContractType string
+
+const (
+	PrecommitType ContractType = "precommit"
+	CommitType    ContractType = "commit"
+)
+
+// TypeOf returns the type of the contract, empty if it is unknown
+func TypeOf(c IContract) ContractType {
+	switch c.(type) {
+	case *PrecommitContract:
+		return PrecommitType
+	case *CommitContract:
+		return CommitType
+	default:
+		return ""
+	}
+}
+
+// RebuildIContract decodes the contract whose type is unknown, it is inferred from the status,
+// the Finished is a commit contract and the others are precommit contracts
 func RebuildIContract(bytes json.RawMessage) (c IContract, err error) {
 	var contractMap map[string]*json.RawMessage
 	err = json.Unmarshal(bytes, &contractMap)
@@ -96,29 +138,36 @@ func RebuildIContract(bytes json.RawMessage) (c IContract, err error) {
 		return nil, err
 	}
 
-	var typ string
-	err = json.Unmarshal(*contractMap["status"], &typ)
-	if err != nil {
-		return nil, err
+	raw, ok := contractMap["status"]
+	if !ok || raw == nil {
+		return nil, fmt.Errorf("contract missing field status")
+	}
+
+	var status CStatus
+	if err = json.Unmarshal(*raw, &status); err != nil {
+		return nil, fmt.Errorf("contract status: %w", err)
+	}
+
+	if status == Finished {
+		return RebuildIContractAs(CommitType, bytes)
 	}
 
+	return RebuildIContractAs(PrecommitType, bytes)
+}
+
+// RebuildIContractAs decodes the contract of the given type
+func RebuildIContractAs(typ ContractType, bytes json.RawMessage) (c IContract, err error) {
 	switch typ {
-	case "Init":
-		fallthrough
-	case "Pending":
-		fallthrough
-	case "Executed":
-		fallthrough
-	case "Completed":
-		var pc PrecommitContract
-		err = json.Unmarshal(bytes, &pc)
-		c = &pc
-	case "Finished":
-		var cc CommitContract
-		err = json.Unmarshal(bytes, &cc)
-		c = &cc
+	case PrecommitType:
+		c = new(PrecommitContract)
+	case CommitType:
+		c = new(CommitContract)
 	default:
-		return nil, fmt.Errorf("unsupport contract type: %s", typ)
+		return nil, fmt.Errorf("unsupport contract type: %q", typ)
+	}
+
+	if err = json.Unmarshal(bytes, c); err != nil {
+		return nil, fmt.Errorf("%s contract: %w", typ, err)
 	}
 
 	return c, nil
@@ -2,6 +2,7 @@ package contractlib
 
 import (
 	"encoding/json"
+	"errors"
 	"testing"
 )
 
@@ -95,3 +96,56 @@ func TestIncRebuildIContract(t *testing.T) {
 
 	}
 }
+
+func TestTransition(t *testing.T) {
+	for _, c := range []struct {
+		from, to CStatus
+		legal    bool
+	}{
+		{Init, Pending, true},
+		{Pending, Executed, true},
+		{Executed, Completed, true},
+		{Finished, Completed, true},
+		{Pending, Aborted, true},
+		{Init, DeadLetter, true},
+		{DeadLetter, Init, true},
+		{Completed, Pending, false},
+		{Aborted, Pending, false},
+		{Init, Executed, false},
+		{Pending, Init, false},
+	} {
+		err := ValidateTransition(c.from, c.to)
+		if c.legal && err != nil {
+			t.Fatalf("%s to %s, want legal, got: %v", c.from, c.to, err)
+		}
+		if !c.legal && !errors.Is(err, ErrIllegalTransition) {
+			t.Fatalf("%s to %s, want ErrIllegalTransition, got: %v", c.from, c.to, err)
+		}
+	}
+}
+
+func TestRebuildIContract(t *testing.T) {
+	for _, raw := range []string{`{}`, `{"status":null}`, `{"status":"Nope"}`, `[]`} {
+		if _, err := RebuildIContract(json.RawMessage(raw)); err == nil {
+			t.Fatalf("want error of the contract %s", raw)
+		}
+	}
+
+	var c Contract
+	if err := json.Unmarshal([]byte(`{"other":1}`), &c); err == nil {
+		t.Fatal("want error of the contract without IContract")
+	}
+
+	// the saved type is kept whatever the status is
+	c2, err := RebuildIContractAs(PrecommitType, json.RawMessage(`{"status":"Finished","contract_id":"a"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if TypeOf(c2) != PrecommitType || c2.GetStatus() != Finished || c2.GetContractID() != "a" {
+		t.Fatalf("precommit contract, got: %+v", c2)
+	}
+
+	if _, err := RebuildIContractAs("escrow", json.RawMessage(`{}`)); err == nil {
+		t.Fatal("want error of the unknown contract type")
+	}
+}
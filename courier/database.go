@@ -1,15 +1,23 @@
 package courier
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/icodezjb/fabric-study/courier/client"
 	"github.com/icodezjb/fabric-study/courier/contractlib"
 	"github.com/icodezjb/fabric-study/log"
 
 	"github.com/asdine/storm/v3"
 	"github.com/asdine/storm/v3/q"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	bolt "go.etcd.io/bbolt"
 )
 
 type FieldName = string
@@ -18,34 +26,245 @@ const (
 	PK             FieldName = "PK"
 	CrossIdIndex   FieldName = "CrossID"
 	StatusField    FieldName = "Status"
-	TimestampField FieldName = "Timestamp"
+	TimestampField FieldName = "TimeStamp"
 )
 
+// statusMatcher matches the status of the contract, storm field matchers
+// can not reach the Status field behind the embedded IContract interface
+type statusMatcher []contractlib.CStatus
+
+// StatusIn matches the CrossTxs whose status is one of the given status
+func StatusIn(status ...contractlib.CStatus) q.Matcher {
+	return statusMatcher(status)
+}
+
+func (m statusMatcher) Match(i interface{}) (bool, error) {
+	var c *CrossTx
+	switch v := i.(type) {
+	case CrossTx:
+		c = &v
+	case *CrossTx:
+		c = v
+	default:
+		return false, fmt.Errorf("status matcher: unsupported type %T", i)
+	}
+
+	if c.IContract == nil {
+		return false, nil
+	}
+
+	for _, status := range m {
+		if c.GetStatus() == status {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// timeMatcher matches the CrossTxs whose timestamp is in the unix time range [from, to],
+// storm field matchers can not compare the fields of the timestamp
+type timeMatcher struct {
+	from, to int64
+}
+
+// TimeBetween matches the CrossTxs whose timestamp seconds are in [from, to], 0 leaves the bound open
+func TimeBetween(from, to int64) q.Matcher {
+	return timeMatcher{from: from, to: to}
+}
+
+func (m timeMatcher) Match(i interface{}) (bool, error) {
+	var c *CrossTx
+	switch v := i.(type) {
+	case CrossTx:
+		c = &v
+	case *CrossTx:
+		c = v
+	default:
+		return false, fmt.Errorf("time matcher: unsupported type %T", i)
+	}
+
+	if c.TimeStamp == nil {
+		return false, nil
+	}
+
+	return (m.from == 0 || c.TimeStamp.Seconds >= m.from) && (m.to == 0 || c.TimeStamp.Seconds <= m.to), nil
+}
+
+// blockMatcher matches the CrossTxs whose block number is in [from, to]
+type blockMatcher struct {
+	from, to uint64
+}
+
+// BlockBetween matches the CrossTxs whose block numbers are in [from, to], 0 leaves the bound open
+func BlockBetween(from, to uint64) q.Matcher {
+	return blockMatcher{from: from, to: to}
+}
+
+func (m blockMatcher) Match(i interface{}) (bool, error) {
+	var c *CrossTx
+	switch v := i.(type) {
+	case CrossTx:
+		c = &v
+	case *CrossTx:
+		c = v
+	default:
+		return false, fmt.Errorf("block matcher: unsupported type %T", i)
+	}
+
+	return (m.from == 0 || c.BlockNumber >= m.from) && (m.to == 0 || c.BlockNumber <= m.to), nil
+}
+
 type DB interface {
 	Save(txList []*CrossTx) error
-	Updates(idList []string, updaters []func(c *CrossTx)) error
+	// SaveBlock saves the new CrossTxs, the updates of the stored ones and the invalidated precommits of the block
+	// and checkpoints the block in one transaction
+	SaveBlock(number uint64, txList []*CrossTx, updates []*CrossTxUpdate, invalids []*InvalidPrecommit) error
+	// Updates applies the updaters to the CrossTxs in one transaction, the updates rejected by
+	// their updaters are skipped and returned as UpdateErrors, the others are committed.
+	// An unknown CrossID fails the whole transaction with ErrCrossTxNotFound
+	Updates(idList []string, updaters []func(c *CrossTx) error) error
 	One(fieldName string, value interface{}) *CrossTx
 	Set(key string, value uint64) error
 	Get(key string) uint64
 	Query(pageSize int, startPage int, orderBy []FieldName, reverse bool, filter ...q.Matcher) []*CrossTx
+
+	SaveReceipt(r *ReceiptRecord) error
+	GetReceipt(crossID string) *ReceiptRecord
+	QueryReceipts(filter ...q.Matcher) []*ReceiptRecord
+
+	QueryInvalidPrecommits(filter ...q.Matcher) []*InvalidPrecommit
+
+	SaveAudit(r *AuditRecord) error
+	QueryAudit(filter ...q.Matcher) []*AuditRecord
+
+	// CountByStatus counts the CrossTxs by the status of their contracts
+	CountByStatus() (map[contractlib.CStatus]int, error)
+
+	QueryTransitions(afterID uint64, limit int, filter ...q.Matcher) []*TransitionEvent
+	// Transitions is the bus of the status changes committed by Save, SaveBlock and Updates, nil if not published
+	Transitions() *TransitionBus
+}
+
+// ErrCrossTxNotFound is wrapped by the errors of the updates and the receipts of unknown CrossTxs
+var ErrCrossTxNotFound = errors.New("not found")
+
+// UpdateErrors are the updates rejected by their updaters, by crossID
+type UpdateErrors map[string]error
+
+func (e UpdateErrors) Error() string {
+	ids := make([]string, 0, len(e))
+	for id := range e {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	msgs := make([]string, 0, len(ids))
+	for _, id := range ids {
+		msgs = append(msgs, fmt.Sprintf("%s: %v", id, e[id]))
+	}
+
+	return fmt.Sprintf("%d updates rejected: %s", len(e), strings.Join(msgs, "; "))
+}
+
+// rejectedUpdates returns the rejected updates of the Updates error, ok is false if the whole update failed
+func rejectedUpdates(err error) (rejected UpdateErrors, ok bool) {
+	if err == nil {
+		return nil, true
+	}
+
+	ok = errors.As(err, &rejected)
+	return rejected, ok
+}
+
+// Backend is the database shared by the pipelines, each pipeline opens its own DB in it
+type Backend interface {
+	Open(channelID, chaincodeID string) (DB, error)
+	// Pipelines returns the pipelines which have records in the backend
+	Pipelines() ([]client.PipelineConfig, error)
+	Close() error
+}
+
+// OpenBackend opens the storm or the sqlite backend in the data directory, see OpenStormDB for the default pipeline
+func OpenBackend(kind, dataDir string, defaultPipeline *client.PipelineConfig) (Backend, error) {
+	switch kind {
+	case client.StormDB:
+		root, err := OpenStormDB(dataDir, defaultPipeline)
+		if err != nil {
+			return nil, err
+		}
+		return stormBackend{root}, nil
+	case client.SQLiteDB:
+		db, err := OpenSQLiteDB(dataDir)
+		if err != nil {
+			return nil, err
+		}
+		return sqliteBackend{db}, nil
+	default:
+		return nil, fmt.Errorf("unsupported db %q", kind)
+	}
+}
+
+type stormBackend struct {
+	*storm.DB
+}
+
+func (b stormBackend) Open(channelID, chaincodeID string) (DB, error) {
+	return NewStore(b.DB, channelID, chaincodeID)
+}
+
+func (b stormBackend) Pipelines() (pipelines []client.PipelineConfig, err error) {
+	err = b.Bolt.View(func(tx *bolt.Tx) error {
+		pipelines = pipelineBuckets(tx, "CrossTx", "config")
+		return nil
+	})
+
+	return pipelines, err
 }
 
 type Store struct {
 	db storm.Node
+
+	// mu orders the publishing of the transitions as their commits, bolt serializes the writes anyway
+	mu  sync.Mutex
+	bus *TransitionBus
+	// counts are the CrossTxs by status, counted at the first CountByStatus then kept up to date
+	// by the committed transitions, guarded by mu
+	counts map[contractlib.CStatus]int
 }
 
-func OpenStormDB(dataDir string) (*storm.DB, error) {
+const openTimeout = time.Second
+
+// OpenStormDB opens the storm database of all the pipelines in the data directory, and migrates it to SchemaVersion.
+// The data of the layout before the pipelines is moved to the default pipeline, nil refuses such a database
+func OpenStormDB(dataDir string, defaultPipeline *client.PipelineConfig) (*storm.DB, error) {
 	var workDir = os.TempDir()
 
 	if dataDir != "" {
 		workDir = dataDir
 	}
-	return storm.Open(filepath.Join(workDir, "rootdb"))
+	// bolt locks the file, fail instead of waiting for the running courier
+	root, err := storm.Open(filepath.Join(workDir, "rootdb"), storm.BoltOptions(0600, &bolt.Options{Timeout: openTimeout}))
+	if err != nil {
+		return nil, err
+	}
+
+	if err = migrate(root, defaultPipeline); err != nil {
+		root.Close()
+		return nil, err
+	}
+
+	return root, nil
 }
 
-func NewStore(root *storm.DB) (*Store, error) {
-	s := &Store{}
-	s.db = root.From("mychannel").WithBatch(true)
+// NewStore returns the store of a pipeline, in the bucket of its channel and chaincode
+func NewStore(root *storm.DB, channelID, chaincodeID string) (*Store, error) {
+	if channelID == "" || chaincodeID == "" {
+		return nil, fmt.Errorf("store needs the channel and chaincode")
+	}
+
+	s := &Store{bus: NewTransitionBus()}
+	s.db = root.From(channelID, chaincodeID).WithBatch(true)
 	return s, nil
 }
 
@@ -65,38 +284,150 @@ func (s *Store) Get(key string) uint64 {
 func (s *Store) Save(txList []*CrossTx) error {
 	log.Debug("[Store] to save cross txs", "len(txList)", len(txList))
 
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	withTransaction, err := s.db.Begin(true)
 	if err != nil {
 		return fmt.Errorf("db begin err: %w", err)
 	}
 	defer withTransaction.Rollback()
 
+	events, err := save(withTransaction, txList)
+	if err != nil {
+		return err
+	}
+
+	if err = withTransaction.Commit(); err != nil {
+		return err
+	}
+
+	s.publish(events)
+	return nil
+}
+
+// SaveBlock saves the CrossTxs, the updates and the invalidated precommits of the block, and sets the "number" checkpoint
+// to the next block, either all or none are committed, so a block is never skipped nor half processed
+func (s *Store) SaveBlock(number uint64, txList []*CrossTx, updates []*CrossTxUpdate, invalids []*InvalidPrecommit) error {
+	log.Debug("[Store] to save block", "blockNumber", number, "len(txList)", len(txList), "len(updates)", len(updates), "len(invalids)", len(invalids))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	withTransaction, err := s.db.Begin(true)
+	if err != nil {
+		return fmt.Errorf("db begin err: %w", err)
+	}
+	defer withTransaction.Rollback()
+
+	events, err := save(withTransaction, txList)
+	if err != nil {
+		return err
+	}
+
+	updated, err := applyUpdates(withTransaction, updates)
+	if err != nil {
+		return err
+	}
+	events = append(events, updated...)
+
+	for _, inv := range invalids {
+		if err = withTransaction.Save(inv); err != nil {
+			return fmt.Errorf("db save invalid precommit err: %w", err)
+		}
+	}
+
+	if err = withTransaction.Set("config", "number", number+1); err != nil {
+		return fmt.Errorf("db set checkpoint err: %w", err)
+	}
+
+	if err = withTransaction.Commit(); err != nil {
+		return err
+	}
+
+	s.publish(events)
+	return nil
+}
+
+// save inserts the new CrossTxs, the ones already stored are duplicates and skipped,
+// it returns the logged transitions to be published after the commit
+func save(withTransaction storm.Node, txList []*CrossTx) (events []*TransitionEvent, err error) {
 	for _, newTx := range txList {
 		var oldTx CrossTx
-		err = withTransaction.One(CrossIdIndex, newTx.CrossID, &oldTx)
+		if err = withTransaction.One(CrossIdIndex, newTx.CrossID, &oldTx); err != storm.ErrNotFound {
+			log.Warn("[Store] duplicate crossTx", "crossID", newTx.CrossID, "new.status", newTx.GetStatus(), "err", err)
+			continue
+		}
 
-		if err == storm.ErrNotFound {
-			log.Debug("[Store] save new cross tx", "crossID", newTx.CrossID, "status", newTx.GetStatus(), "blockNumber", newTx.BlockNumber)
-			if err = withTransaction.Save(newTx); err != nil {
-				return fmt.Errorf("db save err: %w", err)
-			}
-		} else if oldTx.IContract == nil {
-			log.Warn("[Store] parse old crossTx failed", "crossID", oldTx.CrossID)
-		} else if newTx.GetStatus() == contractlib.Finished {
-			log.Debug("[Store] receive Finished crossTx ", "crossID", newTx.CrossID, "txId", newTx.TxID)
-			// update old status, discard new
-			oldTx.UpdateStatus(contractlib.Completed)
-			if err = withTransaction.Update(&oldTx); err != nil {
-				return fmt.Errorf("db update err: %w", err)
-			}
-			log.Info("[Store] update Finished to Completed, cross chain transaction completed", "crossID", newTx.CrossID, "txId", newTx.TxID)
-		} else {
-			log.Warn("[Store] duplicate crossTx", "crossID", newTx.CrossID, "old.status", oldTx.GetStatus(), "new.status", newTx.GetStatus())
+		initCrossTx(newTx)
+		newTx.stamp()
+		if err = withTransaction.Save(newTx); err != nil {
+			return nil, fmt.Errorf("db save err: %w", err)
+		}
+
+		logged, err := logTransitions(withTransaction, newTx, 0)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, logged...)
+	}
+
+	return events, nil
+}
+
+// applyUpdates applies the updates of the events to the stored CrossTxs, an update of an unknown
+// CrossTx or rejected by its updater is skipped, it returns the logged transitions
+func applyUpdates(withTransaction storm.Node, updates []*CrossTxUpdate) (events []*TransitionEvent, err error) {
+	for _, u := range updates {
+		var oldTx CrossTx
+		if err = withTransaction.One(CrossIdIndex, u.CrossID, &oldTx); err != nil {
+			log.Warn("[Store] update of unknown crossTx", "crossID", u.CrossID, "txId", u.TxID, "blockNumber", u.BlockNumber, "err", err)
+			continue
+		}
+
+		n := len(oldTx.History)
+		if !updateCrossTx(&oldTx, u) {
 			continue
 		}
+
+		oldTx.stamp()
+		if err = withTransaction.Update(&oldTx); err != nil {
+			return nil, fmt.Errorf("db update err: %w", err)
+		}
+
+		logged, err := logTransitions(withTransaction, &oldTx, n)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, logged...)
 	}
 
-	return withTransaction.Commit()
+	return events, nil
+}
+
+// initCrossTx starts the history of a CrossTx saved for the first time
+func initCrossTx(newTx *CrossTx) {
+	log.Debug("[Store] save new cross tx", "crossID", newTx.CrossID, "status", newTx.GetStatus(), "blockNumber", newTx.BlockNumber)
+	if len(newTx.History) == 0 {
+		newTx.History = []StatusChange{{To: newTx.GetStatus(), Time: time.Now().UnixNano(), Reason: fmt.Sprintf("synced from block %d", newTx.BlockNumber)}}
+	}
+}
+
+// updateCrossTx runs the updater of the event on the stored CrossTx, it reports whether oldTx is changed
+func updateCrossTx(oldTx *CrossTx, u *CrossTxUpdate) bool {
+	if oldTx.IContract == nil {
+		log.Warn("[Store] parse old crossTx failed", "crossID", oldTx.CrossID)
+		return false
+	}
+
+	from := oldTx.GetStatus()
+	if err := u.Update(oldTx); err != nil {
+		log.Error("[Store] reject crossTx update", "crossID", u.CrossID, "txId", u.TxID, "err", err)
+		return false
+	}
+
+	log.Info("[Store] update crossTx", "crossID", u.CrossID, "txId", u.TxID, "from", from, "to", oldTx.GetStatus())
+	return true
 }
 
 func (s *Store) One(fieldName string, value interface{}) *CrossTx {
@@ -108,35 +439,67 @@ func (s *Store) One(fieldName string, value interface{}) *CrossTx {
 	return &to
 }
 
-func (s *Store) Updates(idList []string, updaters []func(c *CrossTx)) error {
+// Updates applies the updaters to the CrossTxs in one transaction,
+// a CrossTx whose updater returns an error, e.g. an illegal transition, is left unchanged
+func (s *Store) Updates(idList []string, updaters []func(c *CrossTx) error) error {
 	if len(idList) != len(updaters) {
 		return fmt.Errorf("invalid update params")
 	}
 
 	log.Debug("[Store] update list", "idList", idList)
 
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	withTransaction, err := s.db.Begin(true)
 	if err != nil {
 		return fmt.Errorf("db begin err: %w", err)
 	}
 	defer withTransaction.Rollback()
 
+	var events []*TransitionEvent
+	rejected := make(UpdateErrors)
 	for i, id := range idList {
 		var c CrossTx
-		if err = withTransaction.One(CrossIdIndex, id, &c); err != nil {
+		if err = withTransaction.One(CrossIdIndex, id, &c); err == storm.ErrNotFound {
+			return fmt.Errorf("db query err: crossID %s %w", id, ErrCrossTxNotFound)
+		}
+		if err != nil {
 			return fmt.Errorf("db query err: %w", err)
 		}
 
-		updaters[i](&c)
+		n := len(c.History)
 
-		if err = withTransaction.Update(&c); err != nil {
+		if err = updaters[i](&c); err != nil {
+			log.Error("[Store] reject update", "crossID", id, "err", err)
+			rejected[id] = err
+			continue
+		}
+
+		// Save instead of Update, storm Update skips the fields reset to zero value
+		c.stamp()
+		if err = withTransaction.Save(&c); err != nil {
 			return fmt.Errorf("db update err: %w", err)
 		}
+
+		logged, err := logTransitions(withTransaction, &c, n)
+		if err != nil {
+			return err
+		}
+		events = append(events, logged...)
 	}
 
-	log.Debug("[Store] update list", "successes", len(idList))
+	log.Debug("[Store] update list", "successes", len(idList)-len(rejected))
+
+	if err = withTransaction.Commit(); err != nil {
+		return err
+	}
 
-	return withTransaction.Commit()
+	s.publish(events)
+	if len(rejected) != 0 {
+		return rejected
+	}
+	return nil
 }
 
 func (s *Store) Query(pageSize int, startPage int, orderBy []FieldName, reverse bool, filter ...q.Matcher) (crossTxs []*CrossTx) {
@@ -144,6 +507,14 @@ func (s *Store) Query(pageSize int, startPage int, orderBy []FieldName, reverse
 		return nil
 	}
 
+	for _, field := range orderBy {
+		if field == TimestampField {
+			// storm can not order by the timestamp message, the found CrossTxs are sorted and paged here
+			_ = s.db.Select(filter...).Find(&crossTxs)
+			return pageCrossTxs(sortCrossTxs(crossTxs, orderBy, reverse), pageSize, startPage)
+		}
+	}
+
 	query := s.db.Select(filter...)
 	if len(orderBy) > 0 {
 		query.OrderBy(orderBy...)
@@ -158,3 +529,171 @@ func (s *Store) Query(pageSize int, startPage int, orderBy []FieldName, reverse
 
 	return crossTxs
 }
+
+// sortCrossTxs sorts the CrossTxs by the fields, then by PK, nil if a field can not be ordered by
+func sortCrossTxs(txs []*CrossTx, orderBy []FieldName, reverse bool) []*CrossTx {
+	for _, field := range orderBy {
+		switch field {
+		case PK, CrossIdIndex, "TxID", "BlockNumber", TimestampField:
+		default:
+			return nil
+		}
+	}
+
+	compare := func(a, b *CrossTx, field FieldName) int {
+		switch field {
+		case CrossIdIndex:
+			return strings.Compare(a.CrossID, b.CrossID)
+		case "TxID":
+			return strings.Compare(a.TxID, b.TxID)
+		case "BlockNumber":
+			return compareInt64(int64(a.BlockNumber), int64(b.BlockNumber))
+		case TimestampField:
+			var at, bt timestamp.Timestamp
+			if a.TimeStamp != nil {
+				at = *a.TimeStamp
+			}
+			if b.TimeStamp != nil {
+				bt = *b.TimeStamp
+			}
+			if c := compareInt64(at.Seconds, bt.Seconds); c != 0 {
+				return c
+			}
+			return compareInt64(int64(at.Nanos), int64(bt.Nanos))
+		default:
+			return compareInt64(a.PK, b.PK)
+		}
+	}
+
+	fields := append(append([]FieldName(nil), orderBy...), PK)
+	sort.SliceStable(txs, func(i, j int) bool {
+		for _, field := range fields {
+			if c := compare(txs[i], txs[j], field); c != 0 {
+				return (c < 0) != reverse
+			}
+		}
+		return false
+	})
+
+	return txs
+}
+
+func compareInt64(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// pageCrossTxs returns the page of the CrossTxs, all of them if the page size is not positive
+func pageCrossTxs(txs []*CrossTx, pageSize int, startPage int) []*CrossTx {
+	if pageSize <= 0 {
+		return txs
+	}
+
+	skip := pageSize * (startPage - 1)
+	if skip >= len(txs) {
+		return nil
+	}
+	if end := skip + pageSize; end < len(txs) {
+		return txs[skip:end]
+	}
+
+	return txs[skip:]
+}
+
+func (s *Store) SaveReceipt(r *ReceiptRecord) error {
+	return s.db.Save(r)
+}
+
+func (s *Store) GetReceipt(crossID string) *ReceiptRecord {
+	var r ReceiptRecord
+	if err := s.db.One(CrossIdIndex, crossID, &r); err != nil {
+		return nil
+	}
+
+	return &r
+}
+
+func (s *Store) QueryReceipts(filter ...q.Matcher) (receipts []*ReceiptRecord) {
+	_ = s.db.Select(filter...).Find(&receipts)
+	return receipts
+}
+
+func (s *Store) QueryInvalidPrecommits(filter ...q.Matcher) (invalids []*InvalidPrecommit) {
+	_ = s.db.Select(filter...).OrderBy("BlockNumber").Find(&invalids)
+	return invalids
+}
+
+func (s *Store) SaveAudit(r *AuditRecord) error {
+	return s.db.Save(r)
+}
+
+func (s *Store) QueryAudit(filter ...q.Matcher) (records []*AuditRecord) {
+	_ = s.db.Select(filter...).OrderBy("ID").Find(&records)
+	return records
+}
+
+// CountByStatus counts the stored CrossTxs once, then returns the counts kept by the committed transitions
+func (s *Store) CountByStatus() (map[contractlib.CStatus]int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.counts == nil {
+		counts := make(map[contractlib.CStatus]int)
+		err := s.db.Select().Each(new(CrossTx), func(record interface{}) error {
+			if c := record.(*CrossTx); c.IContract != nil {
+				counts[c.GetStatus()]++
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		s.counts = counts
+	}
+
+	counts := make(map[contractlib.CStatus]int, len(s.counts))
+	for status, n := range s.counts {
+		counts[status] = n
+	}
+
+	return counts, nil
+}
+
+// publish applies the committed transitions to the counts and publishes them, s.mu is held
+func (s *Store) publish(events []*TransitionEvent) {
+	if s.counts != nil {
+		for _, ev := range events {
+			// the first change of a CrossTx is from no status
+			if ev.From != 0 {
+				if s.counts[ev.From]--; s.counts[ev.From] <= 0 {
+					delete(s.counts, ev.From)
+				}
+			}
+			s.counts[ev.To]++
+		}
+	}
+
+	s.bus.Publish(events)
+}
+
+// QueryTransitions returns the logged events after the ID in order, at most limit if it is positive
+func (s *Store) QueryTransitions(afterID uint64, limit int, filter ...q.Matcher) (events []*TransitionEvent) {
+	query := s.db.Select(append(filter, q.Gt("ID", afterID))...).OrderBy("ID")
+	if limit > 0 {
+		query.Limit(limit)
+	}
+	_ = query.Find(&events)
+
+	return events
+}
+
+// Transitions returns the bus of the transition events committed by the store
+func (s *Store) Transitions() *TransitionBus {
+	return s.bus
+}
@@ -0,0 +1,386 @@
+package courier
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/icodezjb/fabric-study/courier/client"
+	"github.com/icodezjb/fabric-study/courier/contractlib"
+
+	"github.com/asdine/storm/v3/q"
+	"github.com/golang/protobuf/ptypes/timestamp"
+)
+
+// openTestBackend opens the backend of the kind in a temporary data directory
+func openTestBackend(t *testing.T, kind string) (Backend, func()) {
+	dir, err := ioutil.TempDir("", "courier")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backend, err := OpenBackend(kind, dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return backend, func() {
+		backend.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func newConformanceCrossTx(crossID string, status contractlib.CStatus, blockNumber uint64, seconds int64) *CrossTx {
+	tx := newTestCrossTx(crossID, status, "")
+	tx.BlockNumber = blockNumber
+	tx.TimeStamp = &timestamp.Timestamp{Seconds: seconds}
+	return tx
+}
+
+// newTransitionUpdate is the update of a synced event moving the CrossTx to the status
+func newTransitionUpdate(crossID string, to contractlib.CStatus, blockNumber uint64) *CrossTxUpdate {
+	return &CrossTxUpdate{
+		CrossID:     crossID,
+		TxID:        "tx-" + crossID,
+		BlockNumber: blockNumber,
+		Update: func(c *CrossTx) error {
+			return c.Transition(to, fmt.Sprintf("event of block %d", blockNumber))
+		},
+	}
+}
+
+func crossIDs(txs []*CrossTx) (ids []string) {
+	for _, tx := range txs {
+		ids = append(ids, tx.CrossID)
+	}
+	return ids
+}
+
+func equalIDs(got []string, want ...string) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// testDBConformance is the behavior every DB backend must have
+func testDBConformance(t *testing.T, kind string) {
+	backend, closeBackend := openTestBackend(t, kind)
+	defer closeBackend()
+
+	db, err := backend.Open("mychannel", "mycc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := backend.Open("mychannel", ""); err == nil {
+		t.Fatal("want error of the pipeline without chaincode")
+	}
+
+	live, unsubscribe := db.Transitions().Subscribe()
+	defer unsubscribe()
+
+	t.Run("config", func(t *testing.T) {
+		if got := db.Get("number"); got != 0 {
+			t.Fatalf("missing key, want: 0, got: %d", got)
+		}
+		if err := db.Set("number", 7); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Set("number", 1<<40); err != nil {
+			t.Fatal(err)
+		}
+		if got := db.Get("number"); got != 1<<40 {
+			t.Fatalf("number, want: %d, got: %d", uint64(1<<40), got)
+		}
+	})
+
+	t.Run("save", func(t *testing.T) {
+		a := newConformanceCrossTx("a", contractlib.Init, 1, 300)
+		if err := db.Save([]*CrossTx{
+			a,
+			newConformanceCrossTx("b", contractlib.Init, 2, 100),
+			newConformanceCrossTx("c", contractlib.Executed, 3, 200),
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if a.PK == 0 {
+			t.Fatal("want the PK of the saved CrossTx set")
+		}
+
+		// the duplicate is discarded, the updates complete c and abort b
+		if err := db.SaveBlock(4, []*CrossTx{newConformanceCrossTx("a", contractlib.Pending, 4, 400)}, []*CrossTxUpdate{
+			newTransitionUpdate("c", contractlib.Completed, 4),
+			newTransitionUpdate("b", contractlib.Aborted, 4),
+			newTransitionUpdate("x", contractlib.Aborted, 4),
+		}, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		for id, want := range map[string]contractlib.CStatus{"a": contractlib.Init, "b": contractlib.Aborted, "c": contractlib.Completed} {
+			tx := db.One(CrossIdIndex, id)
+			if tx == nil || tx.GetStatus() != want {
+				t.Fatalf("crossID %s, want status: %s, got: %+v", id, want, tx)
+			}
+		}
+
+		// the completion of an Init CrossTx is an illegal transition, the update is skipped
+		if err := db.SaveBlock(5, nil, []*CrossTxUpdate{newTransitionUpdate("a", contractlib.Completed, 5)}, nil); err != nil {
+			t.Fatal(err)
+		}
+		if db.One(CrossIdIndex, "x") != nil {
+			t.Fatal("want the update of an unknown CrossTx skipped")
+		}
+
+		c := db.One(CrossIdIndex, "c")
+		if c.BlockNumber != 3 || len(c.History) != 2 || c.History[1].From != contractlib.Executed || c.History[1].To != contractlib.Completed {
+			t.Fatalf("merged crossTx, got: %+v", c)
+		}
+		if got := db.One(CrossIdIndex, "a"); got.GetStatus() != contractlib.Init || got.History[0].Reason != "synced from block 1" {
+			t.Fatalf("crossID a, got: %+v", got)
+		}
+	})
+
+	t.Run("one", func(t *testing.T) {
+		a := db.One(CrossIdIndex, "a")
+		if got := db.One(PK, a.PK); got == nil || got.CrossID != "a" {
+			t.Fatalf("one by PK, got: %+v", got)
+		}
+		if got := db.One("TxID", "tx-b"); got == nil || got.CrossID != "b" {
+			t.Fatalf("one by TxID, got: %+v", got)
+		}
+		if got := db.One(CrossIdIndex, "missing"); got != nil {
+			t.Fatalf("one missing, got: %+v", got)
+		}
+	})
+
+	t.Run("updates", func(t *testing.T) {
+		toPending := func(c *CrossTx) error { return c.Transition(contractlib.Pending, "sent") }
+		reject := func(c *CrossTx) error {
+			c.Attempts = 99
+			return errors.New("rejected")
+		}
+
+		if err := db.Updates([]string{"a"}, nil); err == nil {
+			t.Fatal("want error of the updaters not matching the ids")
+		}
+
+		// the unknown CrossID fails the whole update
+		if err := db.Updates([]string{"a", "missing"}, []func(c *CrossTx) error{toPending, toPending}); !errors.Is(err, ErrCrossTxNotFound) {
+			t.Fatalf("want ErrCrossTxNotFound of the unknown CrossID, got: %v", err)
+		}
+		if got := db.One(CrossIdIndex, "a"); got.GetStatus() != contractlib.Init {
+			t.Fatalf("rolled back update, got: %s", got.GetStatus())
+		}
+
+		// the rejected update is returned, the others are committed
+		err := db.Updates([]string{"a", "c"}, []func(c *CrossTx) error{toPending, reject})
+		var rejected UpdateErrors
+		if !errors.As(err, &rejected) || len(rejected) != 1 || rejected["c"] == nil {
+			t.Fatalf("want the rejected update of c, got: %v", err)
+		}
+
+		a := db.One(CrossIdIndex, "a")
+		if a.GetStatus() != contractlib.Pending || len(a.History) != 2 || a.History[1].Reason != "sent" {
+			t.Fatalf("updated crossTx, got: %+v", a)
+		}
+		if got := db.One(CrossIdIndex, "c"); got.Attempts != 0 {
+			t.Fatalf("rejected update, want attempts: 0, got: %d", got.Attempts)
+		}
+
+		// the fields reset to the zero value are saved
+		setAttempts := func(n uint32) func(c *CrossTx) error {
+			return func(c *CrossTx) error { c.Attempts = n; return nil }
+		}
+		for _, n := range []uint32{3, 0} {
+			if err := db.Updates([]string{"a"}, []func(c *CrossTx) error{setAttempts(n)}); err != nil {
+				t.Fatal(err)
+			}
+			if got := db.One(CrossIdIndex, "a"); got.Attempts != n {
+				t.Fatalf("attempts, want: %d, got: %d", n, got.Attempts)
+			}
+		}
+	})
+
+	t.Run("query", func(t *testing.T) {
+		if err := db.Save([]*CrossTx{newConformanceCrossTx("d", contractlib.Init, 2, 50)}); err != nil {
+			t.Fatal(err)
+		}
+
+		cases := []struct {
+			name      string
+			pageSize  int
+			startPage int
+			orderBy   []FieldName
+			reverse   bool
+			filter    []q.Matcher
+			want      []string
+		}{
+			{name: "all by PK", want: []string{"a", "b", "c", "d"}},
+			{name: "reverse", reverse: true, want: []string{"d", "c", "b", "a"}},
+			{name: "by block number", orderBy: []FieldName{"BlockNumber"}, want: []string{"a", "b", "d", "c"}},
+			{name: "by timestamp", orderBy: []FieldName{TimestampField}, want: []string{"d", "b", "c", "a"}},
+			{name: "by timestamp reverse", orderBy: []FieldName{TimestampField}, reverse: true, want: []string{"a", "c", "b", "d"}},
+			{name: "page", pageSize: 2, startPage: 2, orderBy: []FieldName{TimestampField}, want: []string{"c", "a"}},
+			{name: "page past the end", pageSize: 2, startPage: 3, want: nil},
+			{name: "page zero", pageSize: 2, startPage: 0, want: nil},
+			{name: "status", filter: []q.Matcher{StatusIn(contractlib.Init, contractlib.Completed)}, want: []string{"c", "d"}},
+			{name: "field", filter: []q.Matcher{q.Eq("BlockNumber", uint64(2))}, want: []string{"b", "d"}},
+			{name: "filtered page", pageSize: 1, startPage: 2, filter: []q.Matcher{q.Gte("BlockNumber", uint64(2))}, want: []string{"c"}},
+			{name: "time", filter: []q.Matcher{TimeBetween(100, 250)}, orderBy: []FieldName{TimestampField}, want: []string{"b", "c"}},
+		}
+
+		for _, c := range cases {
+			got := crossIDs(db.Query(c.pageSize, c.startPage, c.orderBy, c.reverse, c.filter...))
+			if !equalIDs(got, c.want...) {
+				t.Fatalf("%s, want: %v, got: %v", c.name, c.want, got)
+			}
+		}
+	})
+
+	t.Run("save block", func(t *testing.T) {
+		inv := &InvalidPrecommit{ID: "tx-x/0", TxID: "tx-x", CrossID: "x", BlockNumber: 9, Reason: "MVCC_READ_CONFLICT"}
+		if err := db.SaveBlock(9, []*CrossTx{newConformanceCrossTx("e", contractlib.Init, 9, 900)}, nil, []*InvalidPrecommit{inv}); err != nil {
+			t.Fatal(err)
+		}
+
+		if got := db.Get("number"); got != 10 {
+			t.Fatalf("checkpoint, want: 10, got: %d", got)
+		}
+		if db.One(CrossIdIndex, "e") == nil {
+			t.Fatal("want the CrossTx of the block saved")
+		}
+
+		invalids := db.QueryInvalidPrecommits(q.Eq("CrossID", "x"))
+		if len(invalids) != 1 || invalids[0].TxID != "tx-x" || invalids[0].Reason != "MVCC_READ_CONFLICT" {
+			t.Fatalf("invalid precommits, got: %+v", invalids)
+		}
+		if got := db.QueryInvalidPrecommits(q.Eq("CrossID", "y")); len(got) != 0 {
+			t.Fatalf("invalid precommits of y, got: %+v", got)
+		}
+	})
+
+	t.Run("receipts", func(t *testing.T) {
+		if err := db.SaveReceipt(&ReceiptRecord{CrossID: "a", Sequence: 1, Receipt: "r1", Parked: true}); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.SaveReceipt(&ReceiptRecord{CrossID: "b", Sequence: 1, Receipt: "r2"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.SaveReceipt(&ReceiptRecord{CrossID: "a", Sequence: 2, Receipt: "r1", Parked: true}); err != nil {
+			t.Fatal(err)
+		}
+
+		if got := db.GetReceipt("a"); got == nil || got.Sequence != 2 {
+			t.Fatalf("receipt, got: %+v", got)
+		}
+		if got := db.GetReceipt("missing"); got != nil {
+			t.Fatalf("missing receipt, got: %+v", got)
+		}
+		if got := db.QueryReceipts(q.Eq("Parked", true)); len(got) != 1 || got[0].CrossID != "a" {
+			t.Fatalf("parked receipts, got: %+v", got)
+		}
+	})
+
+	t.Run("audit", func(t *testing.T) {
+		first := &AuditRecord{CrossID: "a", Action: AdminRequeue, Operator: "op"}
+		second := &AuditRecord{CrossID: "b", Action: AdminNote, Operator: "op"}
+		third := &AuditRecord{CrossID: "a", Action: AdminNote, Operator: "op"}
+		for _, r := range []*AuditRecord{first, second, third} {
+			if err := db.SaveAudit(r); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if first.ID == 0 || second.ID <= first.ID || third.ID <= second.ID {
+			t.Fatalf("audit ids, want increasing, got: %d %d %d", first.ID, second.ID, third.ID)
+		}
+
+		records := db.QueryAudit(q.Eq("CrossID", "a"))
+		if len(records) != 2 || records[0].ID != first.ID || records[1].Action != AdminNote {
+			t.Fatalf("audit of a, got: %+v", records)
+		}
+	})
+
+	t.Run("count", func(t *testing.T) {
+		counts, err := db.CountByStatus()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := map[contractlib.CStatus]int{contractlib.Pending: 1, contractlib.Aborted: 1, contractlib.Completed: 1, contractlib.Init: 2}
+		if len(counts) != len(want) {
+			t.Fatalf("counts, want: %v, got: %v", want, counts)
+		}
+		for status, n := range want {
+			if counts[status] != n {
+				t.Fatalf("count of %s, want: %d, got: %d", status, n, counts[status])
+			}
+		}
+	})
+
+	t.Run("transitions", func(t *testing.T) {
+		// a, b, c synced, c completed, b aborted, a pending, d and e synced
+		events := db.QueryTransitions(0, 0)
+		want := []struct {
+			crossID string
+			to      contractlib.CStatus
+		}{
+			{"a", contractlib.Init}, {"b", contractlib.Init}, {"c", contractlib.Executed},
+			{"c", contractlib.Completed}, {"b", contractlib.Aborted},
+			{"a", contractlib.Pending}, {"d", contractlib.Init}, {"e", contractlib.Init},
+		}
+		if len(events) != len(want) {
+			t.Fatalf("transitions, want: %d, got: %d", len(want), len(events))
+		}
+		for i, ev := range events {
+			if ev.CrossID != want[i].crossID || ev.To != want[i].to || (i > 0 && ev.ID <= events[i-1].ID) {
+				t.Fatalf("transition %d, want: %v, got: %+v", i, want[i], ev)
+			}
+		}
+
+		if got := db.QueryTransitions(events[2].ID, 2); len(got) != 2 || got[0].ID != events[3].ID || got[0].From != contractlib.Executed {
+			t.Fatalf("transitions after %d, got: %+v", events[2].ID, got)
+		}
+
+		filter := &transitionFilter{crossIDs: map[string]bool{"b": true}}
+		if got := db.QueryTransitions(0, 0, filter); len(got) != 2 || got[1].To != contractlib.Aborted {
+			t.Fatalf("transitions of b, got: %+v", got)
+		}
+
+		for i := range events {
+			select {
+			case ev := <-live:
+				if ev.ID != events[i].ID {
+					t.Fatalf("published transition %d, want id: %d, got: %d", i, events[i].ID, ev.ID)
+				}
+			default:
+				t.Fatalf("published transition %d missing", i)
+			}
+		}
+	})
+
+	t.Run("pipelines", func(t *testing.T) {
+		other, err := backend.Open("yourchannel", "mycc")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if other.Get("number") != 0 || other.One(CrossIdIndex, "a") != nil || len(other.Query(0, 0, nil, false)) != 0 {
+			t.Fatal("want the pipelines isolated")
+		}
+		if len(other.QueryTransitions(0, 0)) != 0 || len(other.QueryAudit()) != 0 || len(other.QueryReceipts()) != 0 {
+			t.Fatal("want the records of the pipelines isolated")
+		}
+	})
+}
+
+func TestStormConformance(t *testing.T) {
+	testDBConformance(t, client.StormDB)
+}
@@ -0,0 +1,327 @@
+package courier
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/icodezjb/fabric-study/courier/client"
+	"github.com/icodezjb/fabric-study/courier/contractlib"
+	"github.com/icodezjb/fabric-study/log"
+
+	"github.com/asdine/storm/v3/q"
+)
+
+// maxDumpLine is the longest JSON line of a dump
+const maxDumpLine = 16 * 1024 * 1024
+
+// dumpedKeys are the config keys of the pipelines in the dump, e.g. the "number" checkpoint of the BlockSync
+var dumpedKeys = map[string]struct{}{"number": {}}
+
+// DumpRecord is one JSON line of a dump, either a CrossTx or a config key of the pipeline
+type DumpRecord struct {
+	Pipeline string
+	CrossTx  *CrossTx `json:",omitempty"`
+	Key      string   `json:",omitempty"`
+	Value    uint64   `json:",omitempty"`
+}
+
+// DumpFilter selects the CrossTxs of the dump by their status and block range, zero selects all
+type DumpFilter struct {
+	Status    []contractlib.CStatus
+	FromBlock uint64
+	ToBlock   uint64
+}
+
+// ErrImportTarget refuses to import into a database which has data, unless forced
+var ErrImportTarget = errors.New("the database has data")
+
+// IsZero reports whether the filter selects all the CrossTxs, the config keys are only dumped and restored then,
+// the checkpoint of a partial dump would skip the blocks of the CrossTxs filtered out
+func (f DumpFilter) IsZero() bool {
+	return len(f.Status) == 0 && f.FromBlock == 0 && f.ToBlock == 0
+}
+
+// ParseDumpFilter parses the comma separated status and the block range
+func ParseDumpFilter(status string, fromBlock, toBlock uint64) (DumpFilter, error) {
+	f := DumpFilter{FromBlock: fromBlock, ToBlock: toBlock}
+
+	if status != "" {
+		for _, s := range strings.Split(status, ",") {
+			cs, err := contractlib.ParseCStatus(strings.TrimSpace(s))
+			if err != nil {
+				return f, err
+			}
+			f.Status = append(f.Status, cs)
+		}
+	}
+
+	if toBlock > 0 && fromBlock > toBlock {
+		return f, fmt.Errorf("from block %d is after to block %d", fromBlock, toBlock)
+	}
+
+	return f, nil
+}
+
+func (f DumpFilter) matchers() (filter []q.Matcher) {
+	if len(f.Status) > 0 {
+		filter = append(filter, StatusIn(f.Status...))
+	}
+	if f.FromBlock > 0 || f.ToBlock > 0 {
+		filter = append(filter, BlockBetween(f.FromBlock, f.ToBlock))
+	}
+
+	return filter
+}
+
+func (f DumpFilter) match(c *CrossTx) bool {
+	if f.FromBlock > 0 && c.BlockNumber < f.FromBlock || f.ToBlock > 0 && c.BlockNumber > f.ToBlock {
+		return false
+	}
+	if len(f.Status) == 0 {
+		return true
+	}
+
+	for _, s := range f.Status {
+		if c.GetStatus() == s {
+			return true
+		}
+	}
+	return false
+}
+
+// DumpResult counts the records of an export or an import
+type DumpResult struct {
+	CrossTxs int
+	Keys     int
+	// Skipped are the CrossTxs already in the database, only counted by the import
+	Skipped int
+}
+
+// Export writes the CrossTxs selected by the filter of every pipeline in the backend as JSON lines,
+// with the config keys if the filter selects all
+func Export(backend Backend, w io.Writer, filter DumpFilter) (*DumpResult, error) {
+	pipelines, err := backend.Pipelines()
+	if err != nil {
+		return nil, fmt.Errorf("list pipelines: %w", err)
+	}
+	sort.Slice(pipelines, func(i, j int) bool { return pipelines[i].ID() < pipelines[j].ID() })
+
+	result := &DumpResult{}
+	enc := json.NewEncoder(w)
+	for _, p := range pipelines {
+		db, err := backend.Open(p.ChannelID, p.ChainCodeID)
+		if err != nil {
+			return nil, fmt.Errorf("open pipeline %s: %w", p.ID(), err)
+		}
+
+		for _, key := range sortedKeys() {
+			value := db.Get(key)
+			if value == 0 || !filter.IsZero() {
+				continue
+			}
+			if err = enc.Encode(&DumpRecord{Pipeline: p.ID(), Key: key, Value: value}); err != nil {
+				return nil, err
+			}
+			result.Keys++
+		}
+
+		for _, c := range db.Query(0, 0, []FieldName{PK}, false, filter.matchers()...) {
+			if err = enc.Encode(&DumpRecord{Pipeline: p.ID(), CrossTx: c}); err != nil {
+				return nil, err
+			}
+			result.CrossTxs++
+		}
+
+		log.Info("[Dump] exported pipeline", "pipeline", p.ID())
+	}
+
+	return result, nil
+}
+
+func sortedKeys() []string {
+	keys := make([]string, 0, len(dumpedKeys))
+	for key := range dumpedKeys {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// pipelineDump is the records of a pipeline read from a dump
+type pipelineDump struct {
+	client.PipelineConfig
+	crossTxs []*CrossTx
+	keys     map[string]uint64
+}
+
+// Import restores the CrossTxs selected by the filter from the JSON lines of a dump, with the config keys
+// if the filter selects all, all the records are validated before any is written.
+// A database which has data is refused unless forced, then the CrossTxs already in it are skipped
+// and the keys are overwritten, so importing a dump again changes nothing
+func Import(backend Backend, r io.Reader, filter DumpFilter, force bool) (*DumpResult, error) {
+	dumps, err := readDump(r, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	if !force {
+		if err = checkEmpty(backend); err != nil {
+			return nil, err
+		}
+	}
+
+	result := &DumpResult{}
+	for _, d := range dumps {
+		db, err := backend.Open(d.ChannelID, d.ChainCodeID)
+		if err != nil {
+			return nil, fmt.Errorf("open pipeline %s: %w", d.ID(), err)
+		}
+
+		var txList []*CrossTx
+		for _, c := range d.crossTxs {
+			if db.One(CrossIdIndex, c.CrossID) != nil {
+				result.Skipped++
+				continue
+			}
+			// the primary key is assigned by the database
+			c.PK = 0
+			txList = append(txList, c)
+		}
+		if len(txList) > 0 {
+			if err = db.Save(txList); err != nil {
+				return nil, fmt.Errorf("pipeline %s: %w", d.ID(), err)
+			}
+		}
+		result.CrossTxs += len(txList)
+
+		for key, value := range d.keys {
+			if err = db.Set(key, value); err != nil {
+				return nil, fmt.Errorf("pipeline %s key %s: %w", d.ID(), key, err)
+			}
+			result.Keys++
+		}
+
+		log.Info("[Dump] imported pipeline", "pipeline", d.ID(), "crossTxs", len(txList))
+	}
+
+	return result, nil
+}
+
+// checkEmpty refuses the backend if any pipeline has a CrossTx or a config key
+func checkEmpty(backend Backend) error {
+	pipelines, err := backend.Pipelines()
+	if err != nil {
+		return fmt.Errorf("list pipelines: %w", err)
+	}
+
+	for _, p := range pipelines {
+		db, err := backend.Open(p.ChannelID, p.ChainCodeID)
+		if err != nil {
+			return fmt.Errorf("open pipeline %s: %w", p.ID(), err)
+		}
+
+		if len(db.Query(1, 1, nil, false)) != 0 {
+			return fmt.Errorf("pipeline %s has crossTxs: %w", p.ID(), ErrImportTarget)
+		}
+		for _, key := range sortedKeys() {
+			if db.Get(key) != 0 {
+				return fmt.Errorf("pipeline %s has key %s: %w", p.ID(), key, ErrImportTarget)
+			}
+		}
+	}
+
+	return nil
+}
+
+// readDump reads and validates all the records of the dump, grouped by pipeline in the order they appear
+func readDump(r io.Reader, filter DumpFilter) ([]*pipelineDump, error) {
+	var dumps []*pipelineDump
+	byID := make(map[string]*pipelineDump)
+	seen := make(map[string]int)
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxDumpLine)
+	for line := 1; scanner.Scan(); line++ {
+		raw := strings.TrimSpace(scanner.Text())
+		if raw == "" {
+			continue
+		}
+
+		var record DumpRecord
+		if err := json.Unmarshal([]byte(raw), &record); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		if err := validateRecord(&record); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		d, ok := byID[record.Pipeline]
+		if !ok {
+			p, _ := client.ParsePipelineID(record.Pipeline)
+			d = &pipelineDump{PipelineConfig: p, keys: make(map[string]uint64)}
+			byID[record.Pipeline] = d
+			dumps = append(dumps, d)
+		}
+
+		if record.CrossTx == nil {
+			if filter.IsZero() {
+				d.keys[record.Key] = record.Value
+			}
+			continue
+		}
+
+		id := record.Pipeline + "/" + record.CrossTx.CrossID
+		if prev, ok := seen[id]; ok {
+			return nil, fmt.Errorf("line %d: duplicate crossTx %s of line %d", line, record.CrossTx.CrossID, prev)
+		}
+		seen[id] = line
+
+		if filter.match(record.CrossTx) {
+			d.crossTxs = append(d.crossTxs, record.CrossTx)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read dump: %w", err)
+	}
+
+	return dumps, nil
+}
+
+// validateRecord checks the record is a known config key or a stored precommit CrossTx of a pipeline,
+// the CrossTx record itself is validated by its decoding
+func validateRecord(record *DumpRecord) error {
+	if _, err := client.ParsePipelineID(record.Pipeline); err != nil {
+		return err
+	}
+
+	c := record.CrossTx
+	switch {
+	case c == nil && record.Key == "":
+		return errors.New("record has neither CrossTx nor Key")
+	case c != nil && record.Key != "":
+		return errors.New("record has both CrossTx and Key")
+	case c == nil:
+		if _, ok := dumpedKeys[record.Key]; !ok {
+			return fmt.Errorf("unknown key %q", record.Key)
+		}
+		return nil
+	}
+
+	if c.GetContractID() != c.CrossID {
+		return fmt.Errorf("crossTx %s has contract %s", c.CrossID, c.GetContractID())
+	}
+	if typ := contractlib.TypeOf(c.IContract); typ != contractlib.PrecommitType {
+		return fmt.Errorf("crossTx %s has %s contract, expecting %s", c.CrossID, typ, contractlib.PrecommitType)
+	}
+	if c.GetStatus() == contractlib.Finished {
+		return fmt.Errorf("crossTx %s has status %s, it is never stored", c.CrossID, c.GetStatus())
+	}
+
+	return nil
+}
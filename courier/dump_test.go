@@ -0,0 +1,153 @@
+package courier
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/icodezjb/fabric-study/courier/client"
+	"github.com/icodezjb/fabric-study/courier/contractlib"
+)
+
+func TestExportImport(t *testing.T) {
+	src, closeSrc := openTestBackend(t, client.StormDB)
+	defer closeSrc()
+
+	for _, p := range []string{"mycc", "yourcc"} {
+		db, err := src.Open("mychannel", p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = db.SaveBlock(7, []*CrossTx{
+			newConformanceCrossTx(p+"-a", contractlib.Init, 3, 100),
+			newConformanceCrossTx(p+"-b", contractlib.Pending, 5, 200),
+		}, nil, nil); err != nil {
+			t.Fatal(err)
+		}
+		if err = db.Updates([]string{p + "-b"}, []func(c *CrossTx) error{func(c *CrossTx) error {
+			return c.Transition(contractlib.Executed, "receipt")
+		}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var dump bytes.Buffer
+	exported, err := Export(src, &dump, DumpFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exported.CrossTxs != 4 || exported.Keys != 2 {
+		t.Fatalf("exported, got: %+v", exported)
+	}
+
+	for _, kind := range []string{client.StormDB, client.SQLiteDB} {
+		dst, closeDst := openTestBackend(t, kind)
+
+		imported, err := Import(dst, bytes.NewReader(dump.Bytes()), DumpFilter{}, false)
+		if err != nil {
+			t.Fatalf("%s import: %v", kind, err)
+		}
+		if imported.CrossTxs != 4 || imported.Keys != 2 || imported.Skipped != 0 {
+			t.Fatalf("%s imported, got: %+v", kind, imported)
+		}
+
+		// the database has data now, importing again is refused unless forced, then it changes nothing
+		if _, err := Import(dst, bytes.NewReader(dump.Bytes()), DumpFilter{}, false); !errors.Is(err, ErrImportTarget) {
+			t.Fatalf("%s imported again, want ErrImportTarget, got: %v", kind, err)
+		}
+		again, err := Import(dst, bytes.NewReader(dump.Bytes()), DumpFilter{}, true)
+		if err != nil || again.CrossTxs != 0 || again.Skipped != 4 {
+			t.Fatalf("%s imported again, got: %+v %v", kind, again, err)
+		}
+
+		db, err := dst.Open("mychannel", "yourcc")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := db.Get("number"); n != 8 {
+			t.Fatalf("%s checkpoint, want: 8, got: %d", kind, n)
+		}
+		if txs := db.Query(0, 0, nil, false); len(txs) != 2 {
+			t.Fatalf("%s crossTxs, want: 2, got: %d", kind, len(txs))
+		}
+		b := db.One(CrossIdIndex, "yourcc-b")
+		if b == nil || b.GetStatus() != contractlib.Executed || b.BlockNumber != 5 || len(b.History) != 2 {
+			t.Fatalf("%s crossTx yourcc-b, got: %+v", kind, b)
+		}
+		if events := db.QueryTransitions(0, 0); len(events) != 3 {
+			t.Fatalf("%s transitions, want: 3, got: %d", kind, len(events))
+		}
+
+		closeDst()
+	}
+
+	// the filters select the CrossTxs, the checkpoints of a partial dump are neither exported nor restored
+	filter, err := ParseDumpFilter("Executed", 4, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var filtered bytes.Buffer
+	if result, err := Export(src, &filtered, filter); err != nil || result.CrossTxs != 2 || result.Keys != 0 {
+		t.Fatalf("filtered export, got: %+v %v", result, err)
+	}
+
+	dst, closeDst := openTestBackend(t, client.StormDB)
+	defer closeDst()
+
+	filter, _ = ParseDumpFilter("", 0, 4)
+	if result, err := Import(dst, bytes.NewReader(dump.Bytes()), filter, false); err != nil || result.CrossTxs != 2 || result.Keys != 0 {
+		t.Fatalf("filtered import, got: %+v %v", result, err)
+	}
+	db, _ := dst.Open("mychannel", "mycc")
+	if db.One(CrossIdIndex, "mycc-a") == nil || db.One(CrossIdIndex, "mycc-b") != nil {
+		t.Fatalf("filtered import, got: %v", crossIDs(db.Query(0, 0, nil, false)))
+	}
+	if n := db.Get("number"); n != 0 {
+		t.Fatalf("filtered import, want no checkpoint, got: %d", n)
+	}
+}
+
+func TestImportValidation(t *testing.T) {
+	valid := `{"Pipeline":"mychannel/mycc","Key":"number","Value":3}
+{"Pipeline":"mychannel/mycc","CrossTx":{"CrossID":"a","IContract":{"status":"Init","contract_id":"a"}}}
+`
+	cases := []struct {
+		name   string
+		record string
+		err    string
+	}{
+		{name: "not json", record: `{`, err: "line 3"},
+		{name: "bad pipeline", record: `{"Pipeline":"mycc","Key":"number","Value":1}`, err: "invalid pipeline"},
+		{name: "empty", record: `{"Pipeline":"mychannel/mycc"}`, err: "neither"},
+		{name: "both", record: `{"Pipeline":"mychannel/mycc","Key":"number","CrossTx":{"CrossID":"b","IContract":{"status":"Init","contract_id":"b"}}}`, err: "both"},
+		{name: "unknown key", record: `{"Pipeline":"mychannel/mycc","Key":"health","Value":1}`, err: "unknown key"},
+		{name: "no contract", record: `{"Pipeline":"mychannel/mycc","CrossTx":{"CrossID":"b"}}`, err: "missing field IContract"},
+		{name: "other contract", record: `{"Pipeline":"mychannel/mycc","CrossTx":{"CrossID":"b","IContract":{"status":"Init","contract_id":"c"}}}`, err: "has contract c"},
+		{name: "commit", record: `{"Pipeline":"mychannel/mycc","CrossTx":{"CrossID":"b","IContract":{"status":"Finished","contract_id":"b"}}}`, err: "commit contract"},
+		{name: "duplicate", record: `{"Pipeline":"mychannel/mycc","CrossTx":{"CrossID":"a","IContract":{"status":"Init","contract_id":"a"}}}`, err: "duplicate crossTx a of line 2"},
+	}
+
+	for _, c := range cases {
+		backend, closeBackend := openTestBackend(t, client.SQLiteDB)
+
+		_, err := Import(backend, strings.NewReader(valid+c.record), DumpFilter{}, false)
+		if err == nil || !strings.Contains(err.Error(), "line 3") || !strings.Contains(err.Error(), c.err) {
+			t.Fatalf("%s, want error: %s, got: %v", c.name, c.err, err)
+		}
+
+		// nothing is written when any record is invalid
+		if pipelines, err := backend.Pipelines(); err != nil || len(pipelines) != 0 {
+			t.Fatalf("%s, pipelines written: %v %v", c.name, pipelines, err)
+		}
+
+		closeBackend()
+	}
+
+	if _, err := ParseDumpFilter("Nope", 0, 0); err == nil {
+		t.Fatal("want invalid status error")
+	}
+	if _, err := ParseDumpFilter("", 9, 3); err == nil {
+		t.Fatal("want invalid block range error")
+	}
+}
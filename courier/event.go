@@ -0,0 +1,158 @@
+package courier
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/icodezjb/fabric-study/courier/contractlib"
+
+	"github.com/golang/protobuf/ptypes/timestamp"
+)
+
+// EventHandler turns a chaincode event into the changes saved with its block,
+// the new CrossTxs are inserted and the updates are applied to the stored CrossTxs by DB.SaveBlock
+type EventHandler struct {
+	// Decode parses the event payload
+	Decode func(preTx *PrepareCrossTx) (interface{}, error)
+	// Handle produces the new CrossTxs and the updates of the known ones of the decoded event
+	Handle func(preTx *PrepareCrossTx, event interface{}) ([]*CrossTx, []*CrossTxUpdate, error)
+	// RecordInvalid records the txs of the event invalidated by the committing peers as InvalidPrecommit,
+	// the invalidated txs of the other events are dropped
+	RecordInvalid bool
+}
+
+// CrossTxUpdate is the change of a stored CrossTx made by an event, e.g. the commit event completes it
+type CrossTxUpdate struct {
+	CrossID     string
+	TxID        string
+	BlockNumber uint64
+	TimeStamp   *timestamp.Timestamp
+	// Update changes the stored CrossTx, an error rejects the update and the CrossTx is left unchanged
+	Update func(c *CrossTx) error
+}
+
+var (
+	handlersMu    sync.RWMutex
+	eventHandlers = make(map[string]EventHandler)
+)
+
+// RegisterEventHandler registers the handler of the event name, it panics if the name is registered twice,
+// it is meant to be called in init functions
+func RegisterEventHandler(eventName string, h EventHandler) {
+	handlersMu.Lock()
+	defer handlersMu.Unlock()
+
+	if h.Decode == nil || h.Handle == nil {
+		panic(fmt.Sprintf("courier: incomplete handler of event %s", eventName))
+	}
+
+	if _, ok := eventHandlers[eventName]; ok {
+		panic(fmt.Sprintf("courier: event %s registered twice", eventName))
+	}
+
+	eventHandlers[eventName] = h
+}
+
+func lookupEventHandler(eventName string) (EventHandler, bool) {
+	handlersMu.RLock()
+	defer handlersMu.RUnlock()
+
+	h, ok := eventHandlers[eventName]
+	return h, ok
+}
+
+// EventNames returns the registered event names in order
+func EventNames() []string {
+	handlersMu.RLock()
+	defer handlersMu.RUnlock()
+
+	names := make([]string, 0, len(eventHandlers))
+	for name := range eventHandlers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// ValidateEvents checks the filter events are registered
+func ValidateEvents(events []string) error {
+	for _, ev := range events {
+		if _, ok := lookupEventHandler(ev); !ok {
+			return fmt.Errorf("unsupported event %q, supported: %s", ev, strings.Join(EventNames(), ","))
+		}
+	}
+
+	return nil
+}
+
+func decodeContract(preTx *PrepareCrossTx) (interface{}, error) {
+	var c contractlib.Contract
+	if err := json.Unmarshal(preTx.Payload, &c); err != nil {
+		return nil, fmt.Errorf("parse %s contract of tx %s err: %w", preTx.EventName, preTx.TxID, err)
+	}
+
+	return c, nil
+}
+
+func eventContract(preTx *PrepareCrossTx, event interface{}) (contractlib.Contract, error) {
+	c, ok := event.(contractlib.Contract)
+	if !ok {
+		return c, fmt.Errorf("%s event of tx %s is %T, not a contract", preTx.EventName, preTx.TxID, event)
+	}
+
+	return c, nil
+}
+
+// precommitHandler inserts the CrossTx of the precommit contract
+var precommitHandler = EventHandler{
+	Decode:        decodeContract,
+	RecordInvalid: true,
+	Handle: func(preTx *PrepareCrossTx, event interface{}) ([]*CrossTx, []*CrossTxUpdate, error) {
+		c, err := eventContract(preTx, event)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return []*CrossTx{{
+			Contract:    c,
+			TxID:        preTx.TxID,
+			BlockNumber: preTx.BlockNumber,
+			TimeStamp:   preTx.TimeStamp,
+			CrossID:     c.GetContractID(),
+		}}, nil, nil
+	},
+}
+
+// transitionHandler moves the stored CrossTx of the contract to the status, e.g. the commit event completes it
+func transitionHandler(to contractlib.CStatus) EventHandler {
+	return EventHandler{
+		Decode: decodeContract,
+		Handle: func(preTx *PrepareCrossTx, event interface{}) ([]*CrossTx, []*CrossTxUpdate, error) {
+			c, err := eventContract(preTx, event)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			reason := fmt.Sprintf("%s event, txId %s, block %d", preTx.EventName, preTx.TxID, preTx.BlockNumber)
+			return nil, []*CrossTxUpdate{{
+				CrossID:     c.GetContractID(),
+				TxID:        preTx.TxID,
+				BlockNumber: preTx.BlockNumber,
+				TimeStamp:   preTx.TimeStamp,
+				Update: func(stored *CrossTx) error {
+					return stored.Transition(to, reason)
+				},
+			}}, nil
+		},
+	}
+}
+
+func init() {
+	RegisterEventHandler("precommit", precommitHandler)
+	RegisterEventHandler("commit", transitionHandler(contractlib.Completed))
+	RegisterEventHandler("abort", transitionHandler(contractlib.Aborted))
+}
@@ -0,0 +1,119 @@
+package courier
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/icodezjb/fabric-study/courier/client"
+	"github.com/icodezjb/fabric-study/courier/contractlib"
+
+	"github.com/hyperledger/fabric-protos-go/peer"
+)
+
+// cancelFabricClient filters the cancel events besides the contract ones
+type cancelFabricClient struct {
+	MockFabricClient
+}
+
+func (c *cancelFabricClient) FilterEvents() []string {
+	return []string{"precommit", "commit", "cancel"}
+}
+
+func TestEventHandlerRegistry(t *testing.T) {
+	if err := ValidateEvents([]string{"precommit", "commit", "abort"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ValidateEvents([]string{"precommit", "cancel"}); err == nil {
+		t.Fatal("want error of the unregistered cancel event")
+	}
+
+	// cancel carries the CrossID only, it aborts the CrossTx
+	RegisterEventHandler("cancel", EventHandler{
+		RecordInvalid: true,
+		Decode: func(preTx *PrepareCrossTx) (interface{}, error) {
+			return string(preTx.Payload), nil
+		},
+		Handle: func(preTx *PrepareCrossTx, event interface{}) ([]*CrossTx, []*CrossTxUpdate, error) {
+			return nil, []*CrossTxUpdate{{
+				CrossID:     event.(string),
+				TxID:        preTx.TxID,
+				BlockNumber: preTx.BlockNumber,
+				Update: func(c *CrossTx) error {
+					return c.Transition(contractlib.Aborted, "cancelled by "+preTx.TxID)
+				},
+			}}, nil
+		},
+	})
+	defer func() {
+		handlersMu.Lock()
+		delete(eventHandlers, "cancel")
+		handlersMu.Unlock()
+	}()
+
+	if err := ValidateEvents([]string{"precommit", "cancel"}); err != nil {
+		t.Fatal(err)
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("want panic of the event registered twice")
+			}
+		}()
+		RegisterEventHandler("precommit", precommitHandler)
+	}()
+
+	blksync := NewBlockSync(&client.Config{}, &cancelFabricClient{}, &TxManager{DB: &MockDB{db: map[string]uint64{}}})
+
+	precommit := newTestCrossTx("a", contractlib.Init, "")
+	payload, err := json.Marshal(precommit.Contract)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	crossTxs, updates, _, err := blksync.toCrossTxs([]*PrepareCrossTx{
+		{TxID: "tx-1", BlockNumber: 3, EventName: "precommit", Payload: payload},
+		{TxID: "tx-2", BlockNumber: 3, EventName: "cancel", Payload: []byte("a")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(crossTxs) != 1 || len(updates) != 1 {
+		t.Fatalf("want 1 CrossTx and 1 update, got: %d %d", len(crossTxs), len(updates))
+	}
+
+	// the update applies to the CrossTx inserted by the same block
+	store, closeStore := newTestStore(t)
+	defer closeStore()
+
+	if err = store.SaveBlock(3, crossTxs, updates, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	a := store.One(CrossIdIndex, "a")
+	if a == nil || len(a.History) != 2 {
+		t.Fatalf("crossID a, got: %+v", a)
+	}
+	if got := fmt.Sprintf("%s %s %s", a.TxID, a.GetStatus(), a.History[1].Reason); got != "tx-1 Aborted cancelled by tx-2" {
+		t.Fatalf("crossID a, want: tx-1 Aborted cancelled by tx-2, got: %s", got)
+	}
+
+	// the invalidated cancel is recorded as the handler asks, the invalidated commit is dropped
+	_, _, invalids, err := blksync.toCrossTxs([]*PrepareCrossTx{
+		{TxID: "tx-4", EventName: "cancel", Payload: []byte("a"), ValidationCode: peer.TxValidationCode_MVCC_READ_CONFLICT},
+		{TxID: "tx-5", EventName: "commit", Payload: payload, ValidationCode: peer.TxValidationCode_MVCC_READ_CONFLICT},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(invalids) != 1 || invalids[0].TxID != "tx-4" {
+		t.Fatalf("invalids, want: tx-4 only, got: %+v", invalids)
+	}
+
+	if _, _, _, err := blksync.toCrossTxs([]*PrepareCrossTx{{TxID: "tx-3", EventName: "abort", Payload: payload}}); err == nil {
+		t.Fatal("want error of the event not filtered by the pipeline")
+	}
+}
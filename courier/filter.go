@@ -16,16 +16,23 @@ import (
 // transactionActions aliasing for peer.TransactionAction pointers slice
 type transactionActions []*peer.TransactionAction
 
-func (ta transactionActions) toFilteredActions() (*peer.FilteredTransaction_TransactionActions, error) {
-	transactionActions := &peer.FilteredTransactionActions{}
-	for _, action := range ta {
+// actionEvent is the chaincode event of the action at Index of a transaction
+type actionEvent struct {
+	Index int
+	Event *peer.ChaincodeEvent
+}
+
+// chaincodeEvents returns the chaincode events of all the actions, the actions without event are skipped
+func (ta transactionActions) chaincodeEvents() ([]actionEvent, error) {
+	var events []actionEvent
+	for i, action := range ta {
 		chaincodeActionPayload, err := utils.GetChaincodeActionPayload(action.Payload)
 		if err != nil {
 			return nil, fmt.Errorf("error unmarshal transaction action payload for block event: %w", err)
 		}
 
 		if chaincodeActionPayload.Action == nil {
-			log.Debug("[Filter] chaincode action, the payload action is nil, skipping")
+			log.Debug("[Filter] chaincode action, the payload action is nil, skipping", "action", i)
 			continue
 		}
 		propRespPayload, err := utils.GetProposalResponsePayload(chaincodeActionPayload.Action.ProposalResponsePayload)
@@ -44,20 +51,11 @@ func (ta transactionActions) toFilteredActions() (*peer.FilteredTransaction_Tran
 		}
 
 		if ccEvent.GetChaincodeId() != "" {
-			filteredAction := &peer.FilteredChaincodeAction{
-				ChaincodeEvent: &peer.ChaincodeEvent{
-					TxId:        ccEvent.TxId,
-					ChaincodeId: ccEvent.ChaincodeId,
-					EventName:   ccEvent.EventName,
-					Payload:     ccEvent.Payload,
-				},
-			}
-			transactionActions.ChaincodeActions = append(transactionActions.ChaincodeActions, filteredAction)
+			events = append(events, actionEvent{Index: i, Event: ccEvent})
 		}
 	}
-	return &peer.FilteredTransaction_TransactionActions{
-		TransactionActions: transactionActions,
-	}, nil
+
+	return events, nil
 }
 
 type PrepareCrossTx struct {
@@ -69,31 +67,54 @@ type PrepareCrossTx struct {
 	//Block->Data->Data(Envelope[x])->Payload->Header->ChannelHeader->Timestamp
 	TimeStamp *timestamp.Timestamp
 
-	// hyperledger fabric version 1
-	// only supports a single action per transaction
-	// Block->Data->Data(Envelope[x])->Payload->Data->Transaction->Action[0]->ChainCodeAction[0]->ChaincodeEvent->EventName
+	// the index x of Block->Data->Data(Envelope[y])->Payload->Data->Transaction->Action[x]
+	ActionIndex int
+	// Block->Data->Data(Envelope[y])->Payload->Data->Transaction->Action[x]->ChainCodeAction->ChaincodeEvent->ChaincodeId
+	ChaincodeID string
+	// Block->Data->Data(Envelope[y])->Payload->Data->Transaction->Action[x]->ChainCodeAction->ChaincodeEvent->EventName
 	EventName string
-	// Block->Data->Data(Envelope[x])->Payload->Data->Transaction->Action[0]->ChainCodeAction[0]->ChaincodeEvent->Payload
+	// Block->Data->Data(Envelope[y])->Payload->Data->Transaction->Action[x]->ChainCodeAction->ChaincodeEvent->Payload
 	Payload []byte
+
+	// Block->Metadata->Metadata[TRANSACTIONS_FILTER][y], only the txs collected by GetAllPrepareCrossTxs may be invalid
+	ValidationCode peer.TxValidationCode
 }
 
 func (t *PrepareCrossTx) String() string {
 	ts := time.Unix(t.TimeStamp.Seconds, int64(t.TimeStamp.Nanos))
-	return fmt.Sprintf("TxID = %s\nNumber = %d\nTimeStamp = %s\nEventName = %s\nPayload = %v",
-		t.TxID, t.BlockNumber, ts, t.EventName, string(t.Payload))
+	return fmt.Sprintf("TxID = %s\nNumber = %d\nTimeStamp = %s\nActionIndex = %d\nChaincodeID = %s\nEventName = %s\nPayload = %v",
+		t.TxID, t.BlockNumber, ts, t.ActionIndex, t.ChaincodeID, t.EventName, string(t.Payload))
+}
+
+// GetPrepareCrossTxs collects the chaincode events of all the actions of the valid ENDORSER_TRANSACTIONs,
+// filtered by the chaincode ID and event name pair
+func GetPrepareCrossTxs(block *common.Block, filterFunc func(chaincodeID, eventName string) bool) ([]*PrepareCrossTx, error) {
+	return getPrepareCrossTxs(block, filterFunc, false)
+}
+
+// GetAllPrepareCrossTxs collects the chaincode events of the invalidated ENDORSER_TRANSACTIONs too,
+// their PrepareCrossTx has the validation code set
+func GetAllPrepareCrossTxs(block *common.Block, filterFunc func(chaincodeID, eventName string) bool) ([]*PrepareCrossTx, error) {
+	return getPrepareCrossTxs(block, filterFunc, true)
 }
 
-// GetPrepareCrossTxs to collect ENDORSER_TRANSACTION and with event tx, if withEvent set true
-func GetPrepareCrossTxs(block *common.Block, filterFunc func(string) bool) (preCrossTxs []*PrepareCrossTx, err error) {
+func getPrepareCrossTxs(block *common.Block, filterFunc func(chaincodeID, eventName string) bool, withInvalid bool) (preCrossTxs []*PrepareCrossTx, err error) {
 	txsFltr := utils.TxValidationFlags(block.Metadata.Metadata[common.BlockMetadataIndex_TRANSACTIONS_FILTER])
 	blockNum := block.Header.Number
 
 	for txIndex, ebytes := range block.Data.Data {
-		if txsFltr.Flag(txIndex) != peer.TxValidationCode_VALID {
+		code := txsFltr.Flag(txIndex)
+		if code != peer.TxValidationCode_VALID && !withInvalid {
 			continue
 		}
 
+		// an invalidated tx may be malformed, e.g. BAD_PAYLOAD or NIL_ENVELOPE, only a valid one fails the block
 		headerData, payloadData, err := ParseEnvelopePayload(txIndex, ebytes)
+		if err != nil && code != peer.TxValidationCode_VALID {
+			log.Debug("[Filter] skip invalid tx", "blockNumber", blockNum, "txIndex", txIndex, "code", code, "err", err)
+			continue
+		}
+
 		if err != nil {
 			return nil, err
 		}
@@ -103,12 +124,8 @@ func GetPrepareCrossTxs(block *common.Block, filterFunc func(string) bool) (preC
 			continue
 		}
 
-		eventName, eventPayload, err := getTxEvents(payloadData)
-		if err != nil && strings.Contains(err.Error(), "no chaincode event") {
-			continue
-		}
-
-		if !filterFunc(eventName) {
+		if err != nil && code != peer.TxValidationCode_VALID {
+			log.Debug("[Filter] skip invalid tx", "blockNumber", blockNum, "txIndex", txIndex, "code", code, "err", err)
 			continue
 		}
 
@@ -116,15 +133,31 @@ func GetPrepareCrossTxs(block *common.Block, filterFunc func(string) bool) (preC
 			return nil, err
 		}
 
-		preCrossTx := &PrepareCrossTx{
-			BlockNumber: blockNum,
-			TxID:        chdr.TxId,
-			TimeStamp:   chdr.Timestamp,
-			EventName:   eventName,
-			Payload:     eventPayload,
+		events, err := getTxEvents(payloadData)
+		if err != nil {
+			log.Debug("[Filter] skip tx", "blockNumber", blockNum, "txIndex", txIndex, "err", err)
+			continue
 		}
 
-		preCrossTxs = append(preCrossTxs, preCrossTx)
+		for _, ev := range events {
+			if !filterFunc(ev.Event.ChaincodeId, ev.Event.EventName) {
+				continue
+			}
+
+			preCrossTx := &PrepareCrossTx{
+				BlockNumber: blockNum,
+				TxID:        chdr.TxId,
+				TimeStamp:   chdr.Timestamp,
+				ActionIndex: ev.Index,
+				ChaincodeID: ev.Event.ChaincodeId,
+				EventName:   ev.Event.EventName,
+				Payload:     ev.Event.Payload,
+
+				ValidationCode: code,
+			}
+
+			preCrossTxs = append(preCrossTxs, preCrossTx)
+		}
 	}
 
 	if len(preCrossTxs) == 0 {
@@ -169,23 +202,20 @@ func getChannelHeader(channelHeader []byte) (*common.ChannelHeader, error) {
 	return chdr, nil
 }
 
-func getTxEvents(payload []byte) (string, []byte, error) {
+func getTxEvents(payload []byte) ([]actionEvent, error) {
 	tx, err := utils.GetTransaction(payload)
 	if err != nil {
-		return "", nil, fmt.Errorf("error unmarshal transaction payload for block event: %w", err)
+		return nil, fmt.Errorf("error unmarshal transaction payload for block event: %w", err)
 	}
 
-	actionsData, err := transactionActions(tx.Actions).toFilteredActions()
+	events, err := transactionActions(tx.Actions).chaincodeEvents()
 	if err != nil {
-		return "", nil, err
+		return nil, err
 	}
 
-	// hyperledger fabric version 1
-	// only supports a single action per transaction
-	if actionsData.TransactionActions.ChaincodeActions != nil {
-		ccEvent := actionsData.TransactionActions.ChaincodeActions[0].ChaincodeEvent
-		return ccEvent.EventName, ccEvent.Payload, nil
+	if len(events) == 0 {
+		return nil, fmt.Errorf("no chaincode event")
 	}
 
-	return "", nil, fmt.Errorf("no chaincode event")
+	return events, nil
 }
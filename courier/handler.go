@@ -1,114 +1,589 @@
 package courier
 
 import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
-	"strconv"
+	"strings"
 	"sync"
 
 	"github.com/icodezjb/fabric-study/courier/client"
+	"github.com/icodezjb/fabric-study/courier/contractlib"
+	"github.com/icodezjb/fabric-study/courier/metrics"
 	"github.com/icodezjb/fabric-study/log"
-
-	"github.com/asdine/storm/v3"
 )
 
+// maxReceiptBatch bounds the number of the receipts posted in one request
+const maxReceiptBatch = 1000
+
+// codeStreamed is returned by the handlers which wrote the response, e.g. a stream of events
+const codeStreamed = 0
+
+// errStopping rejects the receipts received while courier stops
+var errStopping = errors.New("courier stopping")
+
+// unauthenticatedPaths are served without the client certificate, for the probes and the scrapers
+var unauthenticatedPaths = map[string]bool{"/healthz": true, "/readyz": true, "/metrics": true}
+
 type Handler struct {
-	blkSync *BlockSync
-	rootDB  *storm.DB
-	txm     *TxManager
-	server  *Server
+	pipelines []*Pipeline
+	backend   Backend
+	server    *Server
+
+	// adminToken is the bearer token of the admin API, empty disables it
+	adminToken string
+	// receiptSecrets are the HMAC secrets by relayer, the receipts are not signed if empty
+	receiptSecrets map[string][]byte
+	// requireClientCert requires a verified client certificate out of the unauthenticatedPaths
+	requireClientCert bool
 
 	taskWg sync.WaitGroup
 
 	stopCh chan struct{}
+	// streamStop ends the event streams, the server shutdown waits for them
+	streamStop chan struct{}
 }
 
 func New(cfg *client.Config) (*Handler, error) {
-	fabCli := client.NewFabCli(cfg)
+	backend, err := OpenBackend(cfg.DB, cfg.DataDir(), cfg.DefaultPipeline())
+	if err != nil {
+		return nil, err
+	}
 
-	rootDB, err := OpenStormDB(cfg.DataDir())
+	secrets, err := cfg.Server.LoadReceiptSecrets()
 	if err != nil {
+		backend.Close()
 		return nil, err
 	}
 
-	store, err := NewStore(rootDB)
+	tlsConfig, err := cfg.Server.TLSConfig()
 	if err != nil {
+		backend.Close()
 		return nil, err
 	}
 
-	txm := NewTxManager(fabCli, &client.MockOutChainClient{}, store)
+	requireClientCert := tlsConfig != nil && tlsConfig.ClientCAs != nil
+	if secrets == nil && !requireClientCert {
+		if !cfg.Server.InsecureReceipts {
+			backend.Close()
+			return nil, fmt.Errorf("the receipts are unauthenticated, set --%s or --%s, or --%s to accept them",
+				client.ReceiptSecretsFlag, client.TLSClientCAFlag, client.InsecureReceiptsFlag)
+		}
+		log.Warn("[Server] the receipts are unauthenticated", client.InsecureReceiptsFlag, true)
+	}
+
 	h := &Handler{
-		blkSync: NewBlockSync(fabCli, txm),
-		rootDB:  rootDB,
-		txm:     txm,
-		stopCh:  make(chan struct{}),
+		backend:           backend,
+		adminToken:        cfg.AdminToken,
+		receiptSecrets:    secrets,
+		requireClientCert: requireClientCert,
+		stopCh:            make(chan struct{}),
+		streamStop:        make(chan struct{}),
+	}
+
+	for _, pc := range cfg.Pipelines {
+		p, err := NewPipeline(cfg, pc, backend)
+		if err != nil {
+			backend.Close()
+			return nil, fmt.Errorf("new pipeline %s err: %w", pc.ID(), err)
+		}
+
+		h.pipelines = append(h.pipelines, p)
 	}
 
-	h.server = NewServer(cfg.HTTPEndpoint(), h)
+	h.server = NewServer(cfg.HTTPEndpoint(), h, tlsConfig)
 
 	return h, nil
 }
 
 func (h *Handler) Start() {
-	h.txm.Start()
-	h.blkSync.Start()
+	for _, p := range h.pipelines {
+		p.Start()
+	}
 	h.server.Start()
 }
 
 func (h *Handler) Stop() {
-	h.blkSync.Stop()
+	for _, p := range h.pipelines {
+		p.StopSync()
+	}
+	close(h.streamStop)
 	h.server.Stop()
 
 	close(h.stopCh)
 	h.taskWg.Wait()
 
-	h.txm.Stop()
+	for _, p := range h.pipelines {
+		p.Stop()
+	}
 
-	h.rootDB.Close()
+	h.backend.Close()
+}
+
+// pipeline resolves the pipeline of the request by the channel and chaincode parameters,
+// they can be omitted if the courier runs only one pipeline, the chaincode can be omitted
+// if the channel has only one
+func (h *Handler) pipeline(req *http.Request) (*Pipeline, error) {
+	channel, chaincode := req.FormValue("channel"), req.FormValue("chaincode")
+
+	var found *Pipeline
+	for _, p := range h.pipelines {
+		if (channel != "" && p.ChannelID != channel) || (chaincode != "" && p.ChainCodeID != chaincode) {
+			continue
+		}
+
+		if found != nil {
+			return nil, fmt.Errorf("several pipelines match, set the channel and chaincode")
+		}
+		found = p
+	}
+
+	if found == nil {
+		return nil, fmt.Errorf("no pipeline of channel %q chaincode %q", channel, chaincode)
+	}
+
+	return found, nil
 }
 
 func (h *Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	code, msg := http.StatusOK, ""
+	code, msg := h.authorize(req)
+	if code == http.StatusOK {
+		code, msg = h.serve(w, req)
+	}
+	if code == codeStreamed {
+		return
+	}
 
+	w.WriteHeader(code)
+	if _, err := w.Write([]byte(msg)); err != nil {
+		log.Error("[Server] serve http", "err", err)
+	}
+}
+
+func (h *Handler) serve(w http.ResponseWriter, req *http.Request) (code int, msg string) {
+	code = http.StatusOK
+
+	switch route(req.URL.Path) {
+	case "/metrics":
+		if req.Method != "GET" {
+			code, msg = http.StatusBadRequest, "support GET request only"
+			break
+		}
+
+		for _, p := range h.pipelines {
+			p.collectMetrics()
+		}
+
+		var buf bytes.Buffer
+		if err := metrics.DefaultRegistry.WriteText(&buf); err != nil {
+			code, msg = http.StatusInternalServerError, err.Error()
+			break
+		}
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		msg = buf.String()
+	case "/healthz", "/readyz":
+		if req.Method != "GET" {
+			code, msg = http.StatusBadRequest, "support GET request only"
+			break
+		}
+
+		health, ok := h.health(req.URL.Path == "/readyz")
+		raw, err := json.Marshal(health)
+		if err != nil {
+			code, msg = http.StatusInternalServerError, err.Error()
+			break
+		}
+
+		if !ok {
+			code = http.StatusServiceUnavailable
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		msg = string(raw)
+	case "/v1/admin/requeue", "/v1/admin/recommit", "/v1/admin/status", "/v1/admin/note", "/v1/admin/audit":
+		p, err := h.pipeline(req)
+		if err != nil {
+			code, msg = http.StatusBadRequest, err.Error()
+			break
+		}
+
+		code, msg = h.serveAdmin(w, req, p)
+	case "/v1/events":
+		p, err := h.pipeline(req)
+		if err != nil {
+			code, msg = http.StatusBadRequest, err.Error()
+			break
+		}
+
+		code, msg = h.streamTransitions(w, req, p)
+	case "/v1/receipt", "/v1/receipt/conflicts", "/v1/history", "/v1/deadletter", "/v1/invalid",
+		"/v1/crosstx", "/v1/crosstx/":
+		p, err := h.pipeline(req)
+		if err != nil {
+			code, msg = http.StatusBadRequest, err.Error()
+			break
+		}
+
+		code, msg = h.servePipeline(w, req, p)
+	default:
+		code = http.StatusNotFound
+		msg = fmt.Sprintf("%s not found\n", req.URL.Path)
+	}
+
+	return code, msg
+}
+
+// authorize requires the client certificate if the client CA is set, except for the probes and the metrics,
+// then authenticates the admin requests by the bearer token, and the receipts by the relayer signature
+// before they are parsed
+func (h *Handler) authorize(req *http.Request) (code int, msg string) {
+	if h.requireClientCert && !unauthenticatedPaths[req.URL.Path] && (req.TLS == nil || len(req.TLS.VerifiedChains) == 0) {
+		log.Warn("[Server] request without client certificate", "path", req.URL.Path, "remote", req.RemoteAddr)
+		return http.StatusUnauthorized, "client certificate required"
+	}
+
+	switch {
+	case strings.HasPrefix(req.URL.Path, "/v1/admin/"):
+		return h.authorizeAdmin(req)
+	case req.URL.Path == "/v1/receipt":
+		if err := h.authenticateReceipt(req); err != nil {
+			log.Warn("[Server] unauthenticated receipt", "remote", req.RemoteAddr, "err", err)
+			return http.StatusUnauthorized, fmt.Sprintf("unauthorized: %v", err)
+		}
+	}
+
+	return http.StatusOK, ""
+}
+
+// authorizeAdmin checks the bearer token of the admin API
+func (h *Handler) authorizeAdmin(req *http.Request) (code int, msg string) {
+	if h.adminToken == "" {
+		return http.StatusForbidden, "admin API disabled"
+	}
+
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") || subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(h.adminToken)) != 1 {
+		log.Warn("[Server] unauthorized admin request", "path", req.URL.Path, "remote", req.RemoteAddr)
+		return http.StatusUnauthorized, "unauthorized"
+	}
+
+	return http.StatusOK, ""
+}
+
+// serveAdmin serves the operator actions, the operator parameter names who takes the action in the audit log,
+// it is not authenticated, the single admin token lets its holders act under any operator name
+func (h *Handler) serveAdmin(w http.ResponseWriter, req *http.Request, p *Pipeline) (code int, msg string) {
+	code = http.StatusOK
+
+	if req.URL.Path == "/v1/admin/audit" {
+		if req.Method != "GET" {
+			return http.StatusBadRequest, "support GET request only"
+		}
+
+		records := p.txm.AuditLog(req.URL.Query().Get("crossid"))
+		if records == nil {
+			records = []*AuditRecord{}
+		}
+
+		raw, err := json.Marshal(records)
+		if err != nil {
+			return http.StatusInternalServerError, err.Error()
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		return code, string(raw)
+	}
+
+	if req.Method != "POST" {
+		return http.StatusBadRequest, "support POST request only"
+	}
+
+	operator, crossID := req.PostFormValue("operator"), req.PostFormValue("crossid")
+	if operator == "" || crossID == "" {
+		return http.StatusBadRequest, "operator and crossid are required"
+	}
+
+	var err error
 	switch req.URL.Path {
+	case "/v1/admin/requeue":
+		err = p.txm.AdminRequeue(operator, crossID)
+	case "/v1/admin/recommit":
+		err = p.txm.AdminRecommit(operator, crossID)
+	case "/v1/admin/status":
+		var status contractlib.CStatus
+		if status, err = contractlib.ParseCStatus(req.PostFormValue("status")); err != nil {
+			return http.StatusBadRequest, err.Error()
+		}
+		err = p.txm.ForceStatus(operator, crossID, status, req.PostFormValue("reason"))
+	case "/v1/admin/note":
+		err = p.txm.AddNote(operator, crossID, req.PostFormValue("note"))
+	}
+
+	if err != nil {
+		return http.StatusBadRequest, err.Error()
+	}
+
+	return code, msg
+}
+
+// route returns the route of the path, the paths with a trailing id are routed by their prefix
+func route(path string) string {
+	if strings.HasPrefix(path, "/v1/crosstx/") {
+		return "/v1/crosstx/"
+	}
+
+	return path
+}
+
+func (h *Handler) servePipeline(w http.ResponseWriter, req *http.Request, p *Pipeline) (code int, msg string) {
+	code = http.StatusOK
+
+	switch route(req.URL.Path) {
 	case "/v1/receipt":
 		if req.Method != "POST" {
 			code, msg = http.StatusBadRequest, "support POST request only"
 			break
 		}
 
-		crossID := req.PostFormValue("crossid")
-		receipt := req.PostFormValue("receipt")
-		sequence := req.PostFormValue("sequence")
+		if strings.HasPrefix(req.Header.Get("Content-Type"), "application/json") {
+			code, msg = h.serveJSONReceipts(w, req, p)
+			break
+		}
+
+		resp := h.recvReceipt(p, req.PostFormValue("crossid"), req.PostFormValue("receipt"), req.PostFormValue("sequence"))
+
+		code, msg = resp.Code, resp.Result
+		if resp.Error != "" {
+			msg = fmt.Sprintf("%s: %s", resp.Result, resp.Error)
+		}
+	case "/v1/receipt/conflicts":
+		if req.Method != "GET" {
+			code, msg = http.StatusBadRequest, "support GET request only"
+			break
+		}
+
+		conflicts := p.txm.ReceiptConflicts()
+		if conflicts == nil {
+			conflicts = []*ReceiptRecord{}
+		}
+
+		raw, err := json.Marshal(conflicts)
+		if err != nil {
+			code, msg = http.StatusInternalServerError, err.Error()
+			break
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		msg = string(raw)
+	case "/v1/history":
+		if req.Method != "GET" {
+			code, msg = http.StatusBadRequest, "support GET request only"
+			break
+		}
+
+		tx := p.txm.DB.One(CrossIdIndex, req.URL.Query().Get("crossid"))
+		if tx == nil {
+			code, msg = http.StatusNotFound, "crossid not found"
+			break
+		}
+
+		raw, err := json.Marshal(tx.History)
+		if err != nil {
+			code, msg = http.StatusInternalServerError, err.Error()
+			break
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		msg = string(raw)
+	case "/v1/deadletter":
+		if req.Method != "GET" {
+			code, msg = http.StatusBadRequest, "support GET request only"
+			break
+		}
+
+		deadLetters := p.txm.DeadLetters()
+		if deadLetters == nil {
+			deadLetters = []*CrossTx{}
+		}
+
+		raw, err := json.Marshal(deadLetters)
+		if err != nil {
+			code, msg = http.StatusInternalServerError, err.Error()
+			break
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		msg = string(raw)
+	case "/v1/crosstx":
+		if req.Method != "GET" {
+			code, msg = http.StatusBadRequest, "support GET request only"
+			break
+		}
+
+		query, err := parseCrossTxQuery(req.URL.Query())
+		if err != nil {
+			code, msg = http.StatusBadRequest, err.Error()
+			break
+		}
+
+		raw, err := json.Marshal(p.txm.QueryCrossTxs(query))
+		if err != nil {
+			code, msg = http.StatusInternalServerError, err.Error()
+			break
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		msg = string(raw)
+	case "/v1/crosstx/":
+		if req.Method != "GET" {
+			code, msg = http.StatusBadRequest, "support GET request only"
+			break
+		}
+
+		tx := p.txm.DB.One(CrossIdIndex, strings.TrimPrefix(req.URL.Path, "/v1/crosstx/"))
+		if tx == nil {
+			code, msg = http.StatusNotFound, "crossid not found"
+			break
+		}
+
+		raw, err := json.Marshal(newCrossTxView(tx))
+		if err != nil {
+			code, msg = http.StatusInternalServerError, err.Error()
+			break
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		msg = string(raw)
+	case "/v1/invalid":
+		if req.Method != "GET" {
+			code, msg = http.StatusBadRequest, "support GET request only"
+			break
+		}
+
+		invalids := p.txm.InvalidPrecommits(req.URL.Query().Get("crossid"), req.URL.Query().Get("txid"))
+		if invalids == nil {
+			invalids = []*InvalidPrecommit{}
+		}
+
+		raw, err := json.Marshal(invalids)
+		if err != nil {
+			code, msg = http.StatusInternalServerError, err.Error()
+			break
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		msg = string(raw)
+	}
+
+	return code, msg
+}
+
+// serveJSONReceipts receives a receipt or an array of receipts, they are answered with a ReceiptResponse
+// or an array of them in the same order, the status of a batch is 207 unless all its results share one
+func (h *Handler) serveJSONReceipts(w http.ResponseWriter, req *http.Request, p *Pipeline) (code int, msg string) {
+	var raw json.RawMessage
+	if err := json.NewDecoder(io.LimitReader(req.Body, maxReceiptBodySize)).Decode(&raw); err != nil {
+		return http.StatusBadRequest, fmt.Sprintf("invalid json body: %v", err)
+	}
+
+	var (
+		reqs  []ReceiptRequest
+		batch = len(bytes.TrimSpace(raw)) > 0 && bytes.TrimSpace(raw)[0] == '['
+	)
+
+	if batch {
+		if err := json.Unmarshal(raw, &reqs); err != nil {
+			return http.StatusBadRequest, fmt.Sprintf("invalid receipt array: %v", err)
+		}
+		if len(reqs) == 0 || len(reqs) > maxReceiptBatch {
+			return http.StatusBadRequest, fmt.Sprintf("receipt array should have 1 to %d items", maxReceiptBatch)
+		}
+	} else {
+		var r ReceiptRequest
+		if err := json.Unmarshal(raw, &r); err != nil {
+			return http.StatusBadRequest, fmt.Sprintf("invalid receipt: %v", err)
+		}
+		reqs = append(reqs, r)
+	}
 
-		//TODO check crossID, receipt, sequence
-		seq, _ := strconv.Atoi(sequence)
+	resps := make([]ReceiptResponse, 0, len(reqs))
+	for _, r := range reqs {
+		resps = append(resps, h.recvReceipt(p, r.CrossID, r.Receipt, r.sequence()))
+	}
+
+	var body interface{} = resps[0]
+	code = resps[0].Code
+	if batch {
+		body = resps
+		for _, resp := range resps {
+			if resp.Code != code {
+				code = http.StatusMultiStatus
+				break
+			}
+		}
+	}
+
+	out, err := json.Marshal(body)
+	if err != nil {
+		return http.StatusInternalServerError, err.Error()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return code, string(out)
+}
+
+// recvReceipt validates and receives one receipt
+func (h *Handler) recvReceipt(p *Pipeline, crossID, receipt, sequence string) ReceiptResponse {
+	ctr, err := parseReceipt(crossID, receipt, sequence)
+	if err != nil {
+		return ReceiptResponse{CrossID: crossID, Result: ReceiptInvalid.String(), Code: http.StatusBadRequest, Error: err.Error()}
+	}
+
+	result, err := h.RecvMsg(p, ctr)
 
-		h.RecvMsg(CrossTxReceipt{crossID, receipt, int64(seq)})
+	resp := ReceiptResponse{CrossID: crossID, Result: result.String(), Code: http.StatusOK}
+	switch result {
+	case ReceiptAccepted, ReceiptDuplicate:
+	case ReceiptParked:
+		resp.Code = http.StatusAccepted
+	case ReceiptStale, ReceiptConflicting:
+		resp.Code = http.StatusConflict
 	default:
-		code = http.StatusNotFound
-		msg = fmt.Sprintf("%s not found\n", req.URL.Path)
+		switch {
+		case errors.Is(err, ErrCrossTxNotFound):
+			resp.Code = http.StatusNotFound
+		case errors.Is(err, errStopping):
+			resp.Code = http.StatusServiceUnavailable
+		default:
+			// the CrossTx does not take a receipt in its status
+			resp.Code = http.StatusUnprocessableEntity
+		}
 	}
 
-	w.WriteHeader(code)
-	if _, err := w.Write([]byte(msg)); err != nil {
-		log.Error("[Server] serve http", "err", err)
+	if err != nil {
+		resp.Error = err.Error()
 	}
+
+	return resp
 }
 
-func (h *Handler) RecvMsg(ctr CrossTxReceipt) {
+func (h *Handler) RecvMsg(p *Pipeline, ctr CrossTxReceipt) (ReceiptResult, error) {
 	h.taskWg.Add(1)
-	go func() {
-		defer h.taskWg.Done()
+	defer h.taskWg.Done()
+
+	select {
+	case <-h.stopCh:
+		return ReceiptRejected, errStopping
+	default:
+	}
 
-		h.txm.executed.mu.Lock()
-		h.txm.executed.prq.Push(ctr, -ctr.Sequence)
-		h.txm.executed.mu.Unlock()
+	result, err := p.txm.RecvReceipt(ctr)
+	log.Debug("[Handler] receive receipt", "pipeline", p.ID(), "crossID", ctr.CrossID, "sequence", ctr.Sequence, "result", result, "err", err)
 
-		select {
-		case h.txm.executed.process <- struct{}{}:
-		case <-h.stopCh:
-			return
-		}
-	}()
+	return result, err
 }
@@ -0,0 +1,95 @@
+package courier
+
+import (
+	"time"
+)
+
+// PipelineHealth is the health of a pipeline reported by /healthz and /readyz, it is read from the state
+// kept by the sync and the TxManager, the checks neither write the DB nor call fabric
+type PipelineHealth struct {
+	Pipeline         string
+	BlockSyncRunning bool
+	TxManagerRunning bool
+	// LastBlockFetch is the time of the last block fetched from fabric, by query or by event
+	LastBlockFetch *time.Time `json:",omitempty"`
+	BlockNumber    uint64
+	// ChainHeight is the highest height seen by the sync
+	ChainHeight uint64
+	// SyncLag is the number of the committed blocks not synced yet
+	SyncLag uint64
+	// FabricError is the error of the last fabric call of the sync
+	FabricError string      `json:",omitempty"`
+	LastSend    *SendResult `json:",omitempty"`
+	// DBWritable is false once a block save failed, DBError is its error
+	DBWritable bool
+	DBError    string `json:",omitempty"`
+}
+
+// Health is the response of /healthz and /readyz
+type Health struct {
+	Status    string
+	Pipelines []PipelineHealth
+}
+
+// Live reports whether the goroutines of the pipeline are running
+func (h *PipelineHealth) Live() bool {
+	return h.BlockSyncRunning && h.TxManagerRunning
+}
+
+// Ready reports whether the pipeline is running and can reach fabric and write the DB,
+// the outchain send errors are reported but they are retried so they don't fail the readiness
+func (h *PipelineHealth) Ready() bool {
+	return h.Live() && h.FabricError == "" && h.DBWritable
+}
+
+func (p *Pipeline) health() PipelineHealth {
+	h := PipelineHealth{
+		Pipeline:         p.ID(),
+		TxManagerRunning: p.txm.Running(),
+		LastSend:         p.txm.LastSend(),
+		DBWritable:       true,
+	}
+
+	if p.blkSync == nil {
+		return h
+	}
+
+	h.BlockSyncRunning = p.blkSync.Running()
+	h.BlockNumber = p.blkSync.BlockNumber()
+	h.FabricError = p.blkSync.FabricError()
+
+	if h.DBError = p.blkSync.SaveError(); h.DBError != "" {
+		h.DBWritable = false
+	}
+
+	if last := p.blkSync.LastFetch(); !last.IsZero() {
+		h.LastBlockFetch = &last
+	}
+
+	h.ChainHeight = p.blkSync.ChainHeight()
+	if h.ChainHeight > h.BlockNumber {
+		h.SyncLag = h.ChainHeight - h.BlockNumber
+	}
+
+	return h
+}
+
+// health checks all the pipelines, ok is false if any is not live, or not ready if ready is set
+func (h *Handler) health(ready bool) (health Health, ok bool) {
+	ok = true
+	for _, p := range h.pipelines {
+		ph := p.health()
+		if !ph.Live() || (ready && !ph.Ready()) {
+			ok = false
+		}
+
+		health.Pipelines = append(health.Pipelines, ph)
+	}
+
+	health.Status = "ok"
+	if !ok {
+		health.Status = "unavailable"
+	}
+
+	return health, ok
+}
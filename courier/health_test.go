@@ -0,0 +1,79 @@
+package courier
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/icodezjb/fabric-study/courier/client"
+)
+
+func TestHealthEndpoints(t *testing.T) {
+	store, closeStore := newTestStore(t)
+	defer closeStore()
+
+	txm := NewTxManager(&client.Config{}, &MockFabricClient{}, &client.MockOutChainClient{}, store)
+	p := &Pipeline{
+		PipelineConfig: client.PipelineConfig{ChannelID: "mychannel", ChainCodeID: "mycc"},
+		blkSync:        NewBlockSync(&client.Config{}, &MockFabricClient{}, txm),
+		txm:            txm,
+	}
+	h := &Handler{pipelines: []*Pipeline{p}}
+
+	check := func(path string, want int) PipelineHealth {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		if rec.Code != want {
+			t.Fatalf("%s, want: %d, got: %d, %s", path, want, rec.Code, rec.Body.String())
+		}
+
+		var health Health
+		if err := json.Unmarshal(rec.Body.Bytes(), &health); err != nil {
+			t.Fatal(err)
+		}
+		if len(health.Pipelines) != 1 {
+			t.Fatalf("%s, want 1 pipeline, got: %d", path, len(health.Pipelines))
+		}
+
+		return health.Pipelines[0]
+	}
+
+	// not started
+	check("/healthz", http.StatusServiceUnavailable)
+
+	atomic.StoreInt32(&p.blkSync.running, 1)
+	atomic.StoreInt32(&txm.running, 1)
+	p.blkSync.seeHeight(10)
+	txm.send([][]byte{[]byte("{}"), []byte("{}")})
+
+	health := check("/readyz", http.StatusOK)
+	if !health.DBWritable || health.ChainHeight != 10 || health.SyncLag != 9 || health.LastBlockFetch != nil {
+		t.Fatalf("readyz, got: %+v", health)
+	}
+	if health.LastSend == nil || health.LastSend.Sent != 2 || health.LastSend.Failed != 0 {
+		t.Fatalf("last send, got: %+v", health.LastSend)
+	}
+
+	// the fabric error seen by the sync fails the readiness only, until a fabric call succeeds
+	p.blkSync.fabricErr.Store("peer unreachable")
+	check("/healthz", http.StatusOK)
+	if health := check("/readyz", http.StatusServiceUnavailable); health.FabricError != "peer unreachable" {
+		t.Fatalf("readyz, got: %+v", health)
+	}
+	p.blkSync.fabricErr.Store("")
+
+	// the failed block save fails the readiness
+	p.blkSync.saveErr.Store("read-only")
+	check("/healthz", http.StatusOK)
+	if health := check("/readyz", http.StatusServiceUnavailable); health.DBWritable || health.DBError != "read-only" {
+		t.Fatalf("readyz, got: %+v", health)
+	}
+	p.blkSync.saveErr.Store("")
+
+	p.blkSync.Stop()
+	if health := check("/healthz", http.StatusServiceUnavailable); health.BlockSyncRunning || !health.TxManagerRunning {
+		t.Fatalf("healthz, got: %+v", health)
+	}
+}
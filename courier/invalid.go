@@ -0,0 +1,69 @@
+package courier
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/icodezjb/fabric-study/courier/contractlib"
+	"github.com/icodezjb/fabric-study/log"
+
+	"github.com/asdine/storm/v3/q"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/hyperledger/fabric-protos-go/peer"
+)
+
+// InvalidPrecommit is a precommit tx invalidated by the committing peers, e.g. MVCC_READ_CONFLICT
+// or ENDORSEMENT_POLICY_FAILURE, its CrossTx never started
+type InvalidPrecommit struct {
+	// ID is TxID/ActionIndex
+	ID          string `storm:"id"`
+	TxID        string `storm:"index"`
+	CrossID     string `storm:"index"`
+	BlockNumber uint64 `storm:"index"`
+	TimeStamp   *timestamp.Timestamp
+
+	ValidationCode peer.TxValidationCode
+	// Reason is the name of the validation code
+	Reason string
+	// Contract is the precommit contract, if the event payload is JSON
+	Contract json.RawMessage `json:",omitempty"`
+}
+
+// newInvalidPrecommit returns the record of the invalidated precommit tx, the CrossID is set if the contract decodes
+func newInvalidPrecommit(preTx *PrepareCrossTx, h EventHandler) *InvalidPrecommit {
+	inv := &InvalidPrecommit{
+		ID:             fmt.Sprintf("%s/%d", preTx.TxID, preTx.ActionIndex),
+		TxID:           preTx.TxID,
+		BlockNumber:    preTx.BlockNumber,
+		TimeStamp:      preTx.TimeStamp,
+		ValidationCode: preTx.ValidationCode,
+		Reason:         preTx.ValidationCode.String(),
+	}
+
+	if json.Valid(preTx.Payload) {
+		inv.Contract = preTx.Payload
+	}
+
+	if ev, err := h.Decode(preTx); err == nil {
+		if c, ok := ev.(contractlib.Contract); ok && c.IContract != nil {
+			inv.CrossID = c.GetContractID()
+		}
+	}
+
+	log.Warn("[BlockSync] invalid precommit", "txID", inv.TxID, "crossID", inv.CrossID, "blockNumber", inv.BlockNumber, "reason", inv.Reason)
+
+	return inv
+}
+
+// InvalidPrecommits returns the invalidated precommit txs, filtered by the CrossID and TxID if set
+func (t *TxManager) InvalidPrecommits(crossID, txID string) []*InvalidPrecommit {
+	var filter []q.Matcher
+	if crossID != "" {
+		filter = append(filter, q.Eq("CrossID", crossID))
+	}
+	if txID != "" {
+		filter = append(filter, q.Eq("TxID", txID))
+	}
+
+	return t.DB.QueryInvalidPrecommits(filter...)
+}
@@ -0,0 +1,57 @@
+package courier
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/icodezjb/fabric-study/courier/client"
+	"github.com/icodezjb/fabric-study/courier/contractlib"
+
+	"github.com/hyperledger/fabric-protos-go/peer"
+)
+
+func TestInvalidPrecommit(t *testing.T) {
+	store, closeStore := newTestStore(t)
+	defer closeStore()
+
+	txm := &TxManager{DB: store}
+	blksync := NewBlockSync(&client.Config{RecordInvalid: true}, &MockFabricClient{}, txm)
+
+	payload, err := json.Marshal(newTestCrossTx("a", contractlib.Init, "").Contract)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	crossTxs, _, invalids, err := blksync.toCrossTxs([]*PrepareCrossTx{
+		{TxID: "tx-1", BlockNumber: 7, EventName: "precommit", Payload: payload, ValidationCode: peer.TxValidationCode_MVCC_READ_CONFLICT},
+		{TxID: "tx-2", BlockNumber: 7, EventName: "commit", Payload: payload, ValidationCode: peer.TxValidationCode_ENDORSEMENT_POLICY_FAILURE},
+		{TxID: "tx-3", BlockNumber: 7, EventName: "precommit", Payload: payload},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(crossTxs) != 1 || crossTxs[0].TxID != "tx-3" {
+		t.Fatalf("crossTxs, want: tx-3 only, got: %d", len(crossTxs))
+	}
+
+	if len(invalids) != 1 {
+		t.Fatalf("len(invalids), want: 1, got: %d", len(invalids))
+	}
+
+	if inv := invalids[0]; inv.ID != "tx-1/0" || inv.CrossID != "a" || inv.Reason != "MVCC_READ_CONFLICT" {
+		t.Fatalf("invalid precommit, got: %+v", inv)
+	}
+
+	if err := store.SaveBlock(7, nil, nil, invalids); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := txm.InvalidPrecommits("a", ""); len(got) != 1 || got[0].TxID != "tx-1" || got[0].ValidationCode != peer.TxValidationCode_MVCC_READ_CONFLICT {
+		t.Fatalf("invalid precommits of a, got: %+v", got)
+	}
+
+	if got := txm.InvalidPrecommits("", "tx-2"); len(got) != 0 {
+		t.Fatalf("invalid precommits of tx-2, want: none, got: %d", len(got))
+	}
+}
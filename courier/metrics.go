@@ -0,0 +1,91 @@
+package courier
+
+import (
+	"time"
+
+	"github.com/icodezjb/fabric-study/courier/contractlib"
+	"github.com/icodezjb/fabric-study/courier/metrics"
+	"github.com/icodezjb/fabric-study/log"
+)
+
+var (
+	queueSizeGauge = metrics.DefaultRegistry.NewGauge("courier_queue_size",
+		"The number of the items in the TxManager queues.", "pipeline", "queue")
+	crossTxsGauge = metrics.DefaultRegistry.NewGauge("courier_crosstxs",
+		"The number of the stored CrossTxs by status.", "pipeline", "status")
+	blockNumberGauge = metrics.DefaultRegistry.NewGauge("courier_block_number",
+		"The number of the next block to be synced.", "pipeline")
+	chainHeightGauge = metrics.DefaultRegistry.NewGauge("courier_chain_height",
+		"The height of the channel, the number of the next block to be committed.", "pipeline")
+
+	sendSeconds = metrics.DefaultRegistry.NewHistogram("courier_outchain_send_seconds",
+		"The latency of sending the CrossTxs to the outchain, one observation per send or batch.", nil, "pipeline")
+	sendErrors = metrics.DefaultRegistry.NewCounter("courier_outchain_send_errors_total",
+		"The number of the CrossTxs failed to be sent to the outchain.", "pipeline")
+
+	commitSeconds = metrics.DefaultRegistry.NewHistogram("courier_commit_seconds",
+		"The latency of the chaincode commit invocations by outcome.", nil, "pipeline", "outcome")
+	commitFailures = metrics.DefaultRegistry.NewCounter("courier_commit_failures_total",
+		"The number of the chaincode commit invocations not committed, by outcome.", "pipeline", "outcome")
+
+	completionSeconds = metrics.DefaultRegistry.NewHistogram("courier_crosstx_completion_seconds",
+		"The duration from the precommit block to the commit block of the Completed CrossTxs.",
+		[]float64{1, 5, 15, 30, 60, 120, 300, 600, 1800, 3600, 4 * 3600, 24 * 3600}, "pipeline")
+)
+
+// allStatus are the status the CrossTxs are counted by
+var allStatus = []contractlib.CStatus{
+	contractlib.Init,
+	contractlib.Pending,
+	contractlib.Executed,
+	contractlib.Finished,
+	contractlib.Completed,
+	contractlib.Aborted,
+	contractlib.DeadLetter,
+}
+
+// collectMetrics sets the gauges of the pipeline, they are collected when the metrics are scraped
+func (p *Pipeline) collectMetrics() {
+	id := p.ID()
+
+	for name, q := range map[string]*Prqueue{"pending": &p.txm.pending, "executed": &p.txm.executed, "retry": &p.txm.retry} {
+		q.mu.Lock()
+		size := q.prq.Size()
+		q.mu.Unlock()
+
+		queueSizeGauge.With(id, name).Set(float64(size))
+	}
+
+	counts, err := p.txm.DB.CountByStatus()
+	if err != nil {
+		log.Warn("[Metrics] count CrossTxs", "pipeline", id, "err", err)
+	} else {
+		for _, status := range allStatus {
+			crossTxsGauge.With(id, status.String()).Set(float64(counts[status]))
+		}
+	}
+
+	if p.blkSync == nil {
+		return
+	}
+
+	blockNumberGauge.With(id).Set(float64(p.blkSync.BlockNumber()))
+	chainHeightGauge.With(id).Set(float64(p.blkSync.ChainHeight()))
+}
+
+// observeCompletions observes the duration of the CrossTxs completed by the updates of the block
+func (t *TxManager) observeCompletions(updates []*CrossTxUpdate) {
+	for _, u := range updates {
+		if u.TimeStamp == nil {
+			continue
+		}
+
+		stored := t.DB.One(CrossIdIndex, u.CrossID)
+		if stored == nil || stored.GetStatus() != contractlib.Completed || stored.TimeStamp == nil {
+			continue
+		}
+
+		d := time.Unix(u.TimeStamp.Seconds, int64(u.TimeStamp.Nanos)).Sub(time.Unix(stored.TimeStamp.Seconds, int64(stored.TimeStamp.Nanos)))
+		completionSeconds.With(t.pipeline).Observe(d.Seconds())
+	}
+}
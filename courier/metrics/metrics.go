@@ -0,0 +1,342 @@
+// Package metrics is a minimal registry of counters, gauges and histograms,
+// written in the Prometheus text exposition format
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefBuckets are the default histogram buckets in seconds
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// DefaultRegistry is the registry of the courier metrics
+var DefaultRegistry = NewRegistry()
+
+type metric interface {
+	write(w *bufio.Writer)
+}
+
+// Registry holds the metrics in the order they are registered
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+	names   map[string]struct{}
+}
+
+func NewRegistry() *Registry {
+	return &Registry{names: make(map[string]struct{})}
+}
+
+func (r *Registry) register(name string, m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.names[name]; ok {
+		panic(fmt.Sprintf("metrics: %s registered twice", name))
+	}
+
+	r.names[name] = struct{}{}
+	r.metrics = append(r.metrics, m)
+}
+
+// WriteText writes all the metrics in the text exposition format
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mu.Lock()
+	metrics := append([]metric(nil), r.metrics...)
+	r.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(bw)
+	}
+
+	return bw.Flush()
+}
+
+// vec keeps the series of a metric by their label values
+type vec struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+
+	mu     sync.Mutex
+	series map[string]interface{}
+	values map[string][]string
+}
+
+func newVec(name, help, typ string, labels []string) *vec {
+	return &vec{
+		name:   name,
+		help:   help,
+		typ:    typ,
+		labels: labels,
+		series: make(map[string]interface{}),
+		values: make(map[string][]string),
+	}
+}
+
+// get returns the series of the label values, created by newSeries if absent
+func (v *vec) get(values []string, newSeries func() interface{}) interface{} {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s has %d labels, got %d values", v.name, len(v.labels), len(values)))
+	}
+
+	key := strings.Join(values, "\xff")
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	s, ok := v.series[key]
+	if !ok {
+		s = newSeries()
+		v.series[key] = s
+		v.values[key] = append([]string(nil), values...)
+	}
+
+	return s
+}
+
+// each calls fn with the label pairs of the series sorted by the label values
+func (v *vec) each(fn func(labels string, s interface{})) {
+	v.mu.Lock()
+	keys := make([]string, 0, len(v.series))
+	for key := range v.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	type entry struct {
+		labels string
+		s      interface{}
+	}
+	entries := make([]entry, 0, len(keys))
+	for _, key := range keys {
+		entries = append(entries, entry{labels: v.labelPairs(v.values[key]), s: v.series[key]})
+	}
+	v.mu.Unlock()
+
+	for _, e := range entries {
+		fn(e.labels, e.s)
+	}
+}
+
+func (v *vec) labelPairs(values []string) string {
+	pairs := make([]string, 0, len(values))
+	for i, value := range values {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", v.labels[i], escape(value)))
+	}
+
+	return strings.Join(pairs, ",")
+}
+
+func (v *vec) header(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, v.help, v.name, v.typ)
+}
+
+var escaper = strings.NewReplacer("\\", `\\`, "\"", `\"`, "\n", `\n`)
+
+func escape(s string) string {
+	return escaper.Replace(s)
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(f, 'g', -1, 64)
+	}
+}
+
+func braces(labels string) string {
+	if labels == "" {
+		return ""
+	}
+
+	return "{" + labels + "}"
+}
+
+// value is the float of a counter or a gauge series
+type value struct {
+	mu sync.Mutex
+	v  float64
+}
+
+func (v *value) Add(delta float64) {
+	v.mu.Lock()
+	v.v += delta
+	v.mu.Unlock()
+}
+
+func (v *value) Set(f float64) {
+	v.mu.Lock()
+	v.v = f
+	v.mu.Unlock()
+}
+
+func (v *value) get() float64 {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	return v.v
+}
+
+// Counter is a monotonically increasing metric
+type Counter struct {
+	*vec
+}
+
+// CounterSeries is the series of a Counter with its label values
+type CounterSeries struct {
+	v *value
+}
+
+func (c CounterSeries) Inc() {
+	c.v.Add(1)
+}
+
+// Add increases the counter, negative deltas are ignored
+func (c CounterSeries) Add(delta float64) {
+	if delta > 0 {
+		c.v.Add(delta)
+	}
+}
+
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{vec: newVec(name, help, "counter", labels)}
+	r.register(name, c)
+	return c
+}
+
+func (c *Counter) With(values ...string) CounterSeries {
+	return CounterSeries{v: c.get(values, func() interface{} { return &value{} }).(*value)}
+}
+
+func (c *Counter) write(w *bufio.Writer) {
+	c.header(w)
+	c.each(func(labels string, s interface{}) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, braces(labels), formatFloat(s.(*value).get()))
+	})
+}
+
+// Gauge is a metric which goes up and down, e.g. a queue size
+type Gauge struct {
+	*vec
+}
+
+// GaugeSeries is the series of a Gauge with its label values
+type GaugeSeries struct {
+	v *value
+}
+
+func (g GaugeSeries) Set(f float64) {
+	g.v.Set(f)
+}
+
+func (g GaugeSeries) Add(delta float64) {
+	g.v.Add(delta)
+}
+
+func (r *Registry) NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{vec: newVec(name, help, "gauge", labels)}
+	r.register(name, g)
+	return g
+}
+
+func (g *Gauge) With(values ...string) GaugeSeries {
+	return GaugeSeries{v: g.get(values, func() interface{} { return &value{} }).(*value)}
+}
+
+func (g *Gauge) write(w *bufio.Writer) {
+	g.header(w)
+	g.each(func(labels string, s interface{}) {
+		fmt.Fprintf(w, "%s%s %s\n", g.name, braces(labels), formatFloat(s.(*value).get()))
+	})
+}
+
+// Histogram counts the observations in cumulative buckets
+type Histogram struct {
+	*vec
+	buckets []float64
+}
+
+type histogram struct {
+	mu     sync.Mutex
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// HistogramSeries is the series of a Histogram with its label values
+type HistogramSeries struct {
+	h       *histogram
+	buckets []float64
+}
+
+func (h HistogramSeries) Observe(f float64) {
+	i := sort.SearchFloat64s(h.buckets, f)
+
+	h.h.mu.Lock()
+	if i < len(h.buckets) {
+		h.h.counts[i]++
+	}
+	h.h.count++
+	h.h.sum += f
+	h.h.mu.Unlock()
+}
+
+// NewHistogram registers a histogram with the upper bounds of its buckets in increasing order, DefBuckets if nil
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if buckets == nil {
+		buckets = DefBuckets
+	}
+
+	if !sort.Float64sAreSorted(buckets) {
+		panic(fmt.Sprintf("metrics: buckets of %s are not sorted", name))
+	}
+
+	h := &Histogram{vec: newVec(name, help, "histogram", labels), buckets: buckets}
+	r.register(name, h)
+	return h
+}
+
+func (h *Histogram) With(values ...string) HistogramSeries {
+	s := h.get(values, func() interface{} { return &histogram{counts: make([]uint64, len(h.buckets))} }).(*histogram)
+	return HistogramSeries{h: s, buckets: h.buckets}
+}
+
+func (h *Histogram) write(w *bufio.Writer) {
+	h.header(w)
+	h.each(func(labels string, s interface{}) {
+		hs := s.(*histogram)
+
+		hs.mu.Lock()
+		counts := append([]uint64(nil), hs.counts...)
+		count, sum := hs.count, hs.sum
+		hs.mu.Unlock()
+
+		sep := ""
+		if labels != "" {
+			sep = ","
+		}
+
+		var cumulative uint64
+		for i, upper := range h.buckets {
+			cumulative += counts[i]
+			fmt.Fprintf(w, "%s_bucket{%s%sle=\"%s\"} %d\n", h.name, labels, sep, formatFloat(upper), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket{%s%sle=\"+Inf\"} %d\n", h.name, labels, sep, count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, braces(labels), formatFloat(sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, braces(labels), count)
+	})
+}
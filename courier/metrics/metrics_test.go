@@ -0,0 +1,57 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestWriteText(t *testing.T) {
+	r := NewRegistry()
+
+	sends := r.NewCounter("sends_total", "The sends.", "pipeline")
+	queue := r.NewGauge("queue_size", "The queue size.", "pipeline", "queue")
+	latency := r.NewHistogram("latency_seconds", "The latency.", []float64{0.1, 1}, "pipeline")
+
+	sends.With("b/cc").Inc()
+	sends.With("a/cc").Add(2)
+	sends.With("a/cc").Add(-1)
+	queue.With("a/cc", "pending").Set(3)
+	queue.With("a\"\n", "pending").Set(1)
+	latency.With("a/cc").Observe(0.05)
+	latency.With("a/cc").Observe(0.5)
+	latency.With("a/cc").Observe(5)
+
+	var buf bytes.Buffer
+	if err := r.WriteText(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `# HELP sends_total The sends.
+# TYPE sends_total counter
+sends_total{pipeline="a/cc"} 2
+sends_total{pipeline="b/cc"} 1
+# HELP queue_size The queue size.
+# TYPE queue_size gauge
+queue_size{pipeline="a\"\n",queue="pending"} 1
+queue_size{pipeline="a/cc",queue="pending"} 3
+# HELP latency_seconds The latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{pipeline="a/cc",le="0.1"} 1
+latency_seconds_bucket{pipeline="a/cc",le="1"} 2
+latency_seconds_bucket{pipeline="a/cc",le="+Inf"} 3
+latency_seconds_sum{pipeline="a/cc"} 5.55
+latency_seconds_count{pipeline="a/cc"} 3
+`
+	if buf.String() != want {
+		t.Fatalf("want:\n%s\ngot:\n%s", want, buf.String())
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("want panic of the metric registered twice")
+			}
+		}()
+		r.NewGauge("queue_size", "again")
+	}()
+}
@@ -0,0 +1,135 @@
+package courier
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/icodezjb/fabric-study/courier/client"
+	"github.com/icodezjb/fabric-study/courier/contractlib"
+
+	"github.com/golang/protobuf/ptypes/timestamp"
+)
+
+func TestMetricsEndpoint(t *testing.T) {
+	store, closeStore := newTestStore(t)
+	defer closeStore()
+
+	precommit := newTestCrossTx("a", contractlib.Completed, "receipt-a")
+	if err := store.Save([]*CrossTx{
+		precommit,
+		newTestCrossTx("b", contractlib.Pending, ""),
+		newTestCrossTx("c", contractlib.Pending, ""),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	txm := NewTxManager(&client.Config{}, &MockFabricClient{}, &client.MockOutChainClient{}, store)
+	txm.pipeline = "metricschannel/mycc"
+	txm.pending.prq.Push(newTestCrossTx("d", contractlib.Init, ""), 0)
+
+	p := &Pipeline{
+		PipelineConfig: client.PipelineConfig{ChannelID: "metricschannel", ChainCodeID: "mycc"},
+		blkSync:        NewBlockSync(&client.Config{}, &MockFabricClient{}, txm),
+		txm:            txm,
+	}
+
+	// the scrape reads the height the sync has seen, it does not query the peer
+	p.blkSync.seeHeight(10)
+
+	// the counters and histograms are process-global, they are checked by their increase
+	before := scrapeMetrics(t, p)
+
+	txm.send([][]byte{[]byte("{}"), []byte("{}")})
+
+	commit := newTransitionUpdate("a", contractlib.Completed, 2)
+	commit.TimeStamp = &timestamp.Timestamp{Seconds: precommit.TimeStamp.Seconds + 42}
+	txm.observeCompletions([]*CrossTxUpdate{commit})
+
+	after := scrapeMetrics(t, p)
+	for series, want := range map[string]float64{
+		`courier_queue_size{pipeline="metricschannel/mycc",queue="pending"}`:  1,
+		`courier_queue_size{pipeline="metricschannel/mycc",queue="executed"}`: 0,
+		`courier_crosstxs{pipeline="metricschannel/mycc",status="Pending"}`:   2,
+		`courier_crosstxs{pipeline="metricschannel/mycc",status="Completed"}`: 1,
+		`courier_crosstxs{pipeline="metricschannel/mycc",status="Init"}`:      0,
+		`courier_block_number{pipeline="metricschannel/mycc"}`:                1,
+		`courier_chain_height{pipeline="metricschannel/mycc"}`:                10,
+	} {
+		if got, ok := after[series]; !ok || got != want {
+			t.Fatalf("metrics %s, want: %v, got: %v", series, want, got)
+		}
+	}
+
+	for series, want := range map[string]float64{
+		`courier_outchain_send_seconds_count{pipeline="metricschannel/mycc"}`:               2,
+		`courier_crosstx_completion_seconds_bucket{pipeline="metricschannel/mycc",le="30"}`: 0,
+		`courier_crosstx_completion_seconds_bucket{pipeline="metricschannel/mycc",le="60"}`: 1,
+		`courier_crosstx_completion_seconds_sum{pipeline="metricschannel/mycc"}`:            42,
+	} {
+		if _, ok := after[series]; !ok {
+			t.Fatalf("metrics, want series: %s", series)
+		}
+		if got := after[series] - before[series]; got != want {
+			t.Fatalf("metrics %s, want increase: %v, got: %v", series, want, got)
+		}
+	}
+
+	// the counts follow the committed transitions
+	if err := store.Updates([]string{"b"}, []func(c *CrossTx) error{func(c *CrossTx) error {
+		return c.Transition(contractlib.Executed, "receipt")
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SaveBlock(2, []*CrossTx{newTestCrossTx("e", contractlib.Init, "")}, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	after = scrapeMetrics(t, p)
+	for _, series := range []string{
+		`courier_crosstxs{pipeline="metricschannel/mycc",status="Pending"}`,
+		`courier_crosstxs{pipeline="metricschannel/mycc",status="Executed"}`,
+		`courier_crosstxs{pipeline="metricschannel/mycc",status="Init"}`,
+	} {
+		if got := after[series]; got != 1 {
+			t.Fatalf("metrics after the transitions %s, want: 1, got: %v", series, got)
+		}
+	}
+
+	counts, err := store.CountByStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.counts = nil
+	if recounted, err := store.CountByStatus(); err != nil || fmt.Sprint(recounted) != fmt.Sprint(counts) {
+		t.Fatalf("counts, want as recounted: %v, got: %v", recounted, counts)
+	}
+}
+
+// scrapeMetrics serves /metrics for the pipeline and returns the value of each series
+func scrapeMetrics(t *testing.T, p *Pipeline) map[string]float64 {
+	rec := httptest.NewRecorder()
+	(&Handler{pipelines: []*Pipeline{p}}).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("metrics, want: 200, got: %d", rec.Code)
+	}
+
+	values := make(map[string]float64)
+	for _, line := range strings.Split(rec.Body.String(), "\n") {
+		i := strings.LastIndex(line, " ")
+		if line == "" || strings.HasPrefix(line, "#") || i < 0 {
+			continue
+		}
+
+		v, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			t.Fatalf("metrics line %q: %v", line, err)
+		}
+		values[line[:i]] = v
+	}
+
+	return values
+}
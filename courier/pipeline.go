@@ -0,0 +1,53 @@
+package courier
+
+import (
+	"github.com/icodezjb/fabric-study/courier/client"
+	"github.com/icodezjb/fabric-study/log"
+)
+
+// Pipeline syncs and processes the cross chain transactions of one channel and chaincode,
+// the pipelines share nothing but the db backend and the http server
+type Pipeline struct {
+	client.PipelineConfig
+
+	blkSync *BlockSync
+	txm     *TxManager
+}
+
+func NewPipeline(cfg *client.Config, p client.PipelineConfig, backend Backend) (*Pipeline, error) {
+	store, err := backend.Open(p.ChannelID, p.ChainCodeID)
+	if err != nil {
+		return nil, err
+	}
+
+	outCli, err := client.NewOutChainClient(cfg, p)
+	if err != nil {
+		return nil, err
+	}
+
+	fabCli := client.NewFabCli(cfg, p)
+	txm := NewTxManager(cfg, fabCli, outCli, store)
+	txm.pipeline = p.ID()
+
+	return &Pipeline{
+		PipelineConfig: p,
+		blkSync:        NewBlockSync(cfg, fabCli, txm),
+		txm:            txm,
+	}, nil
+}
+
+func (p *Pipeline) Start() {
+	log.Info("[Pipeline] starting", "pipeline", p.ID())
+	p.txm.Start()
+	p.blkSync.Start()
+}
+
+// StopSync stops the block sync, the txmanager keeps running until the pending http tasks are done
+func (p *Pipeline) StopSync() {
+	p.blkSync.Stop()
+}
+
+func (p *Pipeline) Stop() {
+	p.txm.Stop()
+	log.Info("[Pipeline] stopped", "pipeline", p.ID())
+}
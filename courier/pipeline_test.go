@@ -0,0 +1,91 @@
+package courier
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/icodezjb/fabric-study/courier/client"
+	"github.com/icodezjb/fabric-study/courier/contractlib"
+)
+
+func TestPipelineStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "courier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	root, err := OpenStormDB(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer root.Close()
+
+	mine, err := NewStore(root, "mychannel", "mycc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	yours, err := NewStore(root, "yourchannel", "mycc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mine.Save([]*CrossTx{newTestCrossTx("a", contractlib.Init, "")}); err != nil {
+		t.Fatal(err)
+	}
+	mine.Set("number", 10)
+
+	if tx := yours.One(CrossIdIndex, "a"); tx != nil {
+		t.Fatal("CrossTx leaked to the store of another pipeline")
+	}
+
+	if num := yours.Get("number"); num != 0 {
+		t.Fatalf("block number of another pipeline, want: 0, got: %d", num)
+	}
+
+	if _, err := NewStore(root, "mychannel", ""); err == nil {
+		t.Fatal("want error of the store without chaincode")
+	}
+}
+
+func TestHandlerPipeline(t *testing.T) {
+	h := &Handler{}
+	for _, pc := range []client.PipelineConfig{
+		{ChannelID: "mychannel", ChainCodeID: "mycc"},
+		{ChannelID: "mychannel", ChainCodeID: "yourcc"},
+		{ChannelID: "yourchannel", ChainCodeID: "mycc"},
+	} {
+		h.pipelines = append(h.pipelines, &Pipeline{PipelineConfig: pc})
+	}
+
+	for i, c := range []struct {
+		query string
+		id    string
+	}{
+		{"channel=yourchannel", "yourchannel/mycc"},
+		{"channel=mychannel&chaincode=yourcc", "mychannel/yourcc"},
+		{"channel=mychannel", ""},
+		{"chaincode=mycc", ""},
+		{"channel=nochannel", ""},
+		{"", ""},
+	} {
+		p, err := h.pipeline(httptest.NewRequest("GET", "/v1/history?"+c.query, nil))
+		switch {
+		case c.id == "" && err == nil:
+			t.Fatalf("case %d, want error, got: %s", i, p.ID())
+		case c.id != "" && (err != nil || p.ID() != c.id):
+			t.Fatalf("case %d, want: %s, got: %v %v", i, c.id, p, err)
+		}
+	}
+
+	h.pipelines = h.pipelines[:1]
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/v1/history?channel=yourchannel", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("unknown channel, want: 400, got: %d", rec.Code)
+	}
+}
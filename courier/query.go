@@ -0,0 +1,159 @@
+package courier
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/icodezjb/fabric-study/courier/contractlib"
+
+	"github.com/asdine/storm/v3/q"
+)
+
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
+// orderFields are the CrossTx fields the list can be ordered by
+var orderFields = map[string]FieldName{
+	"pk":          PK,
+	"crossid":     CrossIdIndex,
+	"txid":        "TxID",
+	"blocknumber": "BlockNumber",
+	"timestamp":   TimestampField,
+}
+
+// CrossTxView is the JSON view of a CrossTx, with the status and the core of its contract decoded
+type CrossTxView struct {
+	*CrossTx
+	Status contractlib.CStatus
+	Core   *contractlib.ContractCore `json:",omitempty"`
+}
+
+func newCrossTxView(c *CrossTx) *CrossTxView {
+	v := &CrossTxView{CrossTx: c}
+	if c.IContract != nil {
+		v.Status = c.GetStatus()
+		v.Core = c.GetCoreInfo()
+	}
+
+	return v
+}
+
+// crossTxQuery is the parsed query of the CrossTx list
+type crossTxQuery struct {
+	pageSize  int
+	startPage int
+	orderBy   []FieldName
+	reverse   bool
+	filter    []q.Matcher
+}
+
+// parseCrossTxQuery parses the list parameters:
+// status=Init,Pending  from_block=1&to_block=9  txid=...  from_time=...&to_time=... (unix seconds)
+// page=1&page_size=100  order_by=blocknumber&reverse=true
+func parseCrossTxQuery(values url.Values) (*crossTxQuery, error) {
+	query := &crossTxQuery{pageSize: defaultPageSize, startPage: 1, orderBy: []FieldName{PK}}
+
+	if v := values.Get("status"); v != "" {
+		var status []contractlib.CStatus
+		for _, s := range strings.Split(v, ",") {
+			cs, err := contractlib.ParseCStatus(strings.TrimSpace(s))
+			if err != nil {
+				return nil, err
+			}
+			status = append(status, cs)
+		}
+		query.filter = append(query.filter, StatusIn(status...))
+	}
+
+	fromBlock, err := parseUint(values, "from_block")
+	if err != nil {
+		return nil, err
+	}
+	toBlock, err := parseUint(values, "to_block")
+	if err != nil {
+		return nil, err
+	}
+	if fromBlock > 0 || toBlock > 0 {
+		query.filter = append(query.filter, BlockBetween(fromBlock, toBlock))
+	}
+
+	if txID := values.Get("txid"); txID != "" {
+		query.filter = append(query.filter, q.Eq("TxID", txID))
+	}
+
+	fromTime, err := parseUint(values, "from_time")
+	if err != nil {
+		return nil, err
+	}
+	toTime, err := parseUint(values, "to_time")
+	if err != nil {
+		return nil, err
+	}
+	if fromTime > 0 || toTime > 0 {
+		query.filter = append(query.filter, TimeBetween(int64(fromTime), int64(toTime)))
+	}
+
+	if v := values.Get("page_size"); v != "" {
+		size, err := strconv.Atoi(v)
+		if err != nil || size <= 0 || size > maxPageSize {
+			return nil, fmt.Errorf("page_size should be in [1, %d]", maxPageSize)
+		}
+		query.pageSize = size
+	}
+
+	if v := values.Get("page"); v != "" {
+		page, err := strconv.Atoi(v)
+		if err != nil || page <= 0 {
+			return nil, fmt.Errorf("page should be a positive number")
+		}
+		query.startPage = page
+	}
+
+	if v := values.Get("order_by"); v != "" {
+		field, ok := orderFields[strings.ToLower(v)]
+		if !ok {
+			return nil, fmt.Errorf("unsupported order_by %q", v)
+		}
+		query.orderBy = []FieldName{field}
+	}
+
+	if v := values.Get("reverse"); v != "" {
+		reverse, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid reverse %q", v)
+		}
+		query.reverse = reverse
+	}
+
+	return query, nil
+}
+
+func parseUint(values url.Values, key string) (uint64, error) {
+	v := values.Get(key)
+	if v == "" {
+		return 0, nil
+	}
+
+	n, err := strconv.ParseUint(v, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q", key, v)
+	}
+
+	return n, nil
+}
+
+// QueryCrossTxs returns a page of the CrossTxs matching the query
+func (t *TxManager) QueryCrossTxs(query *crossTxQuery) []*CrossTxView {
+	crossTxs := t.DB.Query(query.pageSize, query.startPage, query.orderBy, query.reverse, query.filter...)
+
+	views := make([]*CrossTxView, 0, len(crossTxs))
+	for _, c := range crossTxs {
+		views = append(views, newCrossTxView(c))
+	}
+
+	return views
+}
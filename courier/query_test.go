@@ -0,0 +1,137 @@
+package courier
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/icodezjb/fabric-study/courier/client"
+	"github.com/icodezjb/fabric-study/courier/contractlib"
+)
+
+func TestCrossTxQueryAPI(t *testing.T) {
+	store, closeStore := newTestStore(t)
+	defer closeStore()
+
+	var txs []*CrossTx
+	for i, status := range []contractlib.CStatus{contractlib.Init, contractlib.Pending, contractlib.Pending, contractlib.Completed} {
+		tx := newTestCrossTx(string(rune('a'+i)), status, "")
+		tx.BlockNumber = uint64(i + 1)
+		tx.TimeStamp.Seconds = int64(1000 + i)
+		tx.GetCoreInfo().Value = "10"
+		txs = append(txs, tx)
+	}
+	if err := store.Save(txs); err != nil {
+		t.Fatal(err)
+	}
+
+	h := &Handler{pipelines: []*Pipeline{{
+		PipelineConfig: client.PipelineConfig{ChannelID: "mychannel", ChainCodeID: "mycc"},
+		txm:            &TxManager{DB: store},
+	}}}
+
+	get := func(target string, v interface{}) int {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", target, nil))
+		if rec.Code == http.StatusOK {
+			if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+				t.Fatalf("%s: %v", target, err)
+			}
+		}
+		return rec.Code
+	}
+
+	type view struct {
+		CrossID     string
+		BlockNumber uint64
+		Status      string
+		Core        *contractlib.ContractCore
+	}
+
+	var one view
+	if code := get("/v1/crosstx/b", &one); code != http.StatusOK {
+		t.Fatalf("get b, want: 200, got: %d", code)
+	}
+	if one.CrossID != "b" || one.Status != "Pending" || one.Core == nil || one.Core.Value != "10" {
+		t.Fatalf("get b, got: %+v", one)
+	}
+
+	if code := get("/v1/crosstx/z", &one); code != http.StatusNotFound {
+		t.Fatalf("get unknown, want: 404, got: %d", code)
+	}
+
+	for _, c := range []struct {
+		query string
+		want  string
+	}{
+		{"", "abcd"},
+		{"?status=Pending", "bc"},
+		{"?status=Init,Completed", "ad"},
+		{"?from_block=2&to_block=3", "bc"},
+		{"?txid=tx-c", "c"},
+		{"?from_time=1001&to_time=1002", "bc"},
+		{"?order_by=blocknumber&reverse=true", "dcba"},
+		{"?order_by=timestamp&page_size=3&page=2", "d"},
+		{"?page_size=2&page=3", ""},
+	} {
+		var list []view
+		if code := get("/v1/crosstx"+c.query, &list); code != http.StatusOK {
+			t.Fatalf("list %q, want: 200, got: %d", c.query, code)
+		}
+
+		var got string
+		for _, v := range list {
+			got += v.CrossID
+		}
+		if got != c.want {
+			t.Fatalf("list %q, want: %q, got: %q", c.query, c.want, got)
+		}
+	}
+
+	for _, query := range []string{"?status=Unknown", "?from_block=x", "?page_size=0", "?page=-1", "?order_by=receipt", "?reverse=maybe"} {
+		var list []view
+		if code := get("/v1/crosstx"+query, &list); code != http.StatusBadRequest {
+			t.Fatalf("list %q, want: 400, got: %d", query, code)
+		}
+	}
+}
+
+func TestQueryOrderByTimestamp(t *testing.T) {
+	store, closeStore := newTestStore(t)
+	defer closeStore()
+
+	// the nanos of different lengths, 10 is after 9 and before 200000000
+	var txs []*CrossTx
+	for i, nanos := range []int32{200000000, 9, 10} {
+		tx := newTestCrossTx(string(rune('a'+i)), contractlib.Init, "")
+		tx.TimeStamp.Seconds = 1000
+		tx.TimeStamp.Nanos = nanos
+		txs = append(txs, tx)
+	}
+	last := newTestCrossTx("d", contractlib.Init, "")
+	last.TimeStamp.Seconds = 1001
+	if err := store.Save(append(txs, last)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		reverse  bool
+		pageSize int
+		page     int
+		want     []string
+	}{
+		{false, 0, 0, []string{"b", "c", "a", "d"}},
+		{true, 0, 0, []string{"d", "a", "c", "b"}},
+		{false, 2, 2, []string{"a", "d"}},
+	} {
+		var got []string
+		for _, tx := range store.Query(c.pageSize, c.page, []FieldName{TimestampField}, c.reverse) {
+			got = append(got, tx.CrossID)
+		}
+		if strings.Join(got, "") != strings.Join(c.want, "") {
+			t.Fatalf("order by timestamp, reverse: %v, want: %v, got: %v", c.reverse, c.want, got)
+		}
+	}
+}
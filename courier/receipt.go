@@ -0,0 +1,242 @@
+package courier
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/icodezjb/fabric-study/courier/contractlib"
+	"github.com/icodezjb/fabric-study/log"
+
+	"github.com/asdine/storm/v3/q"
+)
+
+// ReceiptRecord is the receipt accepted for a CrossTx, it deduplicates the replayed receipts
+type ReceiptRecord struct {
+	CrossID  string `storm:"id"`
+	Sequence int64
+	Receipt  string
+	// Parked is set when the receipt arrived before the CrossTx is Pending,
+	// it is released to the commit path once the CrossTx is sent to the outchain
+	Parked bool `storm:"index"`
+	// Conflicts are the receipts differing from the accepted one, flagged for an operator
+	Conflicts []ReceiptConflict
+	// Flagged is set when there are conflicts
+	Flagged bool `storm:"index"`
+}
+
+type ReceiptConflict struct {
+	Sequence int64
+	Receipt  string
+	// Time is the unix time the conflicting receipt was received
+	Time int64
+}
+
+type ReceiptResult int
+
+const (
+	// ReceiptAccepted means the receipt goes to the commit path
+	ReceiptAccepted ReceiptResult = iota
+	// ReceiptParked means the receipt is kept until the CrossTx is Pending
+	ReceiptParked
+	// ReceiptDuplicate means the receipt is already accepted, nothing to do
+	ReceiptDuplicate
+	// ReceiptStale means the sequence is lower than the accepted one
+	ReceiptStale
+	// ReceiptConflicting means a different receipt is already accepted, it is flagged for an operator
+	ReceiptConflicting
+	// ReceiptRejected means the CrossTx does not take a receipt, e.g. unknown or Aborted
+	ReceiptRejected
+	// ReceiptInvalid means the receipt is malformed, e.g. without CrossID or with a non numeric sequence
+	ReceiptInvalid
+)
+
+func (r ReceiptResult) String() string {
+	switch r {
+	case ReceiptAccepted:
+		return "accepted"
+	case ReceiptParked:
+		return "parked"
+	case ReceiptDuplicate:
+		return "duplicate"
+	case ReceiptStale:
+		return "stale"
+	case ReceiptConflicting:
+		return "conflict"
+	case ReceiptInvalid:
+		return "invalid"
+	default:
+		return "rejected"
+	}
+}
+
+// ReceiptRequest is a receipt posted in the JSON body of /v1/receipt, alone or in an array,
+// the sequence is a JSON number or a numeric string, it is validated with the other fields of the receipt
+type ReceiptRequest struct {
+	CrossID  string          `json:"crossid"`
+	Receipt  string          `json:"receipt"`
+	Sequence json.RawMessage `json:"sequence"`
+}
+
+// sequence returns the text of the sequence, unquoted if it is a string
+func (r ReceiptRequest) sequence() string {
+	var s string
+	if err := json.Unmarshal(r.Sequence, &s); err == nil {
+		return s
+	}
+
+	return string(r.Sequence)
+}
+
+// ReceiptResponse is the result of a receipt, Code is the http status of the result
+type ReceiptResponse struct {
+	CrossID string `json:"crossid"`
+	Result  string `json:"result"`
+	Code    int    `json:"code"`
+	Error   string `json:"error,omitempty"`
+}
+
+// parseReceipt validates the fields of the receipt, the sequence is a non negative integer
+func parseReceipt(crossID, receipt, sequence string) (CrossTxReceipt, error) {
+	if crossID == "" {
+		return CrossTxReceipt{}, fmt.Errorf("crossid is required")
+	}
+
+	if receipt == "" {
+		return CrossTxReceipt{}, fmt.Errorf("receipt is required")
+	}
+
+	seq, err := strconv.ParseInt(sequence, 10, 64)
+	if err != nil || seq < 0 {
+		return CrossTxReceipt{}, fmt.Errorf("sequence %q is not a non negative integer", sequence)
+	}
+
+	return CrossTxReceipt{CrossID: crossID, Receipt: receipt, Sequence: seq}, nil
+}
+
+// RecvReceipt deduplicates the receipt by CrossID and sequence, and pushes the accepted one to the executed queue
+func (t *TxManager) RecvReceipt(ctr CrossTxReceipt) (ReceiptResult, error) {
+	t.receiptMu.Lock()
+	defer t.receiptMu.Unlock()
+
+	tx := t.DB.One(CrossIdIndex, ctr.CrossID)
+	if tx == nil {
+		return ReceiptRejected, fmt.Errorf("crossID %s %w", ctr.CrossID, ErrCrossTxNotFound)
+	}
+
+	record := t.DB.GetReceipt(ctr.CrossID)
+	if record == nil {
+		// the txs executed before the receipt log have the accepted receipt in the contract
+		if pc, ok := tx.IContract.(*contractlib.PrecommitContract); ok && pc.Receipt != "" {
+			record = &ReceiptRecord{CrossID: ctr.CrossID, Receipt: pc.Receipt, Sequence: ctr.Sequence}
+		}
+	}
+
+	if record != nil && !record.Parked {
+		switch {
+		case ctr.Sequence < record.Sequence:
+			log.Warn("[TxManager] stale receipt", "crossID", ctr.CrossID, "sequence", ctr.Sequence, "accepted", record.Sequence)
+			return ReceiptStale, fmt.Errorf("sequence %d is lower than the accepted %d", ctr.Sequence, record.Sequence)
+		case ctr.Receipt == record.Receipt:
+			log.Debug("[TxManager] duplicate receipt", "crossID", ctr.CrossID, "sequence", ctr.Sequence)
+			return ReceiptDuplicate, nil
+		default:
+			return ReceiptConflicting, t.flagConflict(record, ctr)
+		}
+	}
+
+	switch tx.GetStatus() {
+	case contractlib.Pending:
+	case contractlib.Init, contractlib.DeadLetter:
+		// the outchain answered before the Init to Pending update, or before the dead letter is requeued
+		if record != nil && ctr.Sequence < record.Sequence {
+			return ReceiptStale, fmt.Errorf("sequence %d is lower than the parked %d", ctr.Sequence, record.Sequence)
+		}
+
+		if err := t.DB.SaveReceipt(&ReceiptRecord{CrossID: ctr.CrossID, Sequence: ctr.Sequence, Receipt: ctr.Receipt, Parked: true}); err != nil {
+			return ReceiptRejected, err
+		}
+
+		log.Info("[TxManager] park receipt", "crossID", ctr.CrossID, "status", tx.GetStatus(), "sequence", ctr.Sequence)
+		return ReceiptParked, nil
+	default:
+		return ReceiptRejected, fmt.Errorf("crossID %s is %s, not %s", ctr.CrossID, tx.GetStatus(), contractlib.Pending)
+	}
+
+	if err := t.DB.SaveReceipt(&ReceiptRecord{CrossID: ctr.CrossID, Sequence: ctr.Sequence, Receipt: ctr.Receipt}); err != nil {
+		return ReceiptRejected, err
+	}
+
+	t.pushReceipts([]CrossTxReceipt{ctr})
+
+	return ReceiptAccepted, nil
+}
+
+func (t *TxManager) flagConflict(record *ReceiptRecord, ctr CrossTxReceipt) error {
+	for _, c := range record.Conflicts {
+		if c.Sequence == ctr.Sequence && c.Receipt == ctr.Receipt {
+			return fmt.Errorf("conflicting receipt already flagged")
+		}
+	}
+
+	record.Conflicts = append(record.Conflicts, ReceiptConflict{
+		Sequence: ctr.Sequence,
+		Receipt:  ctr.Receipt,
+		Time:     time.Now().Unix(),
+	})
+	record.Flagged = true
+
+	if err := t.DB.SaveReceipt(record); err != nil {
+		return err
+	}
+
+	log.Error("[TxManager] conflicting receipt flagged", "crossID", ctr.CrossID, "accepted", record.Receipt, "received", ctr.Receipt, "sequence", ctr.Sequence)
+
+	return fmt.Errorf("receipt conflicts with the accepted one, flagged for an operator")
+}
+
+// releaseParked pushes the parked receipts of the txs now Pending to the executed queue
+func (t *TxManager) releaseParked(crossIDs []string) {
+	t.receiptMu.Lock()
+	defer t.receiptMu.Unlock()
+
+	var released []CrossTxReceipt
+	for _, crossID := range crossIDs {
+		record := t.DB.GetReceipt(crossID)
+		if record == nil || !record.Parked {
+			continue
+		}
+
+		record.Parked = false
+		if err := t.DB.SaveReceipt(record); err != nil {
+			log.Error("[TxManager] release parked receipt", "crossID", crossID, "err", err)
+			continue
+		}
+
+		released = append(released, CrossTxReceipt{CrossID: crossID, Receipt: record.Receipt, Sequence: record.Sequence})
+	}
+
+	if len(released) != 0 {
+		log.Info("[TxManager] release parked receipts", "len(released)", len(released))
+		t.pushReceipts(released)
+	}
+}
+
+func (t *TxManager) pushReceipts(ctrs []CrossTxReceipt) {
+	t.executed.mu.Lock()
+	for _, ctr := range ctrs {
+		t.executed.prq.Push(ctr, -ctr.Sequence)
+	}
+	t.executed.mu.Unlock()
+
+	select {
+	case t.executed.process <- struct{}{}:
+	case <-t.stopCh:
+	}
+}
+
+// ReceiptConflicts returns the receipts flagged with conflicts
+func (t *TxManager) ReceiptConflicts() []*ReceiptRecord {
+	return t.DB.QueryReceipts(q.Eq("Flagged", true))
+}
@@ -0,0 +1,163 @@
+package courier
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/icodezjb/fabric-study/courier/client"
+	"github.com/icodezjb/fabric-study/courier/contractlib"
+)
+
+func TestRecvReceipt(t *testing.T) {
+	store, closeStore := newTestStore(t)
+	defer closeStore()
+
+	if err := store.Save([]*CrossTx{
+		newTestCrossTx("a", contractlib.Pending, ""),
+		newTestCrossTx("b", contractlib.Executed, "receipt-b"),
+		newTestCrossTx("c", contractlib.Aborted, ""),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	txm := NewTxManager(&client.Config{}, &recordFabricClient{}, &client.MockOutChainClient{}, store)
+
+	for i, c := range []struct {
+		ctr    CrossTxReceipt
+		result ReceiptResult
+	}{
+		{CrossTxReceipt{CrossID: "a", Receipt: "receipt-a", Sequence: 2}, ReceiptAccepted},
+		{CrossTxReceipt{CrossID: "a", Receipt: "receipt-a", Sequence: 2}, ReceiptDuplicate},
+		{CrossTxReceipt{CrossID: "a", Receipt: "receipt-a", Sequence: 1}, ReceiptStale},
+		{CrossTxReceipt{CrossID: "a", Receipt: "receipt-x", Sequence: 3}, ReceiptConflicting},
+		{CrossTxReceipt{CrossID: "b", Receipt: "receipt-b", Sequence: 1}, ReceiptDuplicate},
+		{CrossTxReceipt{CrossID: "b", Receipt: "receipt-y", Sequence: 1}, ReceiptConflicting},
+		{CrossTxReceipt{CrossID: "c", Receipt: "receipt-c", Sequence: 1}, ReceiptRejected},
+		{CrossTxReceipt{CrossID: "d", Receipt: "receipt-d", Sequence: 1}, ReceiptRejected},
+	} {
+		if result, _ := txm.RecvReceipt(c.ctr); result != c.result {
+			t.Fatalf("case %d, want: %s, got: %s", i, c.result, result)
+		}
+	}
+
+	// only the first receipt reaches the executed queue
+	if size := txm.executed.prq.Size(); size != 1 {
+		t.Fatalf("executed queue, want: 1, got: %d", size)
+	}
+
+	conflicts := txm.ReceiptConflicts()
+	if len(conflicts) != 2 || conflicts[0].Receipt != "receipt-a" || conflicts[1].Receipt != "receipt-b" {
+		t.Fatalf("conflicts, want: [a b] keeping the accepted receipts, got: %v", conflicts)
+	}
+
+	if pc := store.One(CrossIdIndex, "b").IContract.(*contractlib.PrecommitContract); pc.Receipt != "receipt-b" {
+		t.Fatalf("receipt of b, want: receipt-b, got: %s", pc.Receipt)
+	}
+}
+
+func TestParkedReceipt(t *testing.T) {
+	store, closeStore := newTestStore(t)
+	defer closeStore()
+
+	tx := newTestCrossTx("a", contractlib.Init, "")
+	if err := store.Save([]*CrossTx{tx}); err != nil {
+		t.Fatal(err)
+	}
+
+	txm := NewTxManager(&client.Config{}, &recordFabricClient{}, &client.MockOutChainClient{}, store)
+
+	if result, err := txm.RecvReceipt(CrossTxReceipt{CrossID: "a", Receipt: "receipt-a", Sequence: 1}); result != ReceiptParked {
+		t.Fatalf("want: parked, got: %s, %v", result, err)
+	}
+
+	if !txm.executed.prq.Empty() {
+		t.Fatal("parked receipt reached the executed queue")
+	}
+
+	txm.pending.prq.Push(tx, 0)
+	txm.sendPending()
+
+	if size := txm.executed.prq.Size(); size != 1 {
+		t.Fatalf("executed queue after sent, want: 1, got: %d", size)
+	}
+
+	if result, _ := txm.RecvReceipt(CrossTxReceipt{CrossID: "a", Receipt: "receipt-a", Sequence: 1}); result != ReceiptDuplicate {
+		t.Fatalf("want: duplicate, got: %s", result)
+	}
+}
+
+func TestJSONReceipts(t *testing.T) {
+	store, closeStore := newTestStore(t)
+	defer closeStore()
+
+	if err := store.Save([]*CrossTx{
+		newTestCrossTx("a", contractlib.Pending, ""),
+		newTestCrossTx("b", contractlib.Pending, ""),
+		newTestCrossTx("c", contractlib.Aborted, ""),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	h := &Handler{stopCh: make(chan struct{}), pipelines: []*Pipeline{{
+		PipelineConfig: client.PipelineConfig{ChannelID: "mychannel", ChainCodeID: "mycc"},
+		txm:            NewTxManager(&client.Config{}, &recordFabricClient{}, &client.MockOutChainClient{}, store),
+	}}}
+
+	post := func(contentType, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/v1/receipt", strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := post("application/json", `{"crossid":"a","receipt":"receipt-a","sequence":1}`)
+	var one ReceiptResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &one); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusOK || one.CrossID != "a" || one.Result != "accepted" || one.Code != http.StatusOK {
+		t.Fatalf("single receipt, got: %d %+v", rec.Code, one)
+	}
+
+	rec = post("application/json", `[
+		{"crossid":"a","receipt":"receipt-a","sequence":1},
+		{"crossid":"b","receipt":"receipt-b","sequence":"x"},
+		{"crossid":"b","receipt":"","sequence":1},
+		{"crossid":"c","receipt":"receipt-c","sequence":1},
+		{"crossid":"d","receipt":"receipt-d","sequence":1},
+		{"crossid":"a","receipt":"receipt-a","sequence":0},
+		{"crossid":"b","receipt":"receipt-b","sequence":2}
+	]`)
+	if rec.Code != http.StatusMultiStatus {
+		t.Fatalf("batch, want: 207, got: %d %s", rec.Code, rec.Body)
+	}
+
+	var batch []ReceiptResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &batch); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, r := range batch {
+		got = append(got, fmt.Sprintf("%s %s %d", r.CrossID, r.Result, r.Code))
+	}
+	want := []string{"a duplicate 200", "b invalid 400", "b invalid 400", "c rejected 422", "d rejected 404", "a stale 409", "b accepted 200"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("batch, want: %v, got: %v", want, got)
+	}
+
+	for _, body := range []string{`{"crossid":`, `[]`, `"a"`} {
+		if rec := post("application/json", body); rec.Code != http.StatusBadRequest {
+			t.Fatalf("body %s, want: 400, got: %d", body, rec.Code)
+		}
+	}
+
+	if rec := post("application/x-www-form-urlencoded", "crossid=b&receipt=receipt-b&sequence=abc"); rec.Code != http.StatusBadRequest {
+		t.Fatalf("form with non numeric sequence, want: 400, got: %d", rec.Code)
+	}
+}
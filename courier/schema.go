@@ -0,0 +1,225 @@
+package courier
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/icodezjb/fabric-study/courier/client"
+	"github.com/icodezjb/fabric-study/log"
+
+	"github.com/asdine/storm/v3"
+	bolt "go.etcd.io/bbolt"
+)
+
+// SchemaVersion is the version of the database and of the CrossTx records,
+// version 1 is the schema before the versioning
+//
+// 2: the CrossTx records have the Version and the ContractType
+const SchemaVersion = 2
+
+// ErrNewerSchema refuses the databases and the records written by a newer courier
+var ErrNewerSchema = errors.New("newer schema")
+
+const (
+	metaBucket = "meta"
+	schemaKey  = "schema"
+)
+
+// legacyChannel is the bucket of the layout before the pipelines, the CrossTxs and the config
+// of the only chaincode were saved in it directly
+const legacyChannel = "mychannel"
+
+var legacyBuckets = []string{"CrossTx", "config"}
+
+// ErrLegacyLayout refuses the database of the layout before the pipelines which can not be moved to a pipeline
+var ErrLegacyLayout = errors.New("legacy single-channel layout")
+
+// migration upgrades the database to its version, in one transaction with the schema version
+type migration struct {
+	version int
+	name    string
+	up      func(tx storm.Node, pipelines []client.PipelineConfig) error
+}
+
+var migrations = []migration{
+	{version: 2, name: "version the CrossTx records and save their contract type", up: stampCrossTxs},
+}
+
+// migrate upgrades the storm database to SchemaVersion, it refuses the database of a newer schema.
+// The unversioned database of the layout before the pipelines is moved to the default pipeline first
+func migrate(root *storm.DB, defaultPipeline *client.PipelineConfig) error {
+	version, err := schemaVersion(root)
+	if err != nil {
+		return err
+	}
+
+	if version > SchemaVersion {
+		return fmt.Errorf("db schema version %d, supported %d, upgrade courier: %w", version, SchemaVersion, ErrNewerSchema)
+	}
+
+	if version < 2 {
+		if err = moveLegacyLayout(root, defaultPipeline); err != nil {
+			return err
+		}
+	}
+
+	for _, m := range migrations {
+		if m.version <= version {
+			continue
+		}
+
+		log.Info("[Store] migrate db schema", "from", version, "to", m.version, "migration", m.name)
+		err = root.Bolt.Update(func(tx *bolt.Tx) error {
+			node := root.WithTransaction(tx)
+			if err := m.up(node, pipelineBuckets(tx, "CrossTx")); err != nil {
+				return err
+			}
+
+			return node.Set(metaBucket, schemaKey, m.version)
+		})
+		if err != nil {
+			return fmt.Errorf("db migration to version %d (%s): %w", m.version, m.name, err)
+		}
+
+		version = m.version
+	}
+
+	return nil
+}
+
+// moveLegacyLayout moves the buckets of the layout before the pipelines into the bucket of the pipeline,
+// it refuses to overwrite the buckets of the pipeline
+func moveLegacyLayout(root *storm.DB, p *client.PipelineConfig) error {
+	return root.Bolt.Update(func(tx *bolt.Tx) error {
+		channel := tx.Bucket([]byte(legacyChannel))
+		if channel == nil {
+			return nil
+		}
+
+		var found []string
+		for _, name := range legacyBuckets {
+			if channel.Bucket([]byte(name)) != nil {
+				found = append(found, name)
+			}
+		}
+		if len(found) == 0 {
+			return nil
+		}
+
+		if p == nil {
+			return fmt.Errorf("bucket %s has %v, no pipeline to move them to: %w", legacyChannel, found, ErrLegacyLayout)
+		}
+
+		dstChannel, err := tx.CreateBucketIfNotExists([]byte(p.ChannelID))
+		if err != nil {
+			return err
+		}
+		dst, err := dstChannel.CreateBucketIfNotExists([]byte(p.ChainCodeID))
+		if err != nil {
+			return err
+		}
+
+		for _, name := range found {
+			if dst.Bucket([]byte(name)) != nil {
+				return fmt.Errorf("pipeline %s has the %s bucket already, can not move %s/%s into it: %w", p.ID(), name, legacyChannel, name, ErrLegacyLayout)
+			}
+
+			b, err := dst.CreateBucket([]byte(name))
+			if err != nil {
+				return err
+			}
+			// the channel bucket is the destination channel too if they are the same
+			src := tx.Bucket([]byte(legacyChannel))
+			if err = copyBucket(b, src.Bucket([]byte(name))); err != nil {
+				return fmt.Errorf("move %s/%s: %w", legacyChannel, name, err)
+			}
+			if err = src.DeleteBucket([]byte(name)); err != nil {
+				return err
+			}
+		}
+
+		log.Info("[Store] moved the layout before the pipelines", "from", legacyChannel, "to", p.ID(), "buckets", found)
+		return nil
+	})
+}
+
+// copyBucket copies the keys, the nested buckets and the sequence of the bucket
+func copyBucket(dst, src *bolt.Bucket) error {
+	if err := dst.SetSequence(src.Sequence()); err != nil {
+		return err
+	}
+
+	return src.ForEach(func(k, v []byte) error {
+		if v != nil {
+			return dst.Put(k, v)
+		}
+
+		child, err := dst.CreateBucket(k)
+		if err != nil {
+			return err
+		}
+		return copyBucket(child, src.Bucket(k))
+	})
+}
+
+// schemaVersion returns the schema version of the database, 1 if it is not versioned
+func schemaVersion(root storm.Node) (int, error) {
+	var version int
+	if err := root.Get(metaBucket, schemaKey, &version); err == storm.ErrNotFound {
+		return 1, nil
+	} else if err != nil {
+		return 0, fmt.Errorf("db schema version: %w", err)
+	}
+
+	return version, nil
+}
+
+// pipelineBuckets returns the pipelines which have any of the buckets in the database, e.g. the CrossTx bucket
+func pipelineBuckets(tx *bolt.Tx, buckets ...string) (pipelines []client.PipelineConfig) {
+	_ = tx.ForEach(func(channel []byte, b *bolt.Bucket) error {
+		return b.ForEach(func(chaincode, v []byte) error {
+			if v != nil {
+				return nil
+			}
+
+			for _, name := range buckets {
+				if b.Bucket(chaincode).Bucket([]byte(name)) != nil {
+					pipelines = append(pipelines, client.PipelineConfig{ChannelID: string(channel), ChainCodeID: string(chaincode)})
+					return nil
+				}
+			}
+			return nil
+		})
+	})
+
+	return pipelines
+}
+
+// stampCrossTxs saves the version 1 CrossTx records with the schema version and their contract type
+func stampCrossTxs(tx storm.Node, pipelines []client.PipelineConfig) error {
+	for _, p := range pipelines {
+		node := tx.From(p.ChannelID, p.ChainCodeID)
+
+		var old []*CrossTx
+		err := node.Select().Each(new(CrossTx), func(record interface{}) error {
+			if c := record.(*CrossTx); c.Version < SchemaVersion {
+				old = append(old, c)
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("pipeline %s: %w", p.ID(), err)
+		}
+
+		for _, c := range old {
+			c.stamp()
+			if err = node.Save(c); err != nil {
+				return fmt.Errorf("pipeline %s crossTx %s: %w", p.ID(), c.CrossID, err)
+			}
+		}
+
+		log.Info("[Store] stamped crossTx records", "pipeline", p.ID(), "count", len(old))
+	}
+
+	return nil
+}
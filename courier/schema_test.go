@@ -0,0 +1,249 @@
+package courier
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/icodezjb/fabric-study/courier/client"
+	"github.com/icodezjb/fabric-study/courier/contractlib"
+
+	"github.com/asdine/storm/v3"
+	bolt "go.etcd.io/bbolt"
+)
+
+// downgrade rewrites the CrossTx records in the bucket as version 1 records and unversions the database
+func downgrade(t *testing.T, dir string, bucket ...string) {
+	db, err := bolt.Open(dir+"/rootdb", 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket[0]))
+		for _, name := range bucket[1:] {
+			b = b.Bucket([]byte(name))
+		}
+
+		records := make(map[string][]byte)
+		if err := b.ForEach(func(k, v []byte) error {
+			if v == nil {
+				return nil
+			}
+
+			var record map[string]json.RawMessage
+			if err := json.Unmarshal(v, &record); err != nil {
+				return err
+			}
+			for _, key := range []string{"Version", "ContractType", "History", "Notes", "Attempts"} {
+				delete(record, key)
+			}
+
+			raw, err := json.Marshal(record)
+			records[string(k)] = raw
+			return err
+		}); err != nil {
+			return err
+		}
+
+		for k, v := range records {
+			if err := b.Put([]byte(k), v); err != nil {
+				return err
+			}
+		}
+
+		if err := tx.DeleteBucket([]byte(metaBucket)); err != bolt.ErrBucketNotFound {
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrateStormDB(t *testing.T) {
+	dir, err := ioutil.TempDir("", "courier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	root, err := OpenStormDB(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version, err := schemaVersion(root); err != nil || version != SchemaVersion {
+		t.Fatalf("new db schema version, want: %d, got: %d %v", SchemaVersion, version, err)
+	}
+
+	store, err := NewStore(root, "mychannel", "mycc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Save([]*CrossTx{newTestCrossTx("a", contractlib.Init, ""), newTestCrossTx("b", contractlib.Pending, "")}); err != nil {
+		t.Fatal(err)
+	}
+	root.Close()
+
+	downgrade(t, dir, "mychannel", "mycc", "CrossTx")
+
+	root, err = OpenStormDB(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err = NewStore(root, "mychannel", "mycc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	txs := store.Query(0, 0, nil, false)
+	if len(txs) != 2 {
+		t.Fatalf("migrated crossTxs, want: 2, got: %d", len(txs))
+	}
+	for _, tx := range txs {
+		if tx.Version != SchemaVersion || tx.ContractType != contractlib.PrecommitType || len(tx.History) != 0 {
+			t.Fatalf("migrated crossTx, got: %+v", tx)
+		}
+	}
+	if got := store.One(CrossIdIndex, "b"); got == nil || got.GetStatus() != contractlib.Pending {
+		t.Fatalf("migrated crossTx b, got: %+v", got)
+	}
+
+	// a newer courier wrote the database
+	if err := root.Set(metaBucket, schemaKey, SchemaVersion+1); err != nil {
+		t.Fatal(err)
+	}
+	root.Close()
+
+	if _, err := OpenStormDB(dir, nil); !errors.Is(err, ErrNewerSchema) {
+		t.Fatalf("want ErrNewerSchema, got: %v", err)
+	}
+}
+
+func TestMigrateLegacyLayout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "courier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the layout before the pipelines, the only chaincode in the mychannel bucket
+	root, err := storm.Open(filepath.Join(dir, "rootdb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	node := root.From("mychannel")
+	for _, tx := range []*CrossTx{newTestCrossTx("a", contractlib.Init, ""), newTestCrossTx("b", contractlib.Pending, "")} {
+		if err = node.Save(tx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = node.Set("config", "number", uint64(42)); err != nil {
+		t.Fatal(err)
+	}
+	root.Close()
+
+	downgrade(t, dir, "mychannel", "CrossTx")
+
+	// the runner does not skip the legacy buckets without a pipeline to move them to
+	if _, err = OpenStormDB(dir, nil); !errors.Is(err, ErrLegacyLayout) {
+		t.Fatalf("want ErrLegacyLayout, got: %v", err)
+	}
+
+	pipeline := &client.PipelineConfig{ChannelID: "mychannel", ChainCodeID: "mycc"}
+	root, err = OpenStormDB(dir, pipeline)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer root.Close()
+
+	store, err := NewStore(root, "mychannel", "mycc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := store.Get("number"); n != 42 {
+		t.Fatalf("moved checkpoint, want: 42, got: %d", n)
+	}
+	txs := store.Query(0, 0, nil, false)
+	if len(txs) != 2 {
+		t.Fatalf("moved crossTxs, want: 2, got: %d", len(txs))
+	}
+	for _, tx := range txs {
+		if tx.Version != SchemaVersion || tx.ContractType != contractlib.PrecommitType {
+			t.Fatalf("moved crossTx is not stamped, got: %+v", tx)
+		}
+	}
+	if b := store.One(CrossIdIndex, "b"); b == nil || b.GetStatus() != contractlib.Pending {
+		t.Fatalf("moved crossTx b, got: %+v", b)
+	}
+
+	// the primary keys go on after the moved ones
+	if err = store.Save([]*CrossTx{newTestCrossTx("c", contractlib.Init, "")}); err != nil {
+		t.Fatal(err)
+	}
+	if c := store.One(CrossIdIndex, "c"); c == nil || c.PK != 3 {
+		t.Fatalf("new crossTx, want PK: 3, got: %+v", c)
+	}
+
+	err = root.Bolt.View(func(tx *bolt.Tx) error {
+		for _, name := range legacyBuckets {
+			if tx.Bucket([]byte("mychannel")).Bucket([]byte(name)) != nil {
+				t.Fatalf("legacy bucket %s is left", name)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDecodeCrossTxRecord(t *testing.T) {
+	cases := []struct {
+		name string
+		raw  string
+		err  string
+	}{
+		{name: "not an object", raw: `[]`, err: "crossTx record"},
+		{name: "no CrossID", raw: `{"IContract":{"status":"Init"}}`, err: "missing field CrossID"},
+		{name: "no contract", raw: `{"CrossID":"a"}`, err: "crossTx a record missing field IContract"},
+		{name: "null contract", raw: `{"CrossID":"a","IContract":null}`, err: "missing field IContract"},
+		{name: "bad field", raw: `{"CrossID":"a","BlockNumber":"x","IContract":{"status":"Init"}}`, err: "field BlockNumber"},
+		{name: "bad status", raw: `{"CrossID":"a","IContract":{"status":"Nope"}}`, err: "field IContract"},
+		{name: "unknown type", raw: `{"CrossID":"a","Version":2,"ContractType":"escrow","IContract":{"status":"Init"}}`, err: "unsupport contract type"},
+		{name: "newer", raw: `{"CrossID":"a","Version":3,"IContract":{"status":"Init"}}`, err: ErrNewerSchema.Error()},
+	}
+
+	for _, c := range cases {
+		var tx CrossTx
+		err := json.Unmarshal([]byte(c.raw), &tx)
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Fatalf("%s, want error: %s, got: %v", c.name, c.err, err)
+		}
+	}
+
+	var legacy CrossTx
+	if err := json.Unmarshal([]byte(`{"CrossID":"a","IContract":{"status":"Pending","contract_id":"a"}}`), &legacy); err != nil {
+		t.Fatal(err)
+	}
+	if legacy.Version != 1 || contractlib.TypeOf(legacy.IContract) != contractlib.PrecommitType || legacy.GetStatus() != contractlib.Pending {
+		t.Fatalf("version 1 record, got: %+v", legacy)
+	}
+
+	// the saved contract type is kept, it is not inferred from the status
+	var typed CrossTx
+	if err := json.Unmarshal([]byte(`{"CrossID":"a","Version":2,"ContractType":"commit","IContract":{"status":"Pending"}}`), &typed); err != nil {
+		t.Fatal(err)
+	}
+	if contractlib.TypeOf(typed.IContract) != contractlib.CommitType {
+		t.Fatalf("typed record, got: %T", typed.IContract)
+	}
+}
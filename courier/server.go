@@ -1,25 +1,38 @@
 package courier
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/icodezjb/fabric-study/log"
 )
 
+// shutdownTimeout bounds the wait for the active requests at shutdown
+const shutdownTimeout = 10 * time.Second
+
 type Server struct {
 	server *http.Server
 }
 
-func NewServer(endPoint string, h *Handler) *Server {
+// NewServer returns the server of the handler, it serves https if the tls config is set
+func NewServer(endPoint string, h *Handler, tlsConfig *tls.Config) *Server {
 	s := &Server{}
 
 	s.server = &http.Server{
-		Addr:    endPoint,
-		Handler: h,
+		Addr:      endPoint,
+		Handler:   h,
+		TLSConfig: tlsConfig,
+	}
+
+	scheme := "http://"
+	if tlsConfig != nil {
+		scheme = "https://"
 	}
 
-	log.Info("[Server] http server to listen", "endPoint", "http://"+endPoint)
+	log.Info("[Server] http server to listen", "endPoint", scheme+endPoint, "mTLS", tlsConfig != nil && tlsConfig.ClientCAs != nil)
 	return s
 }
 
@@ -29,7 +42,13 @@ func (s *Server) Start() {
 }
 
 func (s *Server) serve() {
-	err := s.server.ListenAndServe()
+	var err error
+	if s.server.TLSConfig != nil {
+		// the certificate is in the tls config
+		err = s.server.ListenAndServeTLS("", "")
+	} else {
+		err = s.server.ListenAndServe()
+	}
 	if err != nil {
 		log.Info(fmt.Sprintf("[Server] %s", err))
 	}
@@ -38,7 +57,10 @@ func (s *Server) serve() {
 
 func (s *Server) Stop() {
 	log.Info("[Server] http server stopping")
-	if err := s.server.Shutdown(nil); err != nil {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if err := s.server.Shutdown(ctx); err != nil {
 		log.Error("[Server] shutdown", "err", err)
 	}
 }
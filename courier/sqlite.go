@@ -0,0 +1,899 @@
+package courier
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/icodezjb/fabric-study/courier/client"
+	"github.com/icodezjb/fabric-study/courier/contractlib"
+	"github.com/icodezjb/fabric-study/log"
+
+	"github.com/asdine/storm/v3/q"
+	// the pure Go sqlite driver, courier builds without cgo
+	"modernc.org/sqlite"
+)
+
+// sqliteSchema keeps the records as JSON with the indexed fields in columns, the CrossTxs, receipts, invalid precommits,
+// audit records, transitions and config keys of all the pipelines are in one table each, keyed by the pipeline ID
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS crosstx (
+	pk           INTEGER PRIMARY KEY AUTOINCREMENT,
+	pipeline     TEXT NOT NULL,
+	cross_id     TEXT NOT NULL,
+	tx_id        TEXT NOT NULL,
+	block_number INTEGER NOT NULL,
+	ts_seconds   INTEGER NOT NULL,
+	ts_nanos     INTEGER NOT NULL,
+	status       TEXT NOT NULL,
+	data         TEXT NOT NULL,
+	UNIQUE (pipeline, cross_id)
+);
+CREATE INDEX IF NOT EXISTS crosstx_tx_id ON crosstx (pipeline, tx_id);
+CREATE INDEX IF NOT EXISTS crosstx_block_number ON crosstx (pipeline, block_number);
+CREATE INDEX IF NOT EXISTS crosstx_status ON crosstx (pipeline, status);
+
+CREATE TABLE IF NOT EXISTS config (
+	pipeline TEXT NOT NULL,
+	key      TEXT NOT NULL,
+	value    INTEGER NOT NULL,
+	PRIMARY KEY (pipeline, key)
+);
+
+CREATE TABLE IF NOT EXISTS receipt (
+	pipeline TEXT NOT NULL,
+	cross_id TEXT NOT NULL,
+	data     TEXT NOT NULL,
+	PRIMARY KEY (pipeline, cross_id)
+);
+
+CREATE TABLE IF NOT EXISTS invalid_precommit (
+	pipeline     TEXT NOT NULL,
+	id           TEXT NOT NULL,
+	cross_id     TEXT NOT NULL,
+	block_number INTEGER NOT NULL,
+	data         TEXT NOT NULL,
+	PRIMARY KEY (pipeline, id)
+);
+
+CREATE TABLE IF NOT EXISTS audit (
+	id       INTEGER PRIMARY KEY AUTOINCREMENT,
+	pipeline TEXT NOT NULL,
+	cross_id TEXT NOT NULL,
+	action   TEXT NOT NULL,
+	data     TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS transition (
+	id          INTEGER PRIMARY KEY AUTOINCREMENT,
+	pipeline    TEXT NOT NULL,
+	cross_id    TEXT NOT NULL,
+	from_status TEXT NOT NULL,
+	to_status   TEXT NOT NULL,
+	time        INTEGER NOT NULL,
+	reason      TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS transition_pipeline ON transition (pipeline, id);
+`
+
+// sqliteColumns are the columns of the CrossTx fields Query can order by and One can look up
+var sqliteColumns = map[FieldName][]string{
+	PK:             {"pk"},
+	CrossIdIndex:   {"cross_id"},
+	"TxID":         {"tx_id"},
+	"BlockNumber":  {"block_number"},
+	TimestampField: {"ts_seconds", "ts_nanos"},
+}
+
+// OpenSQLiteDB opens the sqlite database of all the pipelines in the data directory
+func OpenSQLiteDB(dataDir string) (*sql.DB, error) {
+	var workDir = os.TempDir()
+
+	if dataDir != "" {
+		workDir = dataDir
+	}
+
+	db := sql.OpenDB(pragmaConnector{name: filepath.Join(workDir, "courier.sqlite")})
+
+	// sqlite has one writer, the writes queue on the connection instead of failing busy
+	db.SetMaxOpenConns(1)
+
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("sqlite schema version err: %w", err)
+	}
+
+	if version > SchemaVersion {
+		db.Close()
+		return nil, fmt.Errorf("db schema version %d, supported %d, upgrade courier: %w", version, SchemaVersion, ErrNewerSchema)
+	}
+
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("sqlite schema err: %w", err)
+	}
+
+	// the first sqlite databases were created with user_version 0 and unstamped records,
+	// they are stamped as the storm migration does
+	if version < SchemaVersion {
+		if err := stampSQLCrossTxs(db); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("sqlite migrate err: %w", err)
+		}
+	}
+
+	return db, nil
+}
+
+// sqlitePragmas wait for the other processes, e.g. the analysts, and let them read while courier writes
+const sqlitePragmas = "PRAGMA busy_timeout = 5000; PRAGMA journal_mode = WAL;"
+
+// pragmaConnector runs sqlitePragmas on every connection it opens, database/sql replaces the connection
+// after an error or an idle close, and this sqlite driver does not take the pragmas from the DSN
+type pragmaConnector struct {
+	name string
+}
+
+func (c pragmaConnector) Connect(context.Context) (driver.Conn, error) {
+	conn, err := c.Driver().Open(c.name)
+	if err != nil {
+		return nil, err
+	}
+
+	execer, ok := conn.(driver.Execer)
+	if !ok {
+		conn.Close()
+		return nil, fmt.Errorf("sqlite pragma err: the connection does not exec")
+	}
+
+	if _, err = execer.Exec(sqlitePragmas, nil); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("sqlite pragma err: %w", err)
+	}
+
+	return conn, nil
+}
+
+func (c pragmaConnector) Driver() driver.Driver {
+	return &sqlite.Driver{}
+}
+
+// stampSQLCrossTxs stamps the CrossTx records of all the pipelines older than SchemaVersion,
+// and sets the schema version in the same transaction
+func stampSQLCrossTxs(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("SELECT pk, data FROM crosstx")
+	if err != nil {
+		return err
+	}
+
+	var old []*CrossTx
+	for rows.Next() {
+		var pk int64
+		var data string
+		if err = rows.Scan(&pk, &data); err != nil {
+			rows.Close()
+			return err
+		}
+
+		c, err := decodeCrossTx(pk, data)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		if c.Version < SchemaVersion {
+			old = append(old, c)
+		}
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return err
+	}
+
+	for _, c := range old {
+		if err = updateRow(tx, c); err != nil {
+			return fmt.Errorf("crossTx %s: %w", c.CrossID, err)
+		}
+	}
+
+	if _, err = tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", SchemaVersion)); err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	log.Info("[SQLStore] stamped crossTx records", "count", len(old), "version", SchemaVersion)
+	return nil
+}
+
+type sqliteBackend struct {
+	db *sql.DB
+}
+
+func (b sqliteBackend) Open(channelID, chaincodeID string) (DB, error) {
+	return NewSQLStore(b.db, channelID, chaincodeID)
+}
+
+func (b sqliteBackend) Pipelines() ([]client.PipelineConfig, error) {
+	rows, err := b.db.Query("SELECT pipeline FROM crosstx UNION SELECT pipeline FROM config ORDER BY pipeline")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var pipelines []client.PipelineConfig
+	for rows.Next() {
+		var id string
+		if err = rows.Scan(&id); err != nil {
+			return nil, err
+		}
+
+		p, err := client.ParsePipelineID(id)
+		if err != nil {
+			return nil, err
+		}
+		pipelines = append(pipelines, p)
+	}
+
+	return pipelines, rows.Err()
+}
+
+func (b sqliteBackend) Close() error {
+	return b.db.Close()
+}
+
+// SQLStore is the DB of a pipeline in sqlite, the records are in the rows of its pipeline ID
+type SQLStore struct {
+	db       *sql.DB
+	pipeline string
+
+	// mu orders the publishing of the transitions as their commits
+	mu  sync.Mutex
+	bus *TransitionBus
+}
+
+// NewSQLStore returns the store of a pipeline in the sqlite database
+func NewSQLStore(db *sql.DB, channelID, chaincodeID string) (*SQLStore, error) {
+	if channelID == "" || chaincodeID == "" {
+		return nil, fmt.Errorf("store needs the channel and chaincode")
+	}
+
+	return &SQLStore{
+		db:       db,
+		pipeline: channelID + "/" + chaincodeID,
+		bus:      NewTransitionBus(),
+	}, nil
+}
+
+// sqlQuerier is the sql.DB or the sql.Tx the records are read with
+type sqlQuerier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func statusText(status contractlib.CStatus) string {
+	if status == 0 {
+		return ""
+	}
+
+	return status.String()
+}
+
+func (s *SQLStore) Set(key string, value uint64) error {
+	_, err := s.db.Exec("INSERT OR REPLACE INTO config (pipeline, key, value) VALUES (?, ?, ?)", s.pipeline, key, int64(value))
+	return err
+}
+
+func (s *SQLStore) Get(key string) uint64 {
+	var value int64
+	if err := s.db.QueryRow("SELECT value FROM config WHERE pipeline = ? AND key = ?", s.pipeline, key).Scan(&value); err != nil {
+		return 0
+	}
+
+	return uint64(value)
+}
+
+func (s *SQLStore) Save(txList []*CrossTx) error {
+	log.Debug("[SQLStore] to save cross txs", "len(txList)", len(txList))
+
+	return s.write(func(tx *sql.Tx) ([]*TransitionEvent, error) {
+		return s.save(tx, txList)
+	})
+}
+
+func (s *SQLStore) SaveBlock(number uint64, txList []*CrossTx, updates []*CrossTxUpdate, invalids []*InvalidPrecommit) error {
+	log.Debug("[SQLStore] to save block", "blockNumber", number, "len(txList)", len(txList), "len(updates)", len(updates), "len(invalids)", len(invalids))
+
+	return s.write(func(tx *sql.Tx) ([]*TransitionEvent, error) {
+		events, err := s.save(tx, txList)
+		if err != nil {
+			return nil, err
+		}
+
+		updated, err := s.applyUpdates(tx, updates)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, updated...)
+
+		for _, inv := range invalids {
+			data, err := json.Marshal(inv)
+			if err != nil {
+				return nil, err
+			}
+			if _, err = tx.Exec("INSERT OR REPLACE INTO invalid_precommit (pipeline, id, cross_id, block_number, data) VALUES (?, ?, ?, ?, ?)",
+				s.pipeline, inv.ID, inv.CrossID, int64(inv.BlockNumber), string(data)); err != nil {
+				return nil, fmt.Errorf("db save invalid precommit err: %w", err)
+			}
+		}
+
+		if _, err = tx.Exec("INSERT OR REPLACE INTO config (pipeline, key, value) VALUES (?, 'number', ?)", s.pipeline, int64(number+1)); err != nil {
+			return nil, fmt.Errorf("db set checkpoint err: %w", err)
+		}
+
+		return events, nil
+	})
+}
+
+// write runs fn in a transaction and publishes the transitions it logged after the commit
+func (s *SQLStore) write(fn func(tx *sql.Tx) ([]*TransitionEvent, error)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("db begin err: %w", err)
+	}
+	defer tx.Rollback()
+
+	events, err := fn(tx)
+	if err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	s.bus.Publish(events)
+	return nil
+}
+
+// save has the semantics of the storm save, the new CrossTxs are inserted and the stored ones are skipped
+func (s *SQLStore) save(tx *sql.Tx, txList []*CrossTx) (events []*TransitionEvent, err error) {
+	for _, newTx := range txList {
+		if _, err = s.one(tx, "cross_id", newTx.CrossID); err != sql.ErrNoRows {
+			log.Warn("[SQLStore] duplicate crossTx", "crossID", newTx.CrossID, "new.status", newTx.GetStatus(), "err", err)
+			continue
+		}
+
+		initCrossTx(newTx)
+		if err = s.insert(tx, newTx); err != nil {
+			return nil, fmt.Errorf("db save err: %w", err)
+		}
+
+		logged, err := s.logTransitions(tx, newTx, 0)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, logged...)
+	}
+
+	return events, nil
+}
+
+// applyUpdates has the semantics of the storm applyUpdates
+func (s *SQLStore) applyUpdates(tx *sql.Tx, updates []*CrossTxUpdate) (events []*TransitionEvent, err error) {
+	for _, u := range updates {
+		oldTx, err := s.one(tx, "cross_id", u.CrossID)
+		if err != nil {
+			log.Warn("[SQLStore] update of unknown crossTx", "crossID", u.CrossID, "txId", u.TxID, "blockNumber", u.BlockNumber, "err", err)
+			continue
+		}
+
+		n := len(oldTx.History)
+		if !updateCrossTx(oldTx, u) {
+			continue
+		}
+		if err = updateRow(tx, oldTx); err != nil {
+			return nil, fmt.Errorf("db update err: %w", err)
+		}
+
+		logged, err := s.logTransitions(tx, oldTx, n)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, logged...)
+	}
+
+	return events, nil
+}
+
+func (s *SQLStore) insert(tx sqlQuerier, c *CrossTx) error {
+	c.stamp()
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	var seconds, nanos int64
+	if c.TimeStamp != nil {
+		seconds, nanos = c.TimeStamp.Seconds, int64(c.TimeStamp.Nanos)
+	}
+
+	result, err := tx.Exec("INSERT INTO crosstx (pipeline, cross_id, tx_id, block_number, ts_seconds, ts_nanos, status, data) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		s.pipeline, c.CrossID, c.TxID, int64(c.BlockNumber), seconds, nanos, statusText(c.GetStatus()), string(data))
+	if err != nil {
+		return err
+	}
+
+	c.PK, err = result.LastInsertId()
+	return err
+}
+
+// updateRow saves the changed CrossTx to its row, the columns are kept in sync with the record
+func updateRow(tx sqlQuerier, c *CrossTx) error {
+	c.stamp()
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	var seconds, nanos int64
+	if c.TimeStamp != nil {
+		seconds, nanos = c.TimeStamp.Seconds, int64(c.TimeStamp.Nanos)
+	}
+
+	_, err = tx.Exec("UPDATE crosstx SET tx_id = ?, block_number = ?, ts_seconds = ?, ts_nanos = ?, status = ?, data = ? WHERE pk = ?",
+		c.TxID, int64(c.BlockNumber), seconds, nanos, statusText(c.GetStatus()), string(data), c.PK)
+	return err
+}
+
+func (s *SQLStore) logTransitions(tx sqlQuerier, c *CrossTx, n int) ([]*TransitionEvent, error) {
+	events := newTransitions(c, n)
+	for _, ev := range events {
+		result, err := tx.Exec("INSERT INTO transition (pipeline, cross_id, from_status, to_status, time, reason) VALUES (?, ?, ?, ?, ?, ?)",
+			s.pipeline, ev.CrossID, statusText(ev.From), statusText(ev.To), ev.Time, ev.Reason)
+		if err != nil {
+			return nil, fmt.Errorf("db save transition err: %w", err)
+		}
+
+		id, err := result.LastInsertId()
+		if err != nil {
+			return nil, err
+		}
+		ev.ID = uint64(id)
+	}
+
+	return events, nil
+}
+
+// one returns the CrossTx of the column value, sql.ErrNoRows if none
+func (s *SQLStore) one(tx sqlQuerier, column string, value interface{}) (*CrossTx, error) {
+	var pk int64
+	var data string
+	if err := tx.QueryRow("SELECT pk, data FROM crosstx WHERE pipeline = ? AND "+column+" = ? ORDER BY pk LIMIT 1", s.pipeline, value).Scan(&pk, &data); err != nil {
+		return nil, err
+	}
+
+	return decodeCrossTx(pk, data)
+}
+
+func decodeCrossTx(pk int64, data string) (*CrossTx, error) {
+	var c CrossTx
+	if err := json.Unmarshal([]byte(data), &c); err != nil {
+		return nil, fmt.Errorf("decode crossTx %d err: %w", pk, err)
+	}
+	c.PK = pk
+
+	return &c, nil
+}
+
+func (s *SQLStore) One(fieldName string, value interface{}) *CrossTx {
+	columns, ok := sqliteColumns[fieldName]
+	if !ok || len(columns) != 1 {
+		// the fields without column are matched on the decoded CrossTxs
+		if txs := s.Query(1, 1, nil, false, q.Eq(fieldName, value)); len(txs) > 0 {
+			return txs[0]
+		}
+		return nil
+	}
+
+	c, err := s.one(s.db, columns[0], value)
+	if err != nil {
+		return nil
+	}
+
+	return c
+}
+
+// Updates applies the updaters to the CrossTxs in one transaction,
+// a CrossTx whose updater returns an error, e.g. an illegal transition, is left unchanged
+func (s *SQLStore) Updates(idList []string, updaters []func(c *CrossTx) error) error {
+	if len(idList) != len(updaters) {
+		return fmt.Errorf("invalid update params")
+	}
+
+	log.Debug("[SQLStore] update list", "idList", idList)
+
+	rejected := make(UpdateErrors)
+	err := s.write(func(tx *sql.Tx) ([]*TransitionEvent, error) {
+		var events []*TransitionEvent
+		for i, id := range idList {
+			c, err := s.one(tx, "cross_id", id)
+			if err == sql.ErrNoRows {
+				return nil, fmt.Errorf("db query err: crossID %s %w", id, ErrCrossTxNotFound)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("db query err: %w", err)
+			}
+
+			n := len(c.History)
+			if err = updaters[i](c); err != nil {
+				log.Error("[SQLStore] reject update", "crossID", id, "err", err)
+				rejected[id] = err
+				continue
+			}
+
+			if err = updateRow(tx, c); err != nil {
+				return nil, fmt.Errorf("db update err: %w", err)
+			}
+
+			logged, err := s.logTransitions(tx, c, n)
+			if err != nil {
+				return nil, err
+			}
+			events = append(events, logged...)
+		}
+
+		return events, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(rejected) != 0 {
+		return rejected
+	}
+	return nil
+}
+
+// Query orders the CrossTxs in sql, and matches the filters on the decoded CrossTxs as storm does,
+// the fields without column can not be ordered by and return nothing
+func (s *SQLStore) Query(pageSize int, startPage int, orderBy []FieldName, reverse bool, filter ...q.Matcher) (crossTxs []*CrossTx) {
+	if pageSize > 0 && startPage <= 0 {
+		return nil
+	}
+
+	direction := ""
+	if reverse {
+		direction = " DESC"
+	}
+
+	var order []string
+	for _, field := range append(append([]FieldName(nil), orderBy...), PK) {
+		columns, ok := sqliteColumns[field]
+		if !ok {
+			log.Warn("[SQLStore] order by unknown field", "field", field)
+			return nil
+		}
+		for _, column := range columns {
+			order = append(order, column+direction)
+		}
+	}
+
+	skip := 0
+	if pageSize > 0 {
+		skip = pageSize * (startPage - 1)
+	}
+
+	where, args := sqlWhere(filter)
+	err := s.each("SELECT pk, data FROM crosstx WHERE pipeline = ?"+where+" ORDER BY "+strings.Join(order, ", "), func(pk int64, data string) (bool, error) {
+		c, err := decodeCrossTx(pk, data)
+		if err != nil {
+			return false, err
+		}
+
+		if ok, err := matchAll(c, filter); err != nil || !ok {
+			return true, err
+		}
+
+		if skip > 0 {
+			skip--
+			return true, nil
+		}
+
+		crossTxs = append(crossTxs, c)
+		return pageSize <= 0 || len(crossTxs) < pageSize, nil
+	}, append([]interface{}{s.pipeline}, args...)...)
+	if err != nil {
+		log.Error("[SQLStore] query", "err", err)
+		return nil
+	}
+
+	return crossTxs
+}
+
+// sqlMatcher is a matcher of the CrossTxs on their columns, the SQLStore narrows the rows with it in SQL
+// before they are decoded, the decoded rows are still matched by all the matchers
+type sqlMatcher interface {
+	where() (string, []interface{})
+}
+
+// sqlWhere returns the conditions of the sqlMatchers of the filter, to be appended to the WHERE clause
+func sqlWhere(filter []q.Matcher) (string, []interface{}) {
+	var (
+		where string
+		args  []interface{}
+	)
+
+	for _, m := range filter {
+		sm, ok := m.(sqlMatcher)
+		if !ok {
+			continue
+		}
+
+		cond, condArgs := sm.where()
+		if cond != "" {
+			where += " AND " + cond
+			args = append(args, condArgs...)
+		}
+	}
+
+	return where, args
+}
+
+func (m statusMatcher) where() (string, []interface{}) {
+	if len(m) == 0 {
+		return "0", nil
+	}
+
+	args := make([]interface{}, len(m))
+	for i, status := range m {
+		args[i] = statusText(status)
+	}
+
+	return "status IN (?" + strings.Repeat(", ?", len(m)-1) + ")", args
+}
+
+func (m timeMatcher) where() (string, []interface{}) {
+	return rangeWhere("ts_seconds", m.from, m.to)
+}
+
+func (m blockMatcher) where() (string, []interface{}) {
+	return rangeWhere("block_number", int64(m.from), int64(m.to))
+}
+
+// rangeWhere is the condition of the column in [from, to], 0 leaves the bound open
+func rangeWhere(column string, from, to int64) (string, []interface{}) {
+	var (
+		conds []string
+		args  []interface{}
+	)
+
+	if from != 0 {
+		conds = append(conds, column+" >= ?")
+		args = append(args, from)
+	}
+	if to != 0 {
+		conds = append(conds, column+" <= ?")
+		args = append(args, to)
+	}
+
+	return strings.Join(conds, " AND "), args
+}
+
+// each calls fn with the pk and data of the rows until fn returns false or an error
+func (s *SQLStore) each(query string, fn func(pk int64, data string) (bool, error), args ...interface{}) error {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var pk int64
+		var data string
+		if err = rows.Scan(&pk, &data); err != nil {
+			return err
+		}
+
+		next, err := fn(pk, data)
+		if err != nil || !next {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+func matchAll(i interface{}, filter []q.Matcher) (bool, error) {
+	for _, m := range filter {
+		if ok, err := m.Match(i); err != nil || !ok {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+func (s *SQLStore) SaveReceipt(r *ReceiptRecord) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec("INSERT OR REPLACE INTO receipt (pipeline, cross_id, data) VALUES (?, ?, ?)", s.pipeline, r.CrossID, string(data))
+	return err
+}
+
+func (s *SQLStore) GetReceipt(crossID string) *ReceiptRecord {
+	var data string
+	if err := s.db.QueryRow("SELECT data FROM receipt WHERE pipeline = ? AND cross_id = ?", s.pipeline, crossID).Scan(&data); err != nil {
+		return nil
+	}
+
+	var r ReceiptRecord
+	if err := json.Unmarshal([]byte(data), &r); err != nil {
+		return nil
+	}
+
+	return &r
+}
+
+func (s *SQLStore) QueryReceipts(filter ...q.Matcher) (receipts []*ReceiptRecord) {
+	err := s.each("SELECT 0, data FROM receipt WHERE pipeline = ? ORDER BY cross_id", func(_ int64, data string) (bool, error) {
+		r := new(ReceiptRecord)
+		if err := json.Unmarshal([]byte(data), r); err != nil {
+			return false, err
+		}
+
+		ok, err := matchAll(r, filter)
+		if ok {
+			receipts = append(receipts, r)
+		}
+		return true, err
+	}, s.pipeline)
+	if err != nil {
+		log.Error("[SQLStore] query receipts", "err", err)
+	}
+
+	return receipts
+}
+
+func (s *SQLStore) QueryInvalidPrecommits(filter ...q.Matcher) (invalids []*InvalidPrecommit) {
+	err := s.each("SELECT 0, data FROM invalid_precommit WHERE pipeline = ? ORDER BY block_number, id", func(_ int64, data string) (bool, error) {
+		inv := new(InvalidPrecommit)
+		if err := json.Unmarshal([]byte(data), inv); err != nil {
+			return false, err
+		}
+
+		ok, err := matchAll(inv, filter)
+		if ok {
+			invalids = append(invalids, inv)
+		}
+		return true, err
+	}, s.pipeline)
+	if err != nil {
+		log.Error("[SQLStore] query invalid precommits", "err", err)
+	}
+
+	return invalids
+}
+
+func (s *SQLStore) SaveAudit(r *AuditRecord) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	result, err := s.db.Exec("INSERT INTO audit (pipeline, cross_id, action, data) VALUES (?, ?, ?, ?)", s.pipeline, r.CrossID, r.Action, string(data))
+	if err != nil {
+		return err
+	}
+
+	r.ID, err = result.LastInsertId()
+	return err
+}
+
+func (s *SQLStore) QueryAudit(filter ...q.Matcher) (records []*AuditRecord) {
+	err := s.each("SELECT id, data FROM audit WHERE pipeline = ? ORDER BY id", func(id int64, data string) (bool, error) {
+		r := new(AuditRecord)
+		if err := json.Unmarshal([]byte(data), r); err != nil {
+			return false, err
+		}
+		r.ID = id
+
+		ok, err := matchAll(r, filter)
+		if ok {
+			records = append(records, r)
+		}
+		return true, err
+	}, s.pipeline)
+	if err != nil {
+		log.Error("[SQLStore] query audit", "err", err)
+	}
+
+	return records
+}
+
+func (s *SQLStore) CountByStatus() (map[contractlib.CStatus]int, error) {
+	rows, err := s.db.Query("SELECT status, count(*) FROM crosstx WHERE pipeline = ? AND status != '' GROUP BY status", s.pipeline)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[contractlib.CStatus]int)
+	for rows.Next() {
+		var text string
+		var n int
+		if err = rows.Scan(&text, &n); err != nil {
+			return nil, err
+		}
+
+		status, err := contractlib.ParseCStatus(text)
+		if err != nil {
+			return nil, err
+		}
+		counts[status] = n
+	}
+
+	return counts, rows.Err()
+}
+
+func (s *SQLStore) QueryTransitions(afterID uint64, limit int, filter ...q.Matcher) (events []*TransitionEvent) {
+	rows, err := s.db.Query("SELECT id, cross_id, from_status, to_status, time, reason FROM transition WHERE pipeline = ? AND id > ? ORDER BY id",
+		s.pipeline, int64(afterID))
+	if err != nil {
+		log.Error("[SQLStore] query transitions", "err", err)
+		return nil
+	}
+	defer rows.Close()
+
+	for rows.Next() && (limit <= 0 || len(events) < limit) {
+		var from, to string
+		ev := new(TransitionEvent)
+		if err = rows.Scan(&ev.ID, &ev.CrossID, &from, &to, &ev.Time, &ev.Reason); err != nil {
+			log.Error("[SQLStore] query transitions", "err", err)
+			return nil
+		}
+
+		if from != "" {
+			if ev.From, err = contractlib.ParseCStatus(from); err != nil {
+				log.Error("[SQLStore] query transitions", "id", ev.ID, "err", err)
+				return nil
+			}
+		}
+		if ev.To, err = contractlib.ParseCStatus(to); err != nil {
+			log.Error("[SQLStore] query transitions", "id", ev.ID, "err", err)
+			return nil
+		}
+
+		if ok, _ := matchAll(ev, filter); ok {
+			events = append(events, ev)
+		}
+	}
+
+	return events
+}
+
+func (s *SQLStore) Transitions() *TransitionBus {
+	return s.bus
+}
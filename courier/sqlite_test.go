@@ -0,0 +1,159 @@
+package courier
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/icodezjb/fabric-study/courier/client"
+	"github.com/icodezjb/fabric-study/courier/contractlib"
+
+	"github.com/asdine/storm/v3/q"
+)
+
+func TestSQLiteConformance(t *testing.T) {
+	testDBConformance(t, client.SQLiteDB)
+}
+
+func TestSQLiteNewerSchema(t *testing.T) {
+	dir, err := ioutil.TempDir("", "courier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := OpenSQLiteDB(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.Exec("PRAGMA user_version = 99"); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	if _, err := OpenSQLiteDB(dir); !errors.Is(err, ErrNewerSchema) {
+		t.Fatalf("want ErrNewerSchema, got: %v", err)
+	}
+}
+
+func TestSQLitePragmasPerConnection(t *testing.T) {
+	dir, err := ioutil.TempDir("", "courier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := OpenSQLiteDB(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// without idle connections every query opens a new one
+	db.SetMaxIdleConns(0)
+	for i := 0; i < 2; i++ {
+		var timeout int
+		if err := db.QueryRow("PRAGMA busy_timeout").Scan(&timeout); err != nil || timeout != 5000 {
+			t.Fatalf("busy_timeout of connection %d, want: 5000, got: %d %v", i, timeout, err)
+		}
+	}
+}
+
+func TestSQLiteStampsUnversioned(t *testing.T) {
+	dir, err := ioutil.TempDir("", "courier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := OpenSQLiteDB(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := NewSQLStore(db, "mychannel", "mycc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = store.Save([]*CrossTx{newTestCrossTx("a", contractlib.Init, "")}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the record of the first sqlite databases, without version and contract type
+	var data string
+	if err = db.QueryRow("SELECT data FROM crosstx WHERE cross_id = 'a'").Scan(&data); err != nil {
+		t.Fatal(err)
+	}
+	var record map[string]json.RawMessage
+	if err = json.Unmarshal([]byte(data), &record); err != nil {
+		t.Fatal(err)
+	}
+	delete(record, "Version")
+	delete(record, "ContractType")
+	raw, err := json.Marshal(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.Exec("UPDATE crosstx SET data = ? WHERE cross_id = 'a'; PRAGMA user_version = 0", string(raw)); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	if db, err = OpenSQLiteDB(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var version int
+	if err = db.QueryRow("PRAGMA user_version").Scan(&version); err != nil || version != SchemaVersion {
+		t.Fatalf("user_version, want: %d, got: %d %v", SchemaVersion, version, err)
+	}
+
+	if store, err = NewSQLStore(db, "mychannel", "mycc"); err != nil {
+		t.Fatal(err)
+	}
+	if a := store.One(CrossIdIndex, "a"); a == nil || a.Version != SchemaVersion || a.ContractType != contractlib.PrecommitType {
+		t.Fatalf("stamped crossTx, got: %+v", a)
+	}
+}
+
+func TestSQLiteQueryFiltersInSQL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "courier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := OpenSQLiteDB(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	store, err := NewSQLStore(db, "mychannel", "mycc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := newTestCrossTx("a", contractlib.Init, "")
+	a.BlockNumber = 3
+	if err = store.Save([]*CrossTx{a, newTestCrossTx("b", contractlib.Pending, "")}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the rows out of the filters are not decoded
+	if _, err = db.Exec("INSERT INTO crosstx (pipeline, cross_id, tx_id, block_number, ts_seconds, ts_nanos, status, data) VALUES ('mychannel/mycc', 'x', 'tx-x', 9, 0, 0, 'Completed', 'not json')"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, filter := range [][]q.Matcher{
+		{StatusIn(contractlib.Init)},
+		{BlockBetween(1, 5)},
+	} {
+		if got := store.Query(0, 0, nil, false, filter...); len(got) != 1 || got[0].CrossID != "a" {
+			t.Fatalf("query %v, want: a, got: %d", filter, len(got))
+		}
+	}
+}
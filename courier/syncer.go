@@ -1,35 +1,65 @@
 package courier
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/icodezjb/fabric-study/courier/client"
-	"github.com/icodezjb/fabric-study/courier/contractlib"
 	"github.com/icodezjb/fabric-study/log"
+
+	"github.com/hyperledger/fabric-protos-go/common"
+	"github.com/hyperledger/fabric-protos-go/peer"
 )
 
 const blockInterval = 2 * time.Second
 
+// heightInterval bounds the age of the chain height the polling sync queries, the prefetch queries it every fetch
+const heightInterval = 10 * time.Second
+
+var errSyncStopped = errors.New("block sync stopped")
+
+// blockTxs are the filtered txs of a block, the block is checkpointed with them
+type blockTxs struct {
+	number      uint64
+	preCrossTxs []*PrepareCrossTx
+}
+
 type BlockSync struct {
-	blockNum     uint64
-	filterEvents map[string]struct{}
-	fClient      client.FabricClient
-	wg           sync.WaitGroup
-	stopCh       chan struct{}
-	safeClose    sync.Once
-	preTxsCh     chan []*PrepareCrossTx
-	txm          *TxManager
-	errCh        chan error
+	blockNum    uint64
+	chaincodeID string
+	handlers    map[string]EventHandler
+	fClient     client.FabricClient
+	eClient     client.BlockEventClient // set in the event sync mode, polling only catches up to the chain head
+	prefetch    uint64
+	withInvalid bool // record the invalidated precommit txs
+	wg          sync.WaitGroup
+	stopCh      chan struct{}
+	safeClose   sync.Once
+	preTxsCh    chan blockTxs
+	txm         *TxManager
+
+	// running and lastFetch are read by the health checks, lastFetch is the unix nano time of the last block fetched
+	running   int32
+	lastFetch int64
+	// chainHeight is the highest chain height the sync has seen, read by the metrics and the health checks
+	chainHeight uint64
+	// heightQueried is the time the chain height was last queried, used by syncBlock only
+	heightQueried time.Time
+	// fabricErr and saveErr are the messages of the last fabric call and block save errors, read by the health checks,
+	// a successful fabric call clears fabricErr
+	fabricErr atomic.Value
+	saveErr   atomic.Value
 
 	//for test
-	syncTestHook func([]*CrossTx)
+	syncTestHook func([]*CrossTx, []*CrossTxUpdate)
 }
 
-func NewBlockSync(c client.FabricClient, txm *TxManager) *BlockSync {
+func NewBlockSync(cfg *client.Config, c client.FabricClient, txm *TxManager) *BlockSync {
+	// resume from the block next to the last fully processed one
 	startNum := txm.Get("number")
 	if startNum == 0 {
 		// skip genesis
@@ -37,30 +67,43 @@ func NewBlockSync(c client.FabricClient, txm *TxManager) *BlockSync {
 	}
 
 	s := &BlockSync{
-		blockNum:     startNum,
-		filterEvents: make(map[string]struct{}),
-		fClient:      c,
-		stopCh:       make(chan struct{}),
-		preTxsCh:     make(chan []*PrepareCrossTx),
-		errCh:        make(chan error),
-		txm:          txm,
+		blockNum:    startNum,
+		chaincodeID: c.ChainCodeID(),
+		handlers:    make(map[string]EventHandler),
+		fClient:     c,
+		stopCh:      make(chan struct{}),
+		preTxsCh:    make(chan blockTxs),
+		txm:         txm,
+		prefetch:    1,
+	}
+
+	s.withInvalid = cfg.RecordInvalid
+
+	if cfg.Prefetch > 1 {
+		s.prefetch = uint64(cfg.Prefetch)
+	}
+
+	if cfg.SyncMode == client.EventSync {
+		ec, ok := c.(client.BlockEventClient)
+		if !ok {
+			log.Crit("[BlockSync] fabric client does not deliver block events")
+		}
+		s.eClient = ec
 	}
 
 	for _, ev := range c.FilterEvents() {
-		switch ev {
-		case "precommit":
-			s.filterEvents[ev] = struct{}{}
-		case "commit":
-			s.filterEvents[ev] = struct{}{}
-		default:
-			log.Crit(fmt.Sprintf("[Syncer] unsupported filter event type: %s", ev))
+		h, ok := lookupEventHandler(ev)
+		if !ok {
+			log.Crit(fmt.Sprintf("[BlockSync] unsupported filter event type: %s, supported: %v", ev, EventNames()))
 		}
+		s.handlers[ev] = h
 	}
 
 	return s
 }
 
 func (s *BlockSync) Start() {
+	atomic.StoreInt32(&s.running, 1)
 	s.wg.Add(2)
 	go s.syncBlock()
 	go s.processPreTxs()
@@ -72,6 +115,7 @@ func (s *BlockSync) Stop() {
 	log.Info("[BlockSync] stopping")
 
 	s.safeClose.Do(func() {
+		atomic.StoreInt32(&s.running, 0)
 		close(s.stopCh)
 	})
 
@@ -85,14 +129,52 @@ func (s *BlockSync) syncBlock() {
 	blockTimer := time.NewTimer(0)
 	defer blockTimer.Stop()
 
+	// blocks is set while the block events are subscribed, the timer is idle then
+	var (
+		blocks      <-chan *common.Block
+		unsubscribe = func() {}
+	)
+	defer func() { unsubscribe() }()
+
+	subscribe := func() {
+		ch, stop, err := s.eClient.BlockEvents(s.blockNum)
+		s.fabricErr.Store(errText(err))
+		if err != nil {
+			log.Warn("[BlockSync] subscribe block events, fall back to polling", "err", err)
+			blockTimer.Reset(blockInterval)
+			return
+		}
+
+		log.Info("[BlockSync] subscribed block events", "from", s.blockNum)
+		blocks, unsubscribe = ch, stop
+	}
+
+	// catchUp unsubscribes the block events and polls from the current block after the delay
+	catchUp := func(d time.Duration) {
+		unsubscribe()
+		blocks, unsubscribe = nil, func() {}
+		blockTimer.Reset(d)
+	}
+
+	next := func(d time.Duration) {
+		if blocks == nil {
+			blockTimer.Reset(d)
+		}
+	}
+
 	apply := func(err error) {
 		switch {
+		case err == errSyncStopped:
+			// the loop returns on the stop channel
 		case strings.Contains(err.Error(), "Entry not found in index"):
-			blockTimer.Reset(blockInterval)
-		case strings.Contains(err.Error(), "ignore"):
-			log.Debug(fmt.Sprintf("[BlockSync] handle %v", err))
-			s.blockNum++
-			blockTimer.Reset(blockInterval)
+			// caught up to the chain head
+			s.fabricErr.Store("")
+			s.seeHeight(s.blockNum)
+			if s.eClient != nil && blocks == nil {
+				subscribe()
+				break
+			}
+			next(blockInterval)
 		default:
 			log.Error("[BlockSync] sync block", "err", err)
 			go s.Stop()
@@ -103,33 +185,12 @@ func (s *BlockSync) syncBlock() {
 		select {
 		case <-blockTimer.C:
 			log.Debug("[BlockSync] sync block", "blockNumber", s.blockNum)
-			if err := s.txm.Set("number", s.blockNum); err != nil {
-				apply(err)
-				break
-			}
-
-			block, err := s.fClient.QueryBlockByNum(s.blockNum)
+			blockTime, err := s.fetchBlocks()
 			if err != nil {
 				apply(err)
 				break
 			}
 
-			preCrossTxs, err := GetPrepareCrossTxs(block, func(eventName string) bool {
-				if _, ok := s.filterEvents[eventName]; ok {
-					return true
-				}
-				return false
-			})
-
-			if err != nil {
-				apply(err)
-				break
-			}
-
-			s.preTxsCh <- preCrossTxs
-
-			s.blockNum++
-			blockTime := time.Unix(preCrossTxs[0].TimeStamp.Seconds, preCrossTxs[0].TimeStamp.Seconds)
 			if interval := time.Since(blockTime); interval > blockInterval {
 				//sync new block immediately
 				blockTimer.Reset(0)
@@ -137,57 +198,277 @@ func (s *BlockSync) syncBlock() {
 				//sync next block timestamp
 				blockTimer.Reset(blockInterval)
 			}
-		case err := <-s.errCh:
-			apply(err)
-			break
+		case block, ok := <-blocks:
+			if !ok {
+				log.Warn("[BlockSync] block events closed, catch up by polling", "blockNumber", s.blockNum)
+				catchUp(blockInterval)
+				break
+			}
+
+			switch num := block.GetHeader().GetNumber(); {
+			case num < s.blockNum:
+				log.Debug("[BlockSync] skip delivered block", "blockNumber", num)
+			case num > s.blockNum:
+				log.Warn("[BlockSync] block events gap, catch up by polling", "want", s.blockNum, "got", num)
+				catchUp(0)
+			default:
+				log.Debug("[BlockSync] receive block", "blockNumber", num)
+				atomic.StoreInt64(&s.lastFetch, time.Now().UnixNano())
+				s.fabricErr.Store("")
+				s.seeHeight(num + 1)
+				if _, err := s.handleBlock(block); err != nil {
+					apply(err)
+				}
+			}
 		case <-s.stopCh:
 			return
 		}
 	}
 }
 
+// fetched is a prefetched block, filtered and decoded
+type fetched struct {
+	preCrossTxs []*PrepareCrossTx
+	err         error
+}
+
+// fetchBlocks fetches and decodes up to prefetch blocks concurrently when behind the chain head,
+// and hands them over strictly in block order, it returns the time of the last handled block
+func (s *BlockSync) fetchBlocks() (time.Time, error) {
+	n := uint64(1)
+	if s.prefetch > 1 || time.Since(s.heightQueried) >= heightInterval {
+		s.heightQueried = time.Now()
+		height, err := s.fClient.QueryHeight()
+		s.fabricErr.Store(errText(err))
+		if err == nil {
+			s.seeHeight(height)
+		}
+
+		switch {
+		case err != nil:
+			log.Warn("[BlockSync] query height, fetch one block", "err", err)
+		case s.prefetch > 1 && height > s.blockNum+1:
+			n = height - s.blockNum
+			if n > s.prefetch {
+				n = s.prefetch
+			}
+			log.Info("[BlockSync] catching up", "blockNumber", s.blockNum, "target", height-1, "behind", height-s.blockNum, "window", n)
+		}
+	}
+
+	results := make([]chan fetched, n)
+	for i := range results {
+		results[i] = make(chan fetched, 1)
+
+		go func(num uint64, result chan<- fetched) {
+			block, err := s.fClient.QueryBlockByNum(num)
+			if err != nil {
+				if !strings.Contains(err.Error(), "Entry not found in index") {
+					s.fabricErr.Store(err.Error())
+				}
+				result <- fetched{err: err}
+				return
+			}
+			atomic.StoreInt64(&s.lastFetch, time.Now().UnixNano())
+			s.fabricErr.Store("")
+			s.seeHeight(num + 1)
+
+			preCrossTxs, err := s.filterBlock(block)
+			result <- fetched{preCrossTxs: preCrossTxs, err: err}
+		}(s.blockNum+uint64(i), results[i])
+	}
+
+	var blockTime time.Time
+	for _, result := range results {
+		// the blocks after a failed one are dropped, and fetched again from the failed one
+		f := <-result
+		if f.err != nil {
+			return blockTime, f.err
+		}
+
+		var err error
+		if blockTime, err = s.handle(f.preCrossTxs); err != nil {
+			return blockTime, err
+		}
+	}
+
+	return blockTime, nil
+}
+
+// handleBlock filters the block and hands it over
+func (s *BlockSync) handleBlock(block *common.Block) (time.Time, error) {
+	preCrossTxs, err := s.filterBlock(block)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return s.handle(preCrossTxs)
+}
+
+func (s *BlockSync) filterBlock(block *common.Block) ([]*PrepareCrossTx, error) {
+	getPrepareCrossTxs := GetPrepareCrossTxs
+	if s.withInvalid {
+		getPrepareCrossTxs = GetAllPrepareCrossTxs
+	}
+
+	preCrossTxs, err := getPrepareCrossTxs(block, func(chaincodeID, eventName string) bool {
+		if _, ok := s.handlers[eventName]; ok && chaincodeID == s.chaincodeID {
+			return true
+		}
+		return false
+	})
+
+	if err != nil && strings.Contains(err.Error(), "ignore") {
+		// checkpoint the block without txs too
+		log.Debug(fmt.Sprintf("[BlockSync] handle %v", err))
+		return nil, nil
+	}
+
+	return preCrossTxs, err
+}
+
+// Running reports whether the sync is started and not stopped, it stops itself on the unknown errors
+func (s *BlockSync) Running() bool {
+	return atomic.LoadInt32(&s.running) == 1
+}
+
+// LastFetch returns the time of the last block fetched from fabric, by query or by event, zero if none yet
+func (s *BlockSync) LastFetch() time.Time {
+	if n := atomic.LoadInt64(&s.lastFetch); n != 0 {
+		return time.Unix(0, n)
+	}
+
+	return time.Time{}
+}
+
+// BlockNumber returns the number of the next block to be synced
+func (s *BlockSync) BlockNumber() uint64 {
+	return atomic.LoadUint64(&s.blockNum)
+}
+
+// ChainHeight returns the highest chain height seen by the sync, from the height queries and the fetched blocks,
+// zero if none yet
+func (s *BlockSync) ChainHeight() uint64 {
+	return atomic.LoadUint64(&s.chainHeight)
+}
+
+// FabricError returns the error of the last fabric call of the sync, empty if it succeeded
+func (s *BlockSync) FabricError() string {
+	msg, _ := s.fabricErr.Load().(string)
+	return msg
+}
+
+// SaveError returns the error of the block save which stopped the sync, empty if none
+func (s *BlockSync) SaveError() string {
+	msg, _ := s.saveErr.Load().(string)
+	return msg
+}
+
+func errText(err error) string {
+	if err == nil {
+		return ""
+	}
+
+	return err.Error()
+}
+
+// seeHeight raises the chain height seen by the sync
+func (s *BlockSync) seeHeight(height uint64) {
+	for {
+		seen := atomic.LoadUint64(&s.chainHeight)
+		if height <= seen || atomic.CompareAndSwapUint64(&s.chainHeight, seen, height) {
+			return
+		}
+	}
+}
+
+// handle passes the filtered txs of the current block to processPreTxs, which checkpoints the block with them,
+// it returns the block time
+func (s *BlockSync) handle(preCrossTxs []*PrepareCrossTx) (time.Time, error) {
+	select {
+	case s.preTxsCh <- blockTxs{number: s.blockNum, preCrossTxs: preCrossTxs}:
+	case <-s.stopCh:
+		return time.Time{}, errSyncStopped
+	}
+
+	// BlockNumber reads it from other goroutines
+	atomic.AddUint64(&s.blockNum, 1)
+
+	if len(preCrossTxs) == 0 {
+		return time.Time{}, nil
+	}
+
+	return time.Unix(preCrossTxs[0].TimeStamp.Seconds, int64(preCrossTxs[0].TimeStamp.Nanos)), nil
+}
+
 func (s *BlockSync) processPreTxs() {
 	defer s.wg.Done()
 
 	for {
 		select {
-		case preCrossTxs := <-s.preTxsCh:
-
-			var crossTxs = make([]*CrossTx, len(preCrossTxs))
-			for i, tx := range preCrossTxs {
-				var c contractlib.Contract
-				err := json.Unmarshal(tx.Payload, &c)
-				if err != nil {
-					log.Error("[BlockSync] processPreTxs parse Contract", " event", tx.EventName, "err", err)
-					s.errCh <- err
-					break
-				}
-
-				crossTx := &CrossTx{
-					Contract:    c,
-					TxID:        tx.TxID,
-					BlockNumber: tx.BlockNumber,
-					TimeStamp:   tx.TimeStamp,
-					CrossID:     c.GetContractID(),
-				}
-
-				crossTxs = append(crossTxs[:i], crossTx)
+		case b := <-s.preTxsCh:
+			crossTxs, updates, invalids, err := s.toCrossTxs(b.preCrossTxs)
+			if err != nil {
+				// stop before any later block is checkpointed, the sync resumes from this block
+				log.Error("[BlockSync] processPreTxs", "blockNumber", b.number, "err", err)
+				go s.Stop()
+				return
 			}
 
-			log.Debug("[BlockSync] processPreTxs", "len(crossTxs)", len(crossTxs))
+			log.Debug("[BlockSync] processPreTxs", "blockNumber", b.number, "len(crossTxs)", len(crossTxs), "len(updates)", len(updates), "len(invalids)", len(invalids))
 
 			if s.syncTestHook != nil {
-				s.syncTestHook(crossTxs)
+				s.syncTestHook(crossTxs, updates)
 				break
 			}
 
-			if err := s.txm.AddCrossTxs(crossTxs); err != nil {
-				log.Error("[BlockSync] processPreTxs", "err", err)
-				s.errCh <- err
-				break
+			if err := s.txm.AddCrossTxs(b.number, crossTxs, updates, invalids); err != nil {
+				log.Error("[BlockSync] processPreTxs", "blockNumber", b.number, "err", err)
+				s.saveErr.Store(err.Error())
+				go s.Stop()
+				return
 			}
 		case <-s.stopCh:
 			return
 		}
 	}
 }
+
+// toCrossTxs runs the handlers of the valid events, the CrossTxs and the updates keep the order of the events,
+// the invalidated txs of the handlers recording them are returned as InvalidPrecommit records
+func (s *BlockSync) toCrossTxs(preCrossTxs []*PrepareCrossTx) ([]*CrossTx, []*CrossTxUpdate, []*InvalidPrecommit, error) {
+	var (
+		crossTxs []*CrossTx
+		updates  []*CrossTxUpdate
+		invalids []*InvalidPrecommit
+	)
+
+	for _, tx := range preCrossTxs {
+		h, ok := s.handlers[tx.EventName]
+		if !ok {
+			return nil, nil, nil, fmt.Errorf("no handler of event %s", tx.EventName)
+		}
+
+		if tx.ValidationCode != peer.TxValidationCode_VALID {
+			if h.RecordInvalid {
+				invalids = append(invalids, newInvalidPrecommit(tx, h))
+			}
+			continue
+		}
+
+		ev, err := h.Decode(tx)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		txs, ups, err := h.Handle(tx, ev)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("handle %s event of tx %s err: %w", tx.EventName, tx.TxID, err)
+		}
+
+		crossTxs = append(crossTxs, txs...)
+		updates = append(updates, ups...)
+	}
+
+	return crossTxs, updates, invalids, nil
+}
@@ -5,22 +5,28 @@ import (
 	"encoding/hex"
 	"fmt"
 	"os"
+	"reflect"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/icodezjb/fabric-study/courier/client"
+	"github.com/icodezjb/fabric-study/courier/contractlib"
 
 	"github.com/asdine/storm/v3/q"
 	"github.com/golang/protobuf/proto"
 	"github.com/hyperledger/fabric-protos-go/common"
+	"github.com/hyperledger/fabric-protos-go/peer"
 	"github.com/hyperledger/fabric-sdk-go/pkg/common/providers/fab"
 )
 
 func TestBlockSync(t *testing.T) {
 	var expected = [][]string{
 		{"53ff97aa06a446bc9d27ad7dc1656fbb7f4e9b1a5d162157beab945788e4136c", "Init"},
-		{"53ff97aa06a446bc9d27ad7dc1656fbb7f4e9b1a5d162157beab945788e4136c", "Finished"},
+		{"53ff97aa06a446bc9d27ad7dc1656fbb7f4e9b1a5d162157beab945788e4136c", "Completed"},
 		{"3d688e09b0bfbad4e758529b236857397ff2fe128313af9bf3262fc0c60370b3", "Init"},
-		{"3d688e09b0bfbad4e758529b236857397ff2fe128313af9bf3262fc0c60370b3", "Finished"},
+		{"3d688e09b0bfbad4e758529b236857397ff2fe128313af9bf3262fc0c60370b3", "Completed"},
 		{"57763bd245b062f95f068338d0719c43274305d8eae492de530e68e4eb5f40ae", "Init"},
 		{"9e415b4f883784ef4eacf7cca4496365f0915cb81bed82f430e358b982bf2184", "Init"},
 	}
@@ -36,12 +42,20 @@ func TestBlockSync(t *testing.T) {
 		DB: &MockDB{db: map[string]uint64{}},
 	}
 
-	blksync := NewBlockSync(fabCli, txm)
+	blksync := NewBlockSync(&client.Config{}, fabCli, txm)
 
 	var recvList = []*CrossTx{}
 
-	blksync.syncTestHook = func(txList []*CrossTx) {
+	// the commit events update the stored CrossTx, it is completed if executed
+	blksync.syncTestHook = func(txList []*CrossTx, updates []*CrossTxUpdate) {
 		recvList = append(recvList, txList...)
+		for _, u := range updates {
+			tx := newTestCrossTx(u.CrossID, contractlib.Executed, "")
+			if err := u.Update(tx); err != nil {
+				t.Error(err)
+			}
+			recvList = append(recvList, tx)
+		}
 		if len(recvList) == 6 {
 			stopCh <- struct{}{}
 		}
@@ -59,6 +73,115 @@ func TestBlockSync(t *testing.T) {
 	}
 }
 
+func TestBlockSyncEvents(t *testing.T) {
+	blocks, err := initBlocks()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the chain head is 5 when the courier starts, the deliver service
+	// ends after block 7, then the chain grows to 10
+	fabCli := &eventFabricClient{MockFabricClient: MockFabricClient{blocks: blocks}, head: 5, subscribed: make(chan uint64, 2)}
+	fabCli.deliver = func(from uint64, ch chan<- *common.Block) {
+		for num := from; num <= 7; num++ {
+			ch <- blocks[num-1]
+		}
+		fabCli.mu.Lock()
+		fabCli.head = 10
+		fabCli.mu.Unlock()
+	}
+
+	txm := &TxManager{
+		DB: &MockDB{db: map[string]uint64{}},
+	}
+
+	blksync := NewBlockSync(&client.Config{SyncMode: client.EventSync}, fabCli, txm)
+
+	var recvList []*CrossTx
+	blksync.syncTestHook = func(txList []*CrossTx, _ []*CrossTxUpdate) {
+		recvList = append(recvList, txList...)
+	}
+
+	blksync.Start()
+
+	// subscribed at the head after the catch-up, and again after the deliver service ended
+	for i, want := range []uint64{6, 11} {
+		select {
+		case from := <-fabCli.subscribed:
+			if from != want {
+				t.Fatalf("subscription %d, want from: %d, got: %d", i, want, from)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("subscription %d not made", i)
+		}
+	}
+
+	blksync.Stop()
+
+	var polled []*CrossTx
+	pollSync := NewBlockSync(&client.Config{}, &eventFabricClient{MockFabricClient: MockFabricClient{blocks: blocks}, head: 10}, &TxManager{DB: &MockDB{db: map[string]uint64{}}})
+	pollSync.syncTestHook = func(txList []*CrossTx, _ []*CrossTxUpdate) {
+		polled = append(polled, txList...)
+	}
+	pollSync.Start()
+	time.Sleep(500 * time.Millisecond)
+	pollSync.Stop()
+
+	if len(recvList) == 0 || len(recvList) != len(polled) {
+		t.Fatalf("want: %d CrossTxs as polled, got: %d", len(polled), len(recvList))
+	}
+
+	for i := range recvList {
+		if recvList[i].CrossID != polled[i].CrossID || recvList[i].GetStatus() != polled[i].GetStatus() {
+			t.Fatalf("CrossTx %d, want: %s %v, got: %s %v", i, polled[i].CrossID, polled[i].GetStatus(), recvList[i].CrossID, recvList[i].GetStatus())
+		}
+	}
+}
+
+// eventFabricClient serves the blocks up to the head by number,
+// and delivers the blocks from the subscribed number by the deliver function
+type eventFabricClient struct {
+	MockFabricClient
+
+	mu         sync.Mutex
+	head       uint64
+	subscribed chan uint64
+	deliver    func(from uint64, ch chan<- *common.Block)
+}
+
+func (e *eventFabricClient) QueryBlockByNum(number uint64) (*common.Block, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if number > e.head {
+		return nil, fmt.Errorf("Entry not found in index")
+	}
+	return e.blocks[number-1], nil
+}
+
+func (e *eventFabricClient) QueryHeight() (uint64, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.head + 1, nil
+}
+
+func (e *eventFabricClient) BlockEvents(from uint64) (<-chan *common.Block, func(), error) {
+	e.subscribed <- from
+
+	ch, done := make(chan *common.Block), make(chan struct{})
+	go func() {
+		defer close(ch)
+		if from <= 7 {
+			e.deliver(from, ch)
+			return
+		}
+		<-done
+	}()
+
+	return ch, func() { close(done) }, nil
+}
+
 func newTestFabricClient() (client.FabricClient, error) {
 	mfc := &MockFabricClient{}
 
@@ -83,10 +206,22 @@ func (m *MockFabricClient) QueryBlockByNum(number uint64) (*common.Block, error)
 	return m.blocks[number], nil
 }
 
+func (m *MockFabricClient) QueryHeight() (uint64, error) {
+	return 10, nil
+}
+
 func (m *MockFabricClient) InvokeChainCode(fcn string, args []string) (fab.TransactionID, error) {
 	return "", nil
 }
 
+func (m *MockFabricClient) QueryTxValidation(txID fab.TransactionID) (peer.TxValidationCode, error) {
+	return peer.TxValidationCode_NOT_VALIDATED, fmt.Errorf("Entry not found in index")
+}
+
+func (m *MockFabricClient) ChainCodeID() string {
+	return "mycc"
+}
+
 func (m *MockFabricClient) FilterEvents() []string {
 	return []string{"precommit", "commit"}
 }
@@ -103,7 +238,12 @@ func (d *MockDB) Save(txList []*CrossTx) error {
 	return nil
 }
 
-func (d *MockDB) Updates(idList []string, updaters []func(c *CrossTx)) error {
+func (d *MockDB) SaveBlock(number uint64, txList []*CrossTx, updates []*CrossTxUpdate, invalids []*InvalidPrecommit) error {
+	d.db["number"] = number + 1
+	return nil
+}
+
+func (d *MockDB) Updates(idList []string, updaters []func(c *CrossTx) error) error {
 	return nil
 }
 
@@ -124,6 +264,42 @@ func (d *MockDB) Query(pageSize int, startPage int, orderBy []FieldName, reverse
 	return nil
 }
 
+func (d *MockDB) SaveReceipt(r *ReceiptRecord) error {
+	return nil
+}
+
+func (d *MockDB) GetReceipt(crossID string) *ReceiptRecord {
+	return nil
+}
+
+func (d *MockDB) QueryReceipts(filter ...q.Matcher) []*ReceiptRecord {
+	return nil
+}
+
+func (d *MockDB) QueryInvalidPrecommits(filter ...q.Matcher) []*InvalidPrecommit {
+	return nil
+}
+
+func (d *MockDB) SaveAudit(r *AuditRecord) error {
+	return nil
+}
+
+func (d *MockDB) QueryAudit(filter ...q.Matcher) []*AuditRecord {
+	return nil
+}
+
+func (d *MockDB) CountByStatus() (map[contractlib.CStatus]int, error) {
+	return nil, nil
+}
+
+func (d *MockDB) QueryTransitions(afterID uint64, limit int, filter ...q.Matcher) []*TransitionEvent {
+	return nil
+}
+
+func (d *MockDB) Transitions() *TransitionBus {
+	return nil
+}
+
 func initBlocks() (blocks []*common.Block, err error) {
 	file, err := os.Open("./test/testdata/blockdata.hex")
 	defer file.Close()
@@ -147,3 +323,205 @@ func initBlocks() (blocks []*common.Block, err error) {
 
 	return blocks, err
 }
+
+// slowFabricClient records the max number of concurrent block queries
+type slowFabricClient struct {
+	eventFabricClient
+
+	inflight, maxInflight int32
+}
+
+func (c *slowFabricClient) QueryBlockByNum(number uint64) (*common.Block, error) {
+	n := atomic.AddInt32(&c.inflight, 1)
+	defer atomic.AddInt32(&c.inflight, -1)
+
+	for {
+		max := atomic.LoadInt32(&c.maxInflight)
+		if n <= max || atomic.CompareAndSwapInt32(&c.maxInflight, max, n) {
+			break
+		}
+	}
+
+	// the later blocks are fetched faster
+	time.Sleep(time.Duration(20-number) * time.Millisecond)
+
+	return c.eventFabricClient.QueryBlockByNum(number)
+}
+
+func TestBlockSyncPrefetch(t *testing.T) {
+	blocks, err := initBlocks()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// run syncs the blocks 1 to 10, the hook is called once per block
+	run := func(prefetch int) (*slowFabricClient, []*CrossTx) {
+		fabCli := &slowFabricClient{eventFabricClient: eventFabricClient{MockFabricClient: MockFabricClient{blocks: blocks}, head: 10}}
+		blksync := NewBlockSync(&client.Config{Prefetch: prefetch}, fabCli, &TxManager{DB: &MockDB{db: map[string]uint64{}}})
+
+		handled := make(chan []*CrossTx)
+		blksync.syncTestHook = func(txList []*CrossTx, _ []*CrossTxUpdate) {
+			handled <- txList
+		}
+
+		blksync.Start()
+		defer blksync.Stop()
+
+		var recvList []*CrossTx
+		for i := 0; i < 10; i++ {
+			select {
+			case txList := <-handled:
+				recvList = append(recvList, txList...)
+			case <-time.After(5 * time.Second):
+				t.Fatalf("prefetch %d, timeout after %d blocks", prefetch, i)
+			}
+		}
+
+		return fabCli, recvList
+	}
+
+	_, want := run(1)
+	fabCli, got := run(4)
+
+	if max := atomic.LoadInt32(&fabCli.maxInflight); max < 2 || max > 4 {
+		t.Fatalf("concurrent queries, want: 2 to 4, got: %d", max)
+	}
+
+	if len(got) == 0 || len(got) != len(want) {
+		t.Fatalf("want: %d CrossTxs, got: %d", len(want), len(got))
+	}
+
+	for i := range got {
+		if got[i].CrossID != want[i].CrossID || got[i].GetStatus() != want[i].GetStatus() || got[i].BlockNumber != want[i].BlockNumber {
+			t.Fatalf("CrossTx %d out of order, want: %s %d, got: %s %d", i, want[i].CrossID, want[i].BlockNumber, got[i].CrossID, got[i].BlockNumber)
+		}
+	}
+}
+
+func TestSaveBlock(t *testing.T) {
+	store, closeStore := newTestStore(t)
+	defer closeStore()
+
+	if err := store.SaveBlock(5, []*CrossTx{newTestCrossTx("a", contractlib.Init, "")}, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if num := store.Get("number"); num != 6 {
+		t.Fatalf("checkpoint, want: 6, got: %d", num)
+	}
+
+	// the second CrossTx fails in the middle of the transaction
+	bad := newTestCrossTx("c", contractlib.Init, "")
+	bad.IContract = unencodableContract{bad.IContract.(*contractlib.PrecommitContract)}
+	if err := store.SaveBlock(6, []*CrossTx{newTestCrossTx("b", contractlib.Init, ""), bad}, nil, nil); err == nil {
+		t.Fatal("want error of the unencodable CrossTx")
+	}
+
+	if tx := store.One(CrossIdIndex, "b"); tx != nil {
+		t.Fatal("CrossTx of the failed block saved")
+	}
+
+	if num := store.Get("number"); num != 6 {
+		t.Fatalf("checkpoint after the failed block, want: 6, got: %d", num)
+	}
+}
+
+type unencodableContract struct {
+	*contractlib.PrecommitContract
+}
+
+func (unencodableContract) MarshalJSON() ([]byte, error) {
+	return nil, fmt.Errorf("unencodable")
+}
+
+// crashDB fails the SaveBlock of the given block, before or after the block is committed
+type crashDB struct {
+	*Store
+	block       uint64
+	afterCommit bool
+}
+
+func (c *crashDB) SaveBlock(number uint64, txList []*CrossTx, updates []*CrossTxUpdate, invalids []*InvalidPrecommit) error {
+	if number != c.block {
+		return c.Store.SaveBlock(number, txList, updates, invalids)
+	}
+
+	if c.afterCommit {
+		if err := c.Store.SaveBlock(number, txList, updates, invalids); err != nil {
+			return err
+		}
+	}
+
+	return fmt.Errorf("crash at block %d", number)
+}
+
+func TestBlockCheckpointCrash(t *testing.T) {
+	blocks, err := initBlocks()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// syncUntil runs a BlockSync over the db until it stops by itself or checkpoints the chain head
+	syncUntil := func(db DB, startNum uint64) {
+		fabCli := &eventFabricClient{MockFabricClient: MockFabricClient{blocks: blocks}, head: 10}
+		blksync := NewBlockSync(&client.Config{}, fabCli, NewTxManager(&client.Config{}, fabCli, &client.MockOutChainClient{}, db))
+		if blksync.blockNum != startNum {
+			t.Fatalf("resume, want: %d, got: %d", startNum, blksync.blockNum)
+		}
+
+		blksync.Start()
+		defer blksync.Stop()
+
+		deadline := time.After(5 * time.Second)
+		for db.Get("number") != 11 {
+			select {
+			case <-blksync.stopCh:
+				return
+			case <-deadline:
+				t.Fatalf("timeout, checkpoint: %d", db.Get("number"))
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}
+
+	synced := func(store *Store) map[string]contractlib.CStatus {
+		txs := make(map[string]contractlib.CStatus)
+		for _, tx := range store.Query(0, 0, nil, false) {
+			txs[tx.CrossID] = tx.GetStatus()
+		}
+		return txs
+	}
+
+	store, closeStore := newTestStore(t)
+	syncUntil(store, 1)
+	want := synced(store)
+	closeStore()
+
+	if len(want) == 0 {
+		t.Fatal("no CrossTx synced")
+	}
+
+	for _, c := range []struct {
+		afterCommit bool
+		resume      uint64
+	}{
+		// the block is fetched and parsed but not saved, it is synced again
+		{false, 4},
+		// the block is saved, the sync resumes from the next one
+		{true, 5},
+	} {
+		store, closeStore := newTestStore(t)
+
+		syncUntil(&crashDB{Store: store, block: 4, afterCommit: c.afterCommit}, 1)
+		if num := store.Get("number"); num != c.resume {
+			t.Fatalf("checkpoint after crash, want: %d, got: %d", c.resume, num)
+		}
+
+		syncUntil(store, c.resume)
+		if got := synced(store); !reflect.DeepEqual(got, want) {
+			t.Fatalf("crash after commit %v, want: %v, got: %v", c.afterCommit, want, got)
+		}
+
+		closeStore()
+	}
+}
@@ -0,0 +1,274 @@
+package courier
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/icodezjb/fabric-study/courier/contractlib"
+	"github.com/icodezjb/fabric-study/log"
+
+	"github.com/asdine/storm/v3"
+)
+
+const (
+	// transitionBufferSize is the number of the events a subscriber can lag behind before it is dropped
+	transitionBufferSize = 256
+	// replayPageSize is the number of the logged events read at once to resume a stream
+	replayPageSize = 1000
+	// keepAliveInterval is the interval of the comments keeping an idle stream open
+	keepAliveInterval = 15 * time.Second
+)
+
+// TransitionEvent is a status change of a CrossTx, logged in the transaction of the change,
+// the ID increases in the pipeline and is the id of the server-sent event
+type TransitionEvent struct {
+	ID      uint64 `storm:"id,increment"`
+	CrossID string `storm:"index"`
+	StatusChange
+}
+
+// newTransitions returns the events of the status changes appended to the history of the CrossTx after the first n
+func newTransitions(c *CrossTx, n int) []*TransitionEvent {
+	if n >= len(c.History) {
+		return nil
+	}
+
+	events := make([]*TransitionEvent, 0, len(c.History)-n)
+	for _, change := range c.History[n:] {
+		events = append(events, &TransitionEvent{CrossID: c.CrossID, StatusChange: change})
+	}
+
+	return events
+}
+
+// logTransitions logs the status changes appended to the history of the CrossTx after the first n
+func logTransitions(node storm.Node, c *CrossTx, n int) ([]*TransitionEvent, error) {
+	events := newTransitions(c, n)
+	for _, ev := range events {
+		if err := node.Save(ev); err != nil {
+			return nil, fmt.Errorf("db save transition err: %w", err)
+		}
+	}
+
+	return events, nil
+}
+
+// TransitionBus fans out the transition events committed by the store, a subscriber too slow
+// to keep up is dropped by closing its channel, it can resume from the transition log
+type TransitionBus struct {
+	mu   sync.Mutex
+	subs map[chan *TransitionEvent]struct{}
+}
+
+func NewTransitionBus() *TransitionBus {
+	return &TransitionBus{subs: make(map[chan *TransitionEvent]struct{})}
+}
+
+// Subscribe returns the channel of the events published from now on, and the func to unsubscribe
+func (b *TransitionBus) Subscribe() (<-chan *TransitionEvent, func()) {
+	ch := make(chan *TransitionEvent, transitionBufferSize)
+
+	b.mu.Lock()
+	b.subs[ch] = struct{}{}
+	b.mu.Unlock()
+
+	return ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+
+		if _, ok := b.subs[ch]; ok {
+			delete(b.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+func (b *TransitionBus) Publish(events []*TransitionEvent) {
+	if len(events) == 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for ch := range b.subs {
+		for _, ev := range events {
+			select {
+			case ch <- ev:
+				continue
+			default:
+			}
+
+			log.Warn("[TransitionBus] drop slow subscriber", "eventID", ev.ID)
+			delete(b.subs, ch)
+			close(ch)
+			break
+		}
+	}
+}
+
+// transitionFilter matches the events by CrossID and by the status changed to, an empty set matches all
+type transitionFilter struct {
+	crossIDs map[string]bool
+	status   map[contractlib.CStatus]bool
+}
+
+// parseTransitionFilter parses the comma separated crossid and status parameters
+func parseTransitionFilter(values url.Values) (*transitionFilter, error) {
+	f := &transitionFilter{}
+
+	if v := values.Get("crossid"); v != "" {
+		f.crossIDs = make(map[string]bool)
+		for _, id := range strings.Split(v, ",") {
+			f.crossIDs[strings.TrimSpace(id)] = true
+		}
+	}
+
+	if v := values.Get("status"); v != "" {
+		f.status = make(map[contractlib.CStatus]bool)
+		for _, s := range strings.Split(v, ",") {
+			cs, err := contractlib.ParseCStatus(strings.TrimSpace(s))
+			if err != nil {
+				return nil, err
+			}
+			f.status[cs] = true
+		}
+	}
+
+	return f, nil
+}
+
+func (f *transitionFilter) match(ev *TransitionEvent) bool {
+	return (f.crossIDs == nil || f.crossIDs[ev.CrossID]) && (f.status == nil || f.status[ev.To])
+}
+
+// Match makes the filter a storm matcher of the logged events
+func (f *transitionFilter) Match(i interface{}) (bool, error) {
+	switch v := i.(type) {
+	case TransitionEvent:
+		return f.match(&v), nil
+	case *TransitionEvent:
+		return f.match(v), nil
+	default:
+		return false, fmt.Errorf("transition filter: unsupported type %T", i)
+	}
+}
+
+// lastEventID returns the Last-Event-ID header of the reconnecting client, or the last_event_id parameter
+func lastEventID(req *http.Request) (uint64, error) {
+	v := req.Header.Get("Last-Event-ID")
+	if v == "" {
+		v = req.FormValue("last_event_id")
+	}
+	if v == "" {
+		return 0, nil
+	}
+
+	id, err := strconv.ParseUint(v, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid last event id %q", v)
+	}
+
+	return id, nil
+}
+
+func writeTransition(w http.ResponseWriter, ev *TransitionEvent) error {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "id: %d\nevent: transition\ndata: %s\n\n", ev.ID, data)
+	return err
+}
+
+// streamTransitions streams the transition events of the pipeline as server-sent events, the logged events
+// after the Last-Event-ID are replayed first, the stream ends when the client leaves, the courier stops,
+// or the client is too slow and dropped by the bus
+func (h *Handler) streamTransitions(w http.ResponseWriter, req *http.Request, p *Pipeline) (code int, msg string) {
+	if req.Method != "GET" {
+		return http.StatusBadRequest, "support GET request only"
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return http.StatusInternalServerError, "streaming unsupported"
+	}
+
+	bus := p.txm.DB.Transitions()
+	if bus == nil {
+		return http.StatusNotImplemented, "the store does not publish the transitions"
+	}
+
+	if err := req.ParseForm(); err != nil {
+		return http.StatusBadRequest, err.Error()
+	}
+
+	filter, err := parseTransitionFilter(req.Form)
+	if err != nil {
+		return http.StatusBadRequest, err.Error()
+	}
+
+	lastID, err := lastEventID(req)
+	if err != nil {
+		return http.StatusBadRequest, err.Error()
+	}
+
+	// subscribe before the replay, the events committed during the replay are skipped by their ID
+	live, unsubscribe := bus.Subscribe()
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	for {
+		events := p.txm.DB.QueryTransitions(lastID, replayPageSize, filter)
+		for _, ev := range events {
+			if err := writeTransition(w, ev); err != nil {
+				return codeStreamed, ""
+			}
+			lastID = ev.ID
+		}
+
+		if len(events) < replayPageSize {
+			break
+		}
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case ev, ok := <-live:
+			if !ok {
+				return codeStreamed, ""
+			}
+			if ev.ID <= lastID || !filter.match(ev) {
+				continue
+			}
+			if err := writeTransition(w, ev); err != nil {
+				return codeStreamed, ""
+			}
+			lastID = ev.ID
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return codeStreamed, ""
+			}
+		case <-req.Context().Done():
+			return codeStreamed, ""
+		case <-h.streamStop:
+			return codeStreamed, ""
+		}
+
+		flusher.Flush()
+	}
+}
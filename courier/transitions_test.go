@@ -0,0 +1,140 @@
+package courier
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/icodezjb/fabric-study/courier/client"
+	"github.com/icodezjb/fabric-study/courier/contractlib"
+)
+
+// readTransition reads the next server-sent event of the stream
+func readTransition(t *testing.T, r *bufio.Reader) *TransitionEvent {
+	var ev *TransitionEvent
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("read event: %v", err)
+		}
+
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "" && ev != nil:
+			return ev
+		case strings.HasPrefix(line, "data: "):
+			ev = new(TransitionEvent)
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), ev); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestTransitionStream(t *testing.T) {
+	store, closeStore := newTestStore(t)
+	defer closeStore()
+
+	transit := func(crossID string, to contractlib.CStatus) {
+		if err := store.Updates([]string{crossID}, []func(c *CrossTx) error{func(c *CrossTx) error {
+			return c.Transition(to, "test")
+		}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := store.Save([]*CrossTx{newTestCrossTx("a", contractlib.Init, ""), newTestCrossTx("b", contractlib.Init, "")}); err != nil {
+		t.Fatal(err)
+	}
+	transit("a", contractlib.Pending)
+
+	txm := NewTxManager(&client.Config{}, &MockFabricClient{}, &client.MockOutChainClient{}, store)
+	h := &Handler{
+		pipelines:  []*Pipeline{{PipelineConfig: client.PipelineConfig{ChannelID: "mychannel", ChainCodeID: "mycc"}, txm: txm}},
+		streamStop: make(chan struct{}),
+	}
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	stream := func(query, lastID string) (*bufio.Reader, func()) {
+		req, err := http.NewRequest("GET", server.URL+"/v1/events"+query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lastID != "" {
+			req.Header.Set("Last-Event-ID", lastID)
+		}
+
+		resp, err := (&http.Client{Timeout: 10 * time.Second}).Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+			t.Fatalf("events, want: 200 text/event-stream, got: %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+		}
+
+		return bufio.NewReader(resp.Body), func() { resp.Body.Close() }
+	}
+
+	// resume after the Init of a, the Pending is replayed from the log
+	r, closeStream := stream("?crossid=a", "1")
+	defer closeStream()
+
+	if ev := readTransition(t, r); ev.ID != 3 || ev.CrossID != "a" || ev.From != contractlib.Init || ev.To != contractlib.Pending {
+		t.Fatalf("replayed event, got: %+v", ev)
+	}
+
+	transit("a", contractlib.Executed)
+	transit("b", contractlib.Pending)
+	transit("a", contractlib.Completed)
+
+	for _, want := range []uint64{4, 6} {
+		if ev := readTransition(t, r); ev.ID != want || ev.CrossID != "a" {
+			t.Fatalf("live event, want: %d, got: %+v", want, ev)
+		}
+	}
+
+	completed, closeCompleted := stream("?status=Completed", "")
+	defer closeCompleted()
+
+	if ev := readTransition(t, completed); ev.ID != 6 || ev.To != contractlib.Completed {
+		t.Fatalf("status filtered event, got: %+v", ev)
+	}
+
+	// the streams end when courier stops
+	close(h.streamStop)
+	if _, err := completed.ReadString('\n'); err != io.EOF {
+		t.Fatalf("want EOF of the stopped stream, got: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/v1/events?status=Nope", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("invalid status, want: 400, got: %d", rec.Code)
+	}
+}
+
+func TestTransitionBusDropsSlowSubscriber(t *testing.T) {
+	bus := NewTransitionBus()
+	slow, unsubscribe := bus.Subscribe()
+	defer unsubscribe()
+
+	events := make([]*TransitionEvent, transitionBufferSize+1)
+	for i := range events {
+		events[i] = &TransitionEvent{ID: uint64(i + 1)}
+	}
+	bus.Publish(events)
+
+	n := 0
+	for range slow {
+		n++
+	}
+	if n != transitionBufferSize {
+		t.Fatalf("buffered events, want: %d, got: %d", transitionBufferSize, n)
+	}
+}
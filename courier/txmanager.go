@@ -3,16 +3,19 @@ package courier
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/icodezjb/fabric-study/courier/client"
 	"github.com/icodezjb/fabric-study/courier/contractlib"
 	"github.com/icodezjb/fabric-study/courier/utils/prque"
 	"github.com/icodezjb/fabric-study/log"
 
-	"github.com/asdine/storm/v3"
-	"github.com/asdine/storm/v3/q"
 	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/hyperledger/fabric-protos-go/peer"
+	"github.com/hyperledger/fabric-sdk-go/pkg/common/providers/fab"
 )
 
 type CrossTx struct {
@@ -22,35 +25,159 @@ type CrossTx struct {
 	TxID        string               `storm:"index"`
 	BlockNumber uint64               `storm:"index"`
 	TimeStamp   *timestamp.Timestamp `storm:"index"`
+
+	// Attempts is the number of the failed sends to the outchain
+	Attempts uint32
+	// NextAttempt is the unix time of the next send to the outchain after a failure
+	NextAttempt int64
+
+	// CommitTxID is the fabric transaction of the last commit invocation
+	CommitTxID string `storm:"index"`
+	// CommitOutcome is the result of the last commit invocation, e.g. Committed, Invalidated(MVCC_READ_CONFLICT)
+	CommitOutcome string
+
+	// History is the append-only list of the status changes
+	History []StatusChange
+	// Notes are the annotations of the operators
+	Notes []OperatorNote
+
+	// Version is the schema version of the saved record, 1 for the records saved before it
+	Version int
+	// ContractType is the type of the contract, the version 1 records infer it from the status
+	ContractType contractlib.ContractType
+}
+
+type StatusChange struct {
+	// From is omitted for the status the tx is created with
+	From contractlib.CStatus `json:",omitempty"`
+	To   contractlib.CStatus
+	// Time is the unix time in nanoseconds
+	Time   int64
+	Reason string
+}
+
+// Transition moves the contract to the given status and appends the change to the history,
+// the illegal transitions are rejected, changing to the current status is a no-op
+func (c *CrossTx) Transition(to contractlib.CStatus, reason string) error {
+	from := c.GetStatus()
+	if from == to {
+		return nil
+	}
+
+	if err := contractlib.ValidateTransition(from, to); err != nil {
+		return fmt.Errorf("crossID %s: %w", c.CrossID, err)
+	}
+
+	c.UpdateStatus(to)
+	c.History = append(c.History, StatusChange{From: from, To: to, Time: time.Now().UnixNano(), Reason: reason})
+
+	return nil
 }
 
-func (c *CrossTx) UnmarshalJSON(bytes []byte) (err error) {
-	var errList []error
+// pendingSince returns the time the tx last entered Pending, after a catch-up, a retry or a requeue
+// it is later than the precommit, the precommit time if the history has no Pending entry
+func (c *CrossTx) pendingSince() time.Time {
+	for i := len(c.History) - 1; i >= 0; i-- {
+		if c.History[i].To == contractlib.Pending {
+			return time.Unix(0, c.History[i].Time)
+		}
+	}
+
+	if c.TimeStamp == nil {
+		return time.Time{}
+	}
+	return time.Unix(c.TimeStamp.Seconds, int64(c.TimeStamp.Nanos))
+}
 
+// UnmarshalJSON decodes the CrossTx records of all the schema versions, CrossID and IContract are required,
+// the other fields are absent in the records saved before them, the records of a newer version are refused
+func (c *CrossTx) UnmarshalJSON(bytes []byte) error {
 	var objMap map[string]*json.RawMessage
-	errList = append(errList, json.Unmarshal(bytes, &objMap))
-	errList = append(errList, json.Unmarshal(*objMap["PK"], &c.PK))
-	errList = append(errList, json.Unmarshal(*objMap["CrossID"], &c.CrossID))
-	errList = append(errList, json.Unmarshal(*objMap["TxID"], &c.TxID))
-	errList = append(errList, json.Unmarshal(*objMap["BlockNumber"], &c.BlockNumber))
-	errList = append(errList, json.Unmarshal(*objMap["TimeStamp"], &c.TimeStamp))
+	if err := json.Unmarshal(bytes, &objMap); err != nil {
+		return fmt.Errorf("crossTx record: %w", err)
+	}
 
-	c.IContract, err = contractlib.RebuildIContract(*objMap["IContract"])
-	errList = append(errList, err)
+	decode := func(key string, field interface{}, required bool) error {
+		raw, ok := objMap[key]
+		if !ok || raw == nil {
+			if required {
+				return fmt.Errorf("crossTx %s record missing field %s", c.CrossID, key)
+			}
+			return nil
+		}
 
-	for _, err := range errList {
-		if err != nil {
+		if err := json.Unmarshal(*raw, field); err != nil {
+			return fmt.Errorf("crossTx %s record field %s: %w", c.CrossID, key, err)
+		}
+		return nil
+	}
+
+	if err := decode("CrossID", &c.CrossID, true); err != nil {
+		return err
+	}
+
+	c.Version = 1
+	if err := decode("Version", &c.Version, false); err != nil {
+		return err
+	}
+	if c.Version > SchemaVersion {
+		return fmt.Errorf("crossTx %s record version %d, supported %d: %w", c.CrossID, c.Version, SchemaVersion, ErrNewerSchema)
+	}
+
+	fields := []struct {
+		key   string
+		field interface{}
+	}{
+		{"PK", &c.PK},
+		{"TxID", &c.TxID},
+		{"BlockNumber", &c.BlockNumber},
+		{"TimeStamp", &c.TimeStamp},
+		{"ContractType", &c.ContractType},
+		{"Attempts", &c.Attempts},
+		{"NextAttempt", &c.NextAttempt},
+		{"CommitTxID", &c.CommitTxID},
+		{"CommitOutcome", &c.CommitOutcome},
+		{"History", &c.History},
+		{"Notes", &c.Notes},
+	}
+	for _, f := range fields {
+		if err := decode(f.key, f.field, false); err != nil {
 			return err
 		}
 	}
 
+	var contract json.RawMessage
+	if err := decode("IContract", &contract, true); err != nil {
+		return err
+	}
+
+	var err error
+	if c.ContractType != "" {
+		c.IContract, err = contractlib.RebuildIContractAs(c.ContractType, contract)
+	} else {
+		// the version 1 records
+		c.IContract, err = contractlib.RebuildIContract(contract)
+	}
+	if err != nil {
+		return fmt.Errorf("crossTx %s record field IContract: %w", c.CrossID, err)
+	}
+
 	return nil
 }
 
+// stamp sets the schema version and the contract type of the record to be saved
+func (c *CrossTx) stamp() {
+	c.Version = SchemaVersion
+	c.ContractType = contractlib.TypeOf(c.IContract)
+}
+
 type CrossTxReceipt struct {
 	CrossID  string
 	Receipt  string
 	Sequence int64
+
+	// commitAttempts is the number of the failed commit invocations
+	commitAttempts int
 }
 
 type Prqueue struct {
@@ -59,41 +186,108 @@ type Prqueue struct {
 	mu      sync.Mutex
 }
 
+const (
+	// maxTimeoutCheckInterval bounds the interval of checking the pending deadline
+	maxTimeoutCheckInterval = time.Minute
+
+	// retryCheckInterval is the interval of checking the txs due to resend
+	retryCheckInterval = time.Second
+	// defaultMaxSendAttempts and defaultRetryBackoff are used when the config leaves them unset
+	defaultMaxSendAttempts = 10
+	defaultRetryBackoff    = time.Second
+	// maxRetryBackoff bounds the delay between two sends of a tx
+	maxRetryBackoff = 10 * time.Minute
+)
+
 type TxManager struct {
 	DB
 	oClient client.OutChainClient
 	fClient client.FabricClient
+	// pipeline is the ID of the pipeline, the label of the metrics
+	pipeline string
 
 	wg     sync.WaitGroup
 	stopCh chan struct{}
 
 	pending  Prqueue
 	executed Prqueue
+	// retry holds the txs waiting for the backoff after a failed send, prioritized by the next attempt
+	retry Prqueue
+
+	// maxSendAttempts is the number of the failed sends before a tx is dead-lettered
+	maxSendAttempts int
+	// retryBackoff is the delay after the first failed send, doubled on every failure
+	retryBackoff time.Duration
+
+	// pendingTimeout is the deadline of a Pending tx since it entered Pending, 0 disables it
+	pendingTimeout time.Duration
+	// aborting is the set of the crossIDs whose abort is invoked but not synced yet
+	aborting map[string]struct{}
+
+	// receiptMu serializes the receipt deduplication
+	receiptMu sync.Mutex
+
+	// running is read by the health checks
+	running int32
+	// lastSend is the result of the last send to the outchain
+	sendMu   sync.Mutex
+	lastSend *SendResult
+}
+
+// SendResult is the result of a send to the outchain
+type SendResult struct {
+	Time time.Time
+	// Sent and Failed are the numbers of the CrossTxs accepted and failed by the outchain
+	Sent   int
+	Failed int
+	// Error is one of the errors of the failed CrossTxs
+	Error string `json:",omitempty"`
 }
 
-func NewTxManager(fabCli client.FabricClient, outCli client.OutChainClient, db DB) *TxManager {
-	return &TxManager{
-		DB:       db,
-		stopCh:   make(chan struct{}),
-		pending:  Prqueue{prq: prque.New(nil), process: make(chan struct{}, 4)},
-		executed: Prqueue{prq: prque.New(nil), process: make(chan struct{}, 8)},
-		oClient:  outCli,
-		fClient:  fabCli,
+func NewTxManager(cfg *client.Config, fabCli client.FabricClient, outCli client.OutChainClient, db DB) *TxManager {
+	t := &TxManager{
+		DB:              db,
+		stopCh:          make(chan struct{}),
+		pending:         Prqueue{prq: prque.New(nil), process: make(chan struct{}, 4)},
+		executed:        Prqueue{prq: prque.New(nil), process: make(chan struct{}, 8)},
+		retry:           Prqueue{prq: prque.New(nil)},
+		oClient:         outCli,
+		fClient:         fabCli,
+		maxSendAttempts: cfg.MaxSendAttempts,
+		retryBackoff:    cfg.RetryBackoff,
+		pendingTimeout:  cfg.PendingTimeout,
+		aborting:        make(map[string]struct{}),
 	}
+
+	if t.maxSendAttempts <= 0 {
+		t.maxSendAttempts = defaultMaxSendAttempts
+	}
+	if t.retryBackoff <= 0 {
+		t.retryBackoff = defaultRetryBackoff
+	}
+
+	return t
 }
 
 func (t *TxManager) Start() {
 	log.Info("[TxManager] starting")
+	atomic.StoreInt32(&t.running, 1)
 	t.wg.Add(2)
 	go t.ProcessCrossTxs()
 	go t.ProcessCrossTxReceipts()
 
+	if t.pendingTimeout > 0 {
+		t.wg.Add(1)
+		go t.ProcessPendingTimeouts()
+	}
+
 	t.reload()
 	log.Info("[TxManager] started")
 }
 
 func (t *TxManager) Stop() {
 	log.Info("[TxManager] stopping")
+	atomic.StoreInt32(&t.running, 0)
 	close(t.stopCh)
 	t.wg.Wait()
 
@@ -108,38 +302,71 @@ func (t *TxManager) Stop() {
 
 func (t *TxManager) reload() {
 	log.Debug("[TxManager] reloading")
-	toPending := t.DB.Query(0, 0, []FieldName{TimestampField}, false, q.Eq(StatusField, contractlib.Init))
+	toPending := t.DB.Query(0, 0, []FieldName{TimestampField}, false, StatusIn(contractlib.Init))
 
 	t.pending.mu.Lock()
+	t.retry.mu.Lock()
 	for _, tx := range toPending {
+		// keep the backoff of the txs failed before the restart
+		if tx.NextAttempt > time.Now().Unix() {
+			t.retry.prq.Push(tx, -tx.NextAttempt)
+			continue
+		}
 		t.pending.prq.Push(tx, -tx.TimeStamp.Seconds)
 	}
+	t.retry.mu.Unlock()
 	t.pending.mu.Unlock()
 
 	t.pending.process <- struct{}{}
 
-	log.Debug("[TxManager] reload completed")
-	//TODO: executed queue
+	// the receipts of the executed txs are accepted, but their commit may never land on fabric.
+	// resubmit them, the chaincode commit is a no-op for the already finished contracts
+	toExecuted := t.DB.Query(0, 0, []FieldName{TimestampField}, false, StatusIn(contractlib.Executed))
+
+	t.executed.mu.Lock()
+	for _, tx := range toExecuted {
+		pc, ok := tx.IContract.(*contractlib.PrecommitContract)
+		if !ok {
+			log.Warn("[TxManager] reload executed tx, not a precommit contract", "crossID", tx.CrossID)
+			continue
+		}
+
+		t.executed.prq.Push(CrossTxReceipt{CrossID: tx.CrossID, Receipt: pc.Receipt}, 0)
+	}
+	t.executed.mu.Unlock()
+
+	if len(toExecuted) != 0 {
+		t.executed.process <- struct{}{}
+	}
+
+	log.Debug("[TxManager] reload completed", "pending", len(toPending), "executed", len(toExecuted))
 }
 
-func (t *TxManager) AddCrossTxs(txs []*CrossTx) error {
+// AddCrossTxs stores the CrossTxs, the updates and the invalidated precommits of the block and checkpoints
+// the block in one transaction, then queues the precommit ones
+func (t *TxManager) AddCrossTxs(blockNum uint64, txs []*CrossTx, updates []*CrossTxUpdate, invalids []*InvalidPrecommit) error {
+	// store to db
+	if err := t.DB.SaveBlock(blockNum, txs, updates, invalids); err != nil {
+		return err
+	}
+
+	t.observeCompletions(updates)
+
 	// pick up the precommit contract txs
 	t.pending.mu.Lock()
 	for _, tx := range txs {
-		if tx.Contract.GetStatus() != contractlib.Finished {
+		if tx.Contract.GetStatus() == contractlib.Init {
 			t.pending.prq.Push(tx, -tx.TimeStamp.Seconds)
 		}
 	}
 	t.pending.mu.Unlock()
 
-	// store to db
-	if err := t.DB.Save(txs); err != nil {
-		return err
-	}
-
-	// start send
+	// start send, a queued signal already drains the whole queue
 	if t.pending.prq.Size() != 0 {
-		t.pending.process <- struct{}{}
+		select {
+		case t.pending.process <- struct{}{}:
+		default:
+		}
 	}
 
 	return nil
@@ -151,70 +378,297 @@ func (t *TxManager) ProcessCrossTxs() {
 		log.Info("[TxManager] process crossTx stopped")
 	}()
 
+	retryTicker := time.NewTicker(retryCheckInterval)
+	defer retryTicker.Stop()
+
 	log.Info("[TxManager] process crossTx started")
 	for {
 		select {
 		case <-t.pending.process:
-			var pending = make([]*CrossTx, 0)
-
-			t.pending.mu.Lock()
-			for !t.pending.prq.Empty() {
-				item, _ := t.pending.prq.Pop()
-				tx := item.(*CrossTx)
-				pending = append(pending, tx)
+			t.sendPending()
+		case now := <-retryTicker.C:
+			if t.scheduleRetries(now) {
+				t.sendPending()
 			}
-			t.pending.mu.Unlock()
+		case <-t.stopCh:
+			return
+		}
+	}
+}
 
-			successList := make([]string, 0)
-			updaters := make([]func(c *CrossTx), 0)
+func (t *TxManager) sendPending() {
+	var pending = make([]*CrossTx, 0)
 
-			for _, tx := range pending {
-				raw, err := json.Marshal(tx)
-				if err != nil {
-					log.Error("[TxManager] marshal tx", "crossID", tx.CrossID, "status", tx.GetStatus(), "err", err)
-					continue
-				}
+	t.pending.mu.Lock()
+	for !t.pending.prq.Empty() {
+		item, _ := t.pending.prq.Pop()
+		tx := item.(*CrossTx)
+		pending = append(pending, tx)
+	}
+	t.pending.mu.Unlock()
 
-				// TODO: batch send, MaxBatchSize = 64
-				if err := t.oClient.Send(raw); err != nil {
-					log.Error("[TxManager] send tx to OutChain", "crossID", tx.CrossID, "status", tx.GetStatus(), "err", err)
-					t.pending.prq.Push(tx, -tx.TimeStamp.Seconds)
-					continue
-				}
+	if len(pending) == 0 {
+		return
+	}
+
+	sendList := make([]*CrossTx, 0, len(pending))
+	raws := make([][]byte, 0, len(pending))
+	for _, tx := range pending {
+		raw, err := json.Marshal(tx)
+		if err != nil {
+			log.Error("[TxManager] marshal tx", "crossID", tx.CrossID, "status", tx.GetStatus(), "err", err)
+			continue
+		}
+		sendList = append(sendList, tx)
+		raws = append(raws, raw)
+	}
+
+	errs := t.send(raws)
+
+	idList := make([]string, 0, len(sendList))
+	updaters := make([]func(c *CrossTx) error, 0, len(sendList))
+	successList := make([]string, 0, len(sendList))
+	var retries []*CrossTx
+	var deadLetters int
 
-				successList = append(successList, tx.CrossID)
-				updaters = append(updaters, func(c *CrossTx) {
-					c.UpdateStatus(contractlib.Pending)
-				})
+	now := time.Now()
+	for i, tx := range sendList {
+		idList = append(idList, tx.CrossID)
+
+		if errs[i] == nil {
+			successList = append(successList, tx.CrossID)
+			updaters = append(updaters, func(c *CrossTx) error {
+				return c.Transition(contractlib.Pending, "sent to outchain")
+			})
+			continue
+		}
+
+		tx.Attempts++
+		attempts := tx.Attempts
+
+		if int(attempts) >= t.maxSendAttempts {
+			deadLetters++
+			log.Error("[TxManager] send tx to OutChain, dead-lettered", "crossID", tx.CrossID, "attempts", attempts, "err", errs[i])
+			reason := fmt.Sprintf("send to outchain failed %d times: %v", attempts, errs[i])
+			updaters = append(updaters, func(c *CrossTx) error {
+				c.Attempts = attempts
+				c.NextAttempt = 0
+				return c.Transition(contractlib.DeadLetter, reason)
+			})
+			continue
+		}
+
+		tx.NextAttempt = now.Add(t.backoff(attempts)).Unix()
+		nextAttempt := tx.NextAttempt
+
+		log.Warn("[TxManager] send tx to OutChain", "crossID", tx.CrossID, "attempts", attempts, "nextAttempt", time.Unix(nextAttempt, 0), "err", errs[i])
+		updaters = append(updaters, func(c *CrossTx) error {
+			if c.GetStatus() != contractlib.Init {
+				return fmt.Errorf("crossID %s is %s, not retried", c.CrossID, c.GetStatus())
 			}
+			c.Attempts = attempts
+			c.NextAttempt = nextAttempt
+			return nil
+		})
+		retries = append(retries, tx)
+	}
 
-			go func() {
-				if err := t.DB.Updates(successList, updaters); err != nil {
-					log.Debug("[TxManager] update Init to Pending", "len(successList)", len(successList), "err", err)
-					panic(err)
-				}
-			}()
+	// update synchronously, the attempts of a tx must not be overwritten by an older update
+	err := t.DB.Updates(idList, updaters)
+	rejected, ok := rejectedUpdates(err)
+	if !ok {
+		// the db is unchanged, the whole batch is sent again after the backoff
+		log.Error("[TxManager] update sent txs, retry the batch", "len(idList)", len(idList), "err", err)
+		t.retryLater(sendList, now.Add(t.retryBackoff).Unix())
+		return
+	}
 
-			log.Info("[TxManager] update Init to Pending", "len(successList)", len(successList))
+	// the txs whose update is rejected changed meanwhile, e.g. aborted, they are neither retried nor released
+	t.retry.mu.Lock()
+	for _, tx := range retries {
+		if _, ok := rejected[tx.CrossID]; !ok {
+			t.retry.prq.Push(tx, -tx.NextAttempt)
+		}
+	}
+	t.retry.mu.Unlock()
 
-		case <-t.stopCh:
-			return
+	sent := successList[:0]
+	for _, id := range successList {
+		if _, ok := rejected[id]; !ok {
+			sent = append(sent, id)
+		}
+	}
+
+	log.Info("[TxManager] update Init to Pending", "len(successList)", len(sent), "retry", len(sendList)-len(successList)-deadLetters, "deadLetter", deadLetters, "rejected", len(rejected))
+
+	t.releaseParked(sent)
+}
+
+// backoff returns the delay of the next send after the given number of failed sends
+func (t *TxManager) backoff(attempts uint32) time.Duration {
+	delay := t.retryBackoff
+	for i := uint32(1); i < attempts && delay < maxRetryBackoff; i++ {
+		delay *= 2
+	}
+
+	if delay > maxRetryBackoff {
+		delay = maxRetryBackoff
+	}
+
+	return delay
+}
+
+// retryLater queues the txs to be sent again at the unix time, scheduleRetries moves them back to the pending queue
+func (t *TxManager) retryLater(txs []*CrossTx, nextAttempt int64) {
+	t.retry.mu.Lock()
+	for _, tx := range txs {
+		tx.NextAttempt = nextAttempt
+		t.retry.prq.Push(tx, -nextAttempt)
+	}
+	t.retry.mu.Unlock()
+}
+
+// scheduleRetries moves the txs due to resend to the pending queue, reports whether any is moved
+func (t *TxManager) scheduleRetries(now time.Time) bool {
+	var due []*CrossTx
+
+	t.retry.mu.Lock()
+	for !t.retry.prq.Empty() {
+		item, priority := t.retry.prq.Pop()
+		if -priority > now.Unix() {
+			t.retry.prq.Push(item, priority)
+			break
+		}
+		due = append(due, item.(*CrossTx))
+	}
+	t.retry.mu.Unlock()
+
+	if len(due) == 0 {
+		return false
+	}
+
+	t.pending.mu.Lock()
+	for _, tx := range due {
+		t.pending.prq.Push(tx, -tx.TimeStamp.Seconds)
+	}
+	t.pending.mu.Unlock()
+
+	return true
+}
+
+// DeadLetters returns the txs which are dead-lettered after too many failed sends
+func (t *TxManager) DeadLetters() []*CrossTx {
+	return t.DB.Query(0, 0, []FieldName{TimestampField}, false, StatusIn(contractlib.DeadLetter))
+}
+
+// Requeue resets the attempts of a dead-lettered tx and sends it to the outchain again
+func (t *TxManager) Requeue(crossID string) error {
+	tx := t.DB.One(CrossIdIndex, crossID)
+	if tx == nil {
+		return fmt.Errorf("crossID %s not found", crossID)
+	}
+
+	if tx.GetStatus() != contractlib.DeadLetter {
+		return fmt.Errorf("crossID %s is %s, not %s", crossID, tx.GetStatus(), contractlib.DeadLetter)
+	}
+
+	requeue := func(c *CrossTx) error {
+		c.Attempts = 0
+		c.NextAttempt = 0
+		return c.Transition(contractlib.Init, "requeued by operator")
+	}
+
+	if err := t.DB.Updates([]string{crossID}, []func(c *CrossTx) error{requeue}); err != nil {
+		return err
+	}
+
+	if err := requeue(tx); err != nil {
+		return err
+	}
+
+	t.pending.mu.Lock()
+	t.pending.prq.Push(tx, -tx.TimeStamp.Seconds)
+	t.pending.mu.Unlock()
+
+	select {
+	case t.pending.process <- struct{}{}:
+	case <-t.stopCh:
+	}
+
+	log.Info("[TxManager] requeue dead-lettered tx", "crossID", crossID)
+
+	return nil
+}
+
+// send delivers the marshalled txs to the outchain, in batches if the client supports it
+func (t *TxManager) send(raws [][]byte) []error {
+	if bc, ok := t.oClient.(client.BatchOutChainClient); ok {
+		start := time.Now()
+		errs := bc.SendBatch(raws)
+		sendSeconds.With(t.pipeline).Observe(time.Since(start).Seconds())
+
+		t.countSendErrors(errs)
+		return errs
+	}
+
+	errs := make([]error, len(raws))
+	for i, raw := range raws {
+		start := time.Now()
+		errs[i] = t.oClient.Send(raw)
+		sendSeconds.With(t.pipeline).Observe(time.Since(start).Seconds())
+	}
+
+	t.countSendErrors(errs)
+	return errs
+}
+
+func (t *TxManager) countSendErrors(errs []error) {
+	result := &SendResult{Time: time.Now()}
+	for _, err := range errs {
+		if err != nil {
+			sendErrors.With(t.pipeline).Inc()
+			result.Failed++
+			result.Error = err.Error()
+			continue
 		}
+		result.Sent++
 	}
+
+	t.sendMu.Lock()
+	t.lastSend = result
+	t.sendMu.Unlock()
+}
+
+// Running reports whether the TxManager is started and not stopped
+func (t *TxManager) Running() bool {
+	return atomic.LoadInt32(&t.running) == 1
+}
+
+// LastSend returns the result of the last send to the outchain, nil if nothing is sent yet
+func (t *TxManager) LastSend() *SendResult {
+	t.sendMu.Lock()
+	defer t.sendMu.Unlock()
+
+	return t.lastSend
 }
 
 func (t *TxManager) AddCrossTxReceipts(ctrs []CrossTxReceipt) error {
-	var updaters []func(c *CrossTx)
+	var updaters []func(c *CrossTx) error
 	var ids []string
 
 	for _, ctr := range ctrs {
+		ctr := ctr
 		ids = append(ids, ctr.CrossID)
-		updaters = append(updaters, func(c *CrossTx) {
-			c.UpdateStatus(contractlib.Executed)
+		updaters = append(updaters, func(c *CrossTx) error {
+			if err := c.Transition(contractlib.Executed, fmt.Sprintf("receipt accepted, sequence %d", ctr.Sequence)); err != nil {
+				return err
+			}
+
 			pc, ok := c.IContract.(*contractlib.PrecommitContract)
 			if ok {
 				pc.UpdateReceipt(ctr.Receipt)
 			}
+			return nil
 		})
 	}
 
@@ -243,17 +697,36 @@ func (t *TxManager) ProcessCrossTxReceipts() {
 			}
 			t.executed.mu.Unlock()
 
-			if err := t.AddCrossTxReceipts(executed); err != nil {
-				if errors.Is(err, storm.ErrNotFound) {
+			if len(executed) == 0 {
+				break
+			}
+
+			err := t.AddCrossTxReceipts(executed)
+			if rejected, ok := rejectedUpdates(err); ok && len(rejected) != 0 {
+				// the txs which are no longer Pending or Executed are not committed
+				log.Warn("[TxManager] handle receipt, rejected", "err", err)
+				accepted := executed[:0]
+				for _, ctr := range executed {
+					if _, ok := rejected[ctr.CrossID]; !ok {
+						accepted = append(accepted, ctr)
+					}
+				}
+				executed, err = accepted, nil
+			}
+
+			if err != nil {
+				if errors.Is(err, ErrCrossTxNotFound) {
 					log.Info("[TxManager] discard receipts", "receipts", executed)
 					break
 				}
 
 				log.Warn("[TxManager] handle receipt", "err", err)
 
+				t.executed.mu.Lock()
 				for _, ctr := range executed {
 					t.executed.prq.Push(ctr, -ctr.Sequence)
 				}
+				t.executed.mu.Unlock()
 				break
 			}
 
@@ -261,15 +734,10 @@ func (t *TxManager) ProcessCrossTxReceipts() {
 
 			t.wg.Add(1)
 			go func() {
-				t.wg.Done()
+				defer t.wg.Done()
 
 				for _, ctr := range executed {
-					_, err := t.fClient.InvokeChainCode("commit", []string{ctr.CrossID, ctr.Receipt})
-					if err != nil {
-						log.Error("[ProcessReq] send tx to fabric", "InvokeChainCode err", err)
-					}
-
-					t.executed.prq.Push(ctr, -ctr.Sequence)
+					t.commit(ctr)
 				}
 			}()
 
@@ -278,3 +746,189 @@ func (t *TxManager) ProcessCrossTxReceipts() {
 		}
 	}
 }
+
+// commit invokes the chaincode commit of an executed tx, records the fabric transaction
+// and decides the retry by the outcome
+func (t *TxManager) commit(ctr CrossTxReceipt) {
+	tx := t.DB.One(CrossIdIndex, ctr.CrossID)
+	if tx == nil || tx.GetStatus() != contractlib.Executed {
+		log.Debug("[TxManager] skip commit, tx not executed", "crossID", ctr.CrossID)
+		return
+	}
+
+	if t.committedBefore(tx) {
+		return
+	}
+
+	start := time.Now()
+	txID, err := t.fClient.InvokeChainCode("commit", []string{ctr.CrossID, ctr.Receipt})
+	outcome, code := client.InvokeOutcomeOf(err)
+
+	commitSeconds.With(t.pipeline, outcome.String()).Observe(time.Since(start).Seconds())
+	if outcome != client.Committed {
+		commitFailures.With(t.pipeline, outcome.String()).Inc()
+	}
+
+	commitOutcome := outcome.String()
+	if outcome == client.Invalidated {
+		commitOutcome = fmt.Sprintf("%s(%s)", outcome, code)
+	}
+
+	if err := t.DB.Updates([]string{ctr.CrossID}, []func(c *CrossTx) error{func(c *CrossTx) error {
+		if txID != "" {
+			c.CommitTxID = string(txID)
+		}
+		c.CommitOutcome = commitOutcome
+		return nil
+	}}); err != nil {
+		log.Error("[TxManager] record commit tx", "crossID", ctr.CrossID, "commitTxID", txID, "err", err)
+	}
+
+	switch outcome {
+	case client.Committed:
+		// the commit event synced from the block completes the tx
+		log.Info("[TxManager] commit tx committed", "crossID", ctr.CrossID, "commitTxID", txID)
+		return
+	case client.Invalidated:
+		if code != peer.TxValidationCode_MVCC_READ_CONFLICT && code != peer.TxValidationCode_PHANTOM_READ_CONFLICT {
+			// resubmitting the same commit is invalidated again, left Executed for an operator
+			log.Error("[TxManager] commit tx invalidated", "crossID", ctr.CrossID, "commitTxID", txID, "code", code)
+			return
+		}
+
+		// the conflicting state is committed now, a new endorsement reads it
+		log.Warn("[TxManager] commit tx invalidated, resubmit", "crossID", ctr.CrossID, "commitTxID", txID, "code", code)
+		t.retryCommit(ctr, 0)
+	case client.EndorsementFailed:
+		// the chaincode or the endorsers reject the same commit again, left Executed for an operator
+		log.Error("[TxManager] commit tx rejected", "crossID", ctr.CrossID, "err", err)
+	default:
+		// CommitUnknown or Unavailable, the recorded commit tx is checked before the retry
+		log.Warn("[TxManager] commit tx failed", "crossID", ctr.CrossID, "outcome", outcome, "err", err)
+		t.retryCommit(ctr, t.backoff(uint32(ctr.commitAttempts+1)))
+	}
+}
+
+// committedBefore checks the commit tx recorded with an unknown outcome, it reports whether the tx
+// is committed as valid in the ledger and needs no new invocation
+func (t *TxManager) committedBefore(tx *CrossTx) bool {
+	if tx.CommitTxID == "" || tx.CommitOutcome != client.CommitUnknown.String() {
+		return false
+	}
+
+	code, err := t.fClient.QueryTxValidation(fab.TransactionID(tx.CommitTxID))
+	if err != nil || code != peer.TxValidationCode_VALID {
+		log.Debug("[TxManager] recorded commit tx not valid", "crossID", tx.CrossID, "commitTxID", tx.CommitTxID, "code", code, "err", err)
+		return false
+	}
+
+	if err := t.DB.Updates([]string{tx.CrossID}, []func(c *CrossTx) error{func(c *CrossTx) error {
+		c.CommitOutcome = client.Committed.String()
+		return nil
+	}}); err != nil {
+		log.Error("[TxManager] record commit tx", "crossID", tx.CrossID, "commitTxID", tx.CommitTxID, "err", err)
+	}
+
+	// the commit event synced from the block completes the tx
+	log.Info("[TxManager] recorded commit tx committed", "crossID", tx.CrossID, "commitTxID", tx.CommitTxID)
+	return true
+}
+
+// retryCommit pushes the receipt back to the executed queue after the delay, unless the TxManager is stopped.
+// After too many failures the tx stays Executed with the exhausted outcome, it is resubmitted on restart
+func (t *TxManager) retryCommit(ctr CrossTxReceipt, delay time.Duration) {
+	ctr.commitAttempts++
+	if ctr.commitAttempts >= t.maxSendAttempts {
+		log.Error("[TxManager] commit tx, too many failures", "crossID", ctr.CrossID, "attempts", ctr.commitAttempts)
+		attempts := ctr.commitAttempts
+		if err := t.DB.Updates([]string{ctr.CrossID}, []func(c *CrossTx) error{func(c *CrossTx) error {
+			c.CommitOutcome = fmt.Sprintf("Exhausted(%d attempts, last %s)", attempts, c.CommitOutcome)
+			return nil
+		}}); err != nil {
+			log.Error("[TxManager] record exhausted commit", "crossID", ctr.CrossID, "err", err)
+		}
+		return
+	}
+
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+
+		select {
+		case <-timer.C:
+		case <-t.stopCh:
+			return
+		}
+
+		t.executed.mu.Lock()
+		t.executed.prq.Push(ctr, -ctr.Sequence)
+		t.executed.mu.Unlock()
+
+		select {
+		case t.executed.process <- struct{}{}:
+		case <-t.stopCh:
+		}
+	}()
+}
+
+// ProcessPendingTimeouts aborts the Pending txs whose deadline expired,
+// the abort event synced from fabric moves them to Aborted
+func (t *TxManager) ProcessPendingTimeouts() {
+	defer func() {
+		t.wg.Done()
+		log.Info("[TxManager] process pending timeouts stopped")
+	}()
+
+	interval := t.pendingTimeout / 2
+	if interval > maxTimeoutCheckInterval {
+		interval = maxTimeoutCheckInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	log.Info("[TxManager] process pending timeouts started", "timeout", t.pendingTimeout)
+	for {
+		select {
+		case <-ticker.C:
+			t.abortExpired(time.Now())
+		case <-t.stopCh:
+			return
+		}
+	}
+}
+
+func (t *TxManager) abortExpired(now time.Time) {
+	deadline := now.Add(-t.pendingTimeout).Unix()
+
+	var expired []*CrossTx
+	aborting := make(map[string]struct{})
+	for _, tx := range t.DB.Query(0, 0, nil, false, StatusIn(contractlib.Pending)) {
+		if tx.pendingSince().Unix() > deadline {
+			continue
+		}
+
+		if _, ok := t.aborting[tx.CrossID]; ok {
+			aborting[tx.CrossID] = struct{}{}
+			continue
+		}
+
+		expired = append(expired, tx)
+	}
+
+	for _, tx := range expired {
+		if _, err := t.fClient.InvokeChainCode("abort", []string{tx.CrossID, "pending timeout"}); err != nil {
+			log.Error("[TxManager] abort expired tx", "crossID", tx.CrossID, "err", err)
+			continue
+		}
+
+		log.Info("[TxManager] abort expired tx", "crossID", tx.CrossID, "timeout", t.pendingTimeout)
+		aborting[tx.CrossID] = struct{}{}
+	}
+
+	// the txs which left Pending are no longer tracked
+	t.aborting = aborting
+}
@@ -0,0 +1,560 @@
+package courier
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/icodezjb/fabric-study/courier/client"
+	"github.com/icodezjb/fabric-study/courier/contractlib"
+
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/hyperledger/fabric-protos-go/peer"
+	"github.com/hyperledger/fabric-sdk-go/pkg/common/errors/status"
+	"github.com/hyperledger/fabric-sdk-go/pkg/common/providers/fab"
+)
+
+func newTestStore(t *testing.T) (*Store, func()) {
+	dir, err := ioutil.TempDir("", "courier")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root, err := OpenStormDB(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := NewStore(root, "mychannel", "mycc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return store, func() {
+		root.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func newTestCrossTx(crossID string, status contractlib.CStatus, receipt string) *CrossTx {
+	return &CrossTx{
+		Contract: contractlib.Contract{IContract: &contractlib.PrecommitContract{
+			Status:     status,
+			ContractID: crossID,
+			Receipt:    receipt,
+		}},
+		CrossID:   crossID,
+		TxID:      "tx-" + crossID,
+		TimeStamp: &timestamp.Timestamp{Seconds: time.Now().Unix()},
+	}
+}
+
+type invocation struct {
+	fcn  string
+	args []string
+}
+
+// recordFabricClient records the chaincode invocations
+type recordFabricClient struct {
+	MockFabricClient
+
+	mu      sync.Mutex
+	invokes []invocation
+	invoked chan invocation
+}
+
+func (r *recordFabricClient) InvokeChainCode(fcn string, args []string) (fab.TransactionID, error) {
+	r.mu.Lock()
+	r.invokes = append(r.invokes, invocation{fcn, args})
+	r.mu.Unlock()
+
+	if r.invoked != nil {
+		r.invoked <- invocation{fcn, args}
+	}
+	return "", nil
+}
+
+func TestStatusIn(t *testing.T) {
+	store, closeStore := newTestStore(t)
+	defer closeStore()
+
+	if err := store.Save([]*CrossTx{
+		newTestCrossTx("a", contractlib.Init, ""),
+		newTestCrossTx("b", contractlib.Executed, "receipt-b"),
+		newTestCrossTx("c", contractlib.Completed, "receipt-c"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	txs := store.Query(0, 0, nil, false, StatusIn(contractlib.Init, contractlib.Executed))
+	if len(txs) != 2 || txs[0].CrossID != "a" || txs[1].CrossID != "b" {
+		t.Fatalf("StatusIn(Init, Executed), want: [a b], got: %v", txs)
+	}
+}
+
+func TestReloadExecuted(t *testing.T) {
+	store, closeStore := newTestStore(t)
+	defer closeStore()
+
+	if err := store.Save([]*CrossTx{newTestCrossTx("a", contractlib.Executed, "receipt-a")}); err != nil {
+		t.Fatal(err)
+	}
+
+	fabCli := &recordFabricClient{invoked: make(chan invocation, 1)}
+	txm := NewTxManager(&client.Config{}, fabCli, &client.MockOutChainClient{}, store)
+	txm.Start()
+	defer txm.Stop()
+
+	select {
+	case inv := <-fabCli.invoked:
+		if inv.fcn != "commit" || len(inv.args) != 2 || inv.args[0] != "a" || inv.args[1] != "receipt-a" {
+			t.Fatalf("invoke, want: commit [a receipt-a], got: %s %v", inv.fcn, inv.args)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("executed tx not resubmitted")
+	}
+
+	if tx := store.One(CrossIdIndex, "a"); tx == nil || tx.GetStatus() != contractlib.Executed {
+		t.Fatalf("status, want: Executed, got: %v", tx)
+	}
+}
+
+func TestAbortExpired(t *testing.T) {
+	store, closeStore := newTestStore(t)
+	defer closeStore()
+
+	long := time.Now().Add(-2 * time.Minute)
+	expired := newTestCrossTx("a", contractlib.Pending, "")
+	expired.TimeStamp.Seconds = long.Unix()
+	expired.History = []StatusChange{{To: contractlib.Init, Time: long.UnixNano()}, {From: contractlib.Init, To: contractlib.Pending, Time: long.UnixNano()}}
+
+	// the precommit is as old, but the tx entered Pending again after a requeue
+	requeued := newTestCrossTx("c", contractlib.Pending, "")
+	requeued.TimeStamp.Seconds = long.Unix()
+	requeued.History = []StatusChange{
+		{To: contractlib.Init, Time: long.UnixNano()},
+		{From: contractlib.Init, To: contractlib.DeadLetter, Time: long.UnixNano()},
+		{From: contractlib.DeadLetter, To: contractlib.Init, Time: time.Now().UnixNano()},
+		{From: contractlib.Init, To: contractlib.Pending, Time: time.Now().UnixNano()},
+	}
+	if err := store.Save([]*CrossTx{expired, newTestCrossTx("b", contractlib.Pending, ""), requeued}); err != nil {
+		t.Fatal(err)
+	}
+
+	fabCli := &recordFabricClient{}
+	txm := NewTxManager(&client.Config{PendingTimeout: time.Minute}, fabCli, &client.MockOutChainClient{}, store)
+
+	txm.abortExpired(time.Now())
+	// the abort is not synced yet, the second check must not invoke again
+	txm.abortExpired(time.Now())
+
+	if len(fabCli.invokes) != 1 || fabCli.invokes[0].fcn != "abort" || fabCli.invokes[0].args[0] != "a" {
+		t.Fatalf("invokes, want: [abort a], got: %v", fabCli.invokes)
+	}
+
+	// the synced abort event
+	if err := store.SaveBlock(2, nil, []*CrossTxUpdate{newTransitionUpdate("a", contractlib.Aborted, 2)}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if tx := store.One(CrossIdIndex, "a"); tx == nil || tx.GetStatus() != contractlib.Aborted {
+		t.Fatalf("status, want: Aborted, got: %v", tx)
+	}
+}
+
+// failOutChainClient fails every send
+type failOutChainClient struct{}
+
+func (failOutChainClient) Send([]byte) error {
+	return fmt.Errorf("outchain unavailable")
+}
+
+func (failOutChainClient) Close() {}
+
+func waitStatus(t *testing.T, db DB, crossID string, status contractlib.CStatus) *CrossTx {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		tx := db.One(CrossIdIndex, crossID)
+		if tx != nil && tx.GetStatus() == status {
+			return tx
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("status of %s, want: %s, got: %v", crossID, status, tx)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSendRetryDeadLetter(t *testing.T) {
+	store, closeStore := newTestStore(t)
+	defer closeStore()
+
+	tx := newTestCrossTx("a", contractlib.Init, "")
+	if err := store.Save([]*CrossTx{tx}); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &client.Config{MaxSendAttempts: 2, RetryBackoff: time.Second}
+	txm := NewTxManager(cfg, &recordFabricClient{}, failOutChainClient{}, store)
+
+	txm.pending.prq.Push(tx, 0)
+	txm.sendPending()
+
+	if tx.Attempts != 1 || txm.retry.prq.Size() != 1 {
+		t.Fatalf("after first failure, want: 1 attempt and 1 retry, got: %d attempts and %d retries", tx.Attempts, txm.retry.prq.Size())
+	}
+
+	// not due yet
+	if txm.scheduleRetries(time.Now()) {
+		t.Fatal("retry scheduled before the backoff")
+	}
+
+	if !txm.scheduleRetries(time.Now().Add(time.Second)) {
+		t.Fatal("retry not scheduled after the backoff")
+	}
+	txm.sendPending()
+
+	waitStatus(t, store, "a", contractlib.DeadLetter)
+
+	if deadLetters := txm.DeadLetters(); len(deadLetters) != 1 || deadLetters[0].Attempts != 2 {
+		t.Fatalf("dead letters, want: [a] with 2 attempts, got: %v", deadLetters)
+	}
+
+	txm.oClient = &client.MockOutChainClient{}
+	if err := txm.Requeue("a"); err != nil {
+		t.Fatal(err)
+	}
+	txm.sendPending()
+
+	waitStatus(t, store, "a", contractlib.Pending)
+}
+
+// partialOutChainClient rejects the CrossTxs of the batch in failed
+type partialOutChainClient struct {
+	failOutChainClient
+	failed map[string]bool
+	sent   [][]byte
+}
+
+func (p *partialOutChainClient) SendBatch(raws [][]byte) []error {
+	p.sent = raws
+	errs := make([]error, len(raws))
+	for i, raw := range raws {
+		var tx CrossTx
+		if err := json.Unmarshal(raw, &tx); err != nil {
+			errs[i] = err
+		} else if p.failed[tx.CrossID] {
+			errs[i] = fmt.Errorf("outchain rejected %s", tx.CrossID)
+		}
+	}
+	return errs
+}
+
+func TestSendBatchPartialFailure(t *testing.T) {
+	store, closeStore := newTestStore(t)
+	defer closeStore()
+
+	txs := []*CrossTx{newTestCrossTx("a", contractlib.Init, ""), newTestCrossTx("b", contractlib.Init, ""), newTestCrossTx("c", contractlib.Init, "")}
+	if err := store.Save(txs); err != nil {
+		t.Fatal(err)
+	}
+
+	outCli := &partialOutChainClient{failed: map[string]bool{"b": true}}
+	txm := NewTxManager(&client.Config{RetryBackoff: time.Second}, &recordFabricClient{}, outCli, store)
+
+	for _, tx := range txs {
+		txm.pending.prq.Push(tx, -tx.TimeStamp.Seconds)
+	}
+	txm.sendPending()
+
+	if len(outCli.sent) != 3 {
+		t.Fatalf("batch, want: 3 txs, got: %d", len(outCli.sent))
+	}
+
+	for _, id := range []string{"a", "c"} {
+		if tx := store.One(CrossIdIndex, id); tx.GetStatus() != contractlib.Pending || tx.Attempts != 0 {
+			t.Fatalf("sent %s, want: Pending without attempts, got: %s %d", id, tx.GetStatus(), tx.Attempts)
+		}
+	}
+	if tx := store.One(CrossIdIndex, "b"); tx.GetStatus() != contractlib.Init || tx.Attempts != 1 || tx.NextAttempt == 0 {
+		t.Fatalf("failed b, want: Init with 1 attempt, got: %s %d %d", tx.GetStatus(), tx.Attempts, tx.NextAttempt)
+	}
+
+	if txm.retry.prq.Size() != 1 || !txm.pending.prq.Empty() {
+		t.Fatalf("queues, want: 1 retry and no pending, got: %d retries and %d pending", txm.retry.prq.Size(), txm.pending.prq.Size())
+	}
+	if item, _ := txm.retry.prq.Pop(); item.(*CrossTx).CrossID != "b" {
+		t.Fatalf("retry, want: b, got: %s", item.(*CrossTx).CrossID)
+	}
+}
+
+// failUpdatesDB fails the Updates, e.g. a busy database
+type failUpdatesDB struct {
+	*Store
+}
+
+func (failUpdatesDB) Updates([]string, []func(c *CrossTx) error) error {
+	return fmt.Errorf("database is locked")
+}
+
+func TestSendUpdateFailure(t *testing.T) {
+	store, closeStore := newTestStore(t)
+	defer closeStore()
+
+	tx := newTestCrossTx("a", contractlib.Init, "")
+	if err := store.Save([]*CrossTx{tx}); err != nil {
+		t.Fatal(err)
+	}
+
+	txm := NewTxManager(&client.Config{RetryBackoff: time.Second}, &recordFabricClient{}, &client.MockOutChainClient{}, failUpdatesDB{store})
+
+	txm.pending.prq.Push(tx, 0)
+	txm.sendPending()
+
+	if txm.retry.prq.Size() != 1 {
+		t.Fatalf("after the failed update, want: 1 retry, got: %d", txm.retry.prq.Size())
+	}
+	if got := store.One(CrossIdIndex, "a"); got.GetStatus() != contractlib.Init {
+		t.Fatalf("status, want: Init, got: %s", got.GetStatus())
+	}
+
+	// the db is back, the batch is sent again
+	txm.DB = store
+	if !txm.scheduleRetries(time.Now().Add(time.Second)) {
+		t.Fatal("batch not scheduled after the backoff")
+	}
+	txm.sendPending()
+
+	waitStatus(t, store, "a", contractlib.Pending)
+}
+
+func TestSendRejectedUpdate(t *testing.T) {
+	store, closeStore := newTestStore(t)
+	defer closeStore()
+
+	tx := newTestCrossTx("a", contractlib.Init, "")
+	if err := store.Save([]*CrossTx{tx}); err != nil {
+		t.Fatal(err)
+	}
+
+	txm := NewTxManager(&client.Config{RetryBackoff: time.Second}, &recordFabricClient{}, failOutChainClient{}, store)
+	txm.pending.prq.Push(tx, 0)
+
+	// aborted while it is queued, the failed send is not retried
+	if err := store.Updates([]string{"a"}, []func(c *CrossTx) error{func(c *CrossTx) error {
+		return c.Transition(contractlib.Aborted, "abort event")
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	txm.sendPending()
+
+	if txm.retry.prq.Size() != 0 {
+		t.Fatalf("retries, want: 0, got: %d", txm.retry.prq.Size())
+	}
+	if got := store.One(CrossIdIndex, "a"); got.GetStatus() != contractlib.Aborted || got.Attempts != 0 {
+		t.Fatalf("aborted tx, got: %s %d attempts", got.GetStatus(), got.Attempts)
+	}
+
+	// the requeue of a tx which is not dead-lettered fails
+	if err := txm.Requeue("a"); err == nil {
+		t.Fatal("want error of requeueing an aborted tx")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	txm := NewTxManager(&client.Config{RetryBackoff: time.Second}, &recordFabricClient{}, failOutChainClient{}, nil)
+
+	for attempts, want := range map[uint32]time.Duration{1: time.Second, 2: 2 * time.Second, 4: 8 * time.Second, 64: maxRetryBackoff} {
+		if got := txm.backoff(attempts); got != want {
+			t.Fatalf("backoff(%d), want: %v, got: %v", attempts, want, got)
+		}
+	}
+}
+
+// scriptFabricClient answers the invocations with the scripted errors in turn,
+// the valid transaction is found in the ledger
+type scriptFabricClient struct {
+	recordFabricClient
+	errs  []error
+	valid fab.TransactionID
+}
+
+func (s *scriptFabricClient) QueryTxValidation(txID fab.TransactionID) (peer.TxValidationCode, error) {
+	if s.valid != "" && txID == s.valid {
+		return peer.TxValidationCode_VALID, nil
+	}
+	return s.recordFabricClient.QueryTxValidation(txID)
+}
+
+func (s *scriptFabricClient) InvokeChainCode(fcn string, args []string) (fab.TransactionID, error) {
+	s.recordFabricClient.InvokeChainCode(fcn, args)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := len(s.invokes)
+	txID := fab.TransactionID(fmt.Sprintf("commit-%d", n))
+	if n <= len(s.errs) {
+		return txID, s.errs[n-1]
+	}
+	return txID, nil
+}
+
+func TestCommitOutcome(t *testing.T) {
+	store, closeStore := newTestStore(t)
+	defer closeStore()
+
+	if err := store.Save([]*CrossTx{
+		newTestCrossTx("a", contractlib.Executed, "receipt-a"),
+		newTestCrossTx("b", contractlib.Executed, "receipt-b"),
+		newTestCrossTx("c", contractlib.Executed, "receipt-c"),
+		newTestCrossTx("d", contractlib.Executed, "receipt-d"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	mvcc := status.New(status.EventServerStatus, int32(peer.TxValidationCode_MVCC_READ_CONFLICT), "received invalid transaction", nil)
+	policy := status.New(status.EventServerStatus, int32(peer.TxValidationCode_ENDORSEMENT_POLICY_FAILURE), "received invalid transaction", nil)
+
+	rejected := status.New(status.ChaincodeStatus, 500, "contract c is already committed", nil)
+	timeout := status.New(status.ClientStatus, status.Timeout.ToInt32(), "timed out waiting for the tx status", nil)
+
+	fabCli := &scriptFabricClient{errs: []error{mvcc, nil, policy, rejected, timeout}, valid: "commit-5"}
+	txm := NewTxManager(&client.Config{RetryBackoff: time.Millisecond}, fabCli, &client.MockOutChainClient{}, store)
+
+	// MVCC conflict is resubmitted at once
+	txm.commit(CrossTxReceipt{CrossID: "a", Receipt: "receipt-a"})
+	if tx := store.One(CrossIdIndex, "a"); tx.CommitTxID != "commit-1" || tx.CommitOutcome != "Invalidated(MVCC_READ_CONFLICT)" {
+		t.Fatalf("commit a, want: commit-1 Invalidated(MVCC_READ_CONFLICT), got: %s %s", tx.CommitTxID, tx.CommitOutcome)
+	}
+
+	select {
+	case <-txm.executed.process:
+	case <-time.After(5 * time.Second):
+		t.Fatal("invalidated commit not resubmitted")
+	}
+
+	item, _ := txm.executed.prq.Pop()
+	txm.commit(item.(CrossTxReceipt))
+	if tx := store.One(CrossIdIndex, "a"); tx.CommitTxID != "commit-2" || tx.CommitOutcome != "Committed" {
+		t.Fatalf("commit a, want: commit-2 Committed, got: %s %s", tx.CommitTxID, tx.CommitOutcome)
+	}
+
+	// endorsement policy failure is not resubmitted
+	txm.commit(CrossTxReceipt{CrossID: "b", Receipt: "receipt-b"})
+	if tx := store.One(CrossIdIndex, "b"); tx.CommitOutcome != "Invalidated(ENDORSEMENT_POLICY_FAILURE)" {
+		t.Fatalf("commit b, want: Invalidated(ENDORSEMENT_POLICY_FAILURE), got: %s", tx.CommitOutcome)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if !txm.executed.prq.Empty() {
+		t.Fatal("commit with endorsement policy failure resubmitted")
+	}
+
+	// the chaincode rejection is not resubmitted
+	txm.commit(CrossTxReceipt{CrossID: "c", Receipt: "receipt-c"})
+	if tx := store.One(CrossIdIndex, "c"); tx.GetStatus() != contractlib.Executed || tx.CommitOutcome != "EndorsementFailed" {
+		t.Fatalf("commit c, want: Executed EndorsementFailed, got: %s %s", tx.GetStatus(), tx.CommitOutcome)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if !txm.executed.prq.Empty() {
+		t.Fatal("commit rejected by the chaincode resubmitted")
+	}
+
+	// the unknown outcome is retried after the backoff, the recorded commit tx is found valid without a new invocation
+	txm.commit(CrossTxReceipt{CrossID: "d", Receipt: "receipt-d"})
+	if tx := store.One(CrossIdIndex, "d"); tx.CommitTxID != "commit-5" || tx.CommitOutcome != "CommitUnknown" {
+		t.Fatalf("commit d, want: commit-5 CommitUnknown, got: %s %s", tx.CommitTxID, tx.CommitOutcome)
+	}
+
+	select {
+	case <-txm.executed.process:
+	case <-time.After(5 * time.Second):
+		t.Fatal("commit with unknown outcome not retried")
+	}
+
+	item, _ = txm.executed.prq.Pop()
+	txm.commit(item.(CrossTxReceipt))
+	if tx := store.One(CrossIdIndex, "d"); tx.CommitTxID != "commit-5" || tx.CommitOutcome != "Committed" {
+		t.Fatalf("commit d, want: commit-5 Committed, got: %s %s", tx.CommitTxID, tx.CommitOutcome)
+	}
+	if len(fabCli.invokes) != 5 {
+		t.Fatalf("commit d, want 5 invocations, got: %d", len(fabCli.invokes))
+	}
+}
+
+func TestCommitRetryStopAndExhausted(t *testing.T) {
+	store, closeStore := newTestStore(t)
+	defer closeStore()
+
+	if err := store.Save([]*CrossTx{
+		newTestCrossTx("a", contractlib.Executed, "receipt-a"),
+		newTestCrossTx("b", contractlib.Executed, "receipt-b"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	unavailable := fmt.Errorf("peer unavailable")
+	fabCli := &scriptFabricClient{errs: []error{unavailable, unavailable}}
+	txm := NewTxManager(&client.Config{MaxSendAttempts: 2, RetryBackoff: time.Hour}, fabCli, &client.MockOutChainClient{}, store)
+
+	// the retry waiting for its backoff is dropped by the stop
+	txm.commit(CrossTxReceipt{CrossID: "a", Receipt: "receipt-a"})
+
+	stopped := make(chan struct{})
+	go func() {
+		close(txm.stopCh)
+		txm.wg.Wait()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("commit retry blocks the stop")
+	}
+	if !txm.executed.prq.Empty() {
+		t.Fatal("commit retried after the stop")
+	}
+
+	// the last attempt records the exhausted outcome
+	txm.commit(CrossTxReceipt{CrossID: "b", Receipt: "receipt-b", commitAttempts: 1})
+	if tx := store.One(CrossIdIndex, "b"); tx.GetStatus() != contractlib.Executed || !strings.HasPrefix(tx.CommitOutcome, "Exhausted(2 attempts, last ") {
+		t.Fatalf("commit b, want: Executed and Exhausted, got: %s %s", tx.GetStatus(), tx.CommitOutcome)
+	}
+}
+
+func TestTransitionHistory(t *testing.T) {
+	store, closeStore := newTestStore(t)
+	defer closeStore()
+
+	if err := store.Save([]*CrossTx{newTestCrossTx("a", contractlib.Init, "")}); err != nil {
+		t.Fatal(err)
+	}
+
+	toPending := func(c *CrossTx) error { return c.Transition(contractlib.Pending, "sent") }
+	toInit := func(c *CrossTx) error { return c.Transition(contractlib.Init, "illegal") }
+
+	err := store.Updates([]string{"a", "a"}, []func(c *CrossTx) error{toPending, toInit})
+	if rejected, ok := rejectedUpdates(err); !ok || !errors.Is(rejected["a"], contractlib.ErrIllegalTransition) {
+		t.Fatalf("want the illegal transition rejected, got: %v", err)
+	}
+
+	tx := store.One(CrossIdIndex, "a")
+	if tx.GetStatus() != contractlib.Pending {
+		t.Fatalf("status, want: Pending, got: %s", tx.GetStatus())
+	}
+
+	if len(tx.History) != 2 || tx.History[0].To != contractlib.Init ||
+		tx.History[1].From != contractlib.Init || tx.History[1].To != contractlib.Pending || tx.History[1].Reason != "sent" {
+		t.Fatalf("history, want: [Init, Init->Pending], got: %+v", tx.History)
+	}
+}
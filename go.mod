@@ -17,6 +17,8 @@ require (
 	github.com/spf13/cobra v1.0.0
 	github.com/spf13/pflag v1.0.3
 	github.com/sykesm/zap-logfmt v0.0.3 // indirect
+	go.etcd.io/bbolt v1.3.4
 	go.uber.org/zap v1.15.0 // indirect
 	gopkg.in/jcmturner/goidentity.v3 v3.0.0 // indirect
+	modernc.org/sqlite v1.10.6
 )